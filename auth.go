@@ -1,17 +1,108 @@
 package postmaster
 
 import(
-	"github.com/nu7hatch/gouuid"
 	"errors"
 	"time"
 	"code.google.com/p/go.crypto/pbkdf2"
 	"encoding/base64"
 	"crypto/sha256"
 	"crypto/hmac"
-	"encoding/json"
-	"strings"
 )
 
+//
+//Authentication State
+//
+
+//Things that move a connection between auth states
+type authEvent int
+const (
+	AUTH_EVENT_REQUEST authEvent = iota //authreq answered with a challenge
+	AUTH_EVENT_SUCCESS //auth accepted
+	AUTH_EVENT_REJECT //authreq or auth refused; client may try again
+	AUTH_EVENT_LOCKOUT //Attempts exhausted or deadline passed
+	AUTH_EVENT_REVOKE //Server requires the client to authenticate again
+)
+
+//Allowed transitions; anything missing is refused
+var authTransitions = map[AuthState]map[authEvent]AuthState{
+	AUTH_STATE_NONE: {
+		AUTH_EVENT_REQUEST: AUTH_STATE_PENDING,
+		AUTH_EVENT_REJECT: AUTH_STATE_NONE,
+		AUTH_EVENT_LOCKOUT: AUTH_STATE_FAILED,
+	},
+	AUTH_STATE_PENDING: {
+		AUTH_EVENT_SUCCESS: AUTH_STATE_AUTHENTICATED,
+		AUTH_EVENT_REJECT: AUTH_STATE_NONE,
+		AUTH_EVENT_LOCKOUT: AUTH_STATE_FAILED,
+	},
+	AUTH_STATE_AUTHENTICATED: {
+		AUTH_EVENT_REVOKE: AUTH_STATE_NONE,
+	},
+}
+
+//Returns the state ev leads to from state; false if ev isn't allowed in state
+func nextAuthState(state AuthState, ev authEvent)(AuthState,bool){
+	next,ok := authTransitions[state][ev]
+	return next,ok
+}
+
+//Applies ev to the connection (lock must be held)
+func (c *Connection) authTransition(ev authEvent)(bool){
+	next,ok := nextAuthState(c.authState,ev)
+	if ok{
+		c.authState = next
+	}
+	return ok
+}
+
+//Applies ev to the connection, taking the lock
+func (c *Connection) applyAuthEvent(ev authEvent)(bool){
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	
+	return c.authTransition(ev)
+}
+
+//Counts a failed authreq/auth (lock must be held); the connection is locked out once
+//Server.MaxAuthAttempts is reached. Returns true if locked out.
+func (t *Server) authFailed(conn *Connection)(bool){
+	conn.pendingAuth = nil
+	conn.authFailures++
+	if t.MaxAuthAttempts > 0 && conn.authFailures >= t.MaxAuthAttempts{
+		conn.authTransition(AUTH_EVENT_LOCKOUT)
+		return true
+	}
+	conn.authTransition(AUTH_EVENT_REJECT)
+	return false
+}
+
+//Closes the connection if it hasn't authenticated by Server.AuthTimeout
+func (t *Server) startAuthTimer(conn *Connection){
+	if t.AuthTimeout <= 0{
+		return
+	}
+	
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	
+	conn.authTimer = time.AfterFunc(t.AuthTimeout, func(){
+		if conn.applyAuthEvent(AUTH_EVENT_LOCKOUT){
+			log.Warn("postmaster: closing connection %s: not authenticated within %s", conn.id, t.AuthTimeout)
+			conn.close()
+		}
+	})
+}
+
+//Stops the auth deadline (authenticated or gone)
+func (conn *Connection) stopAuthTimer(){
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	
+	if conn.authTimer != nil{
+		conn.authTimer.Stop()
+	}
+}
+
 //
 //Challenge Response Authentication Methods
 //
@@ -20,91 +111,151 @@ import(
 //returns string -- Authentication challenge. The client will need to create an authentication signature from this.
 func authRequest(t *Server, conn *Connection, authKey string, authExtra map[string]interface{})(string,error){
 	//Check for states that don't support authreq
-	if conn.isAuth{
+	switch conn.AuthState(){
+	case AUTH_STATE_AUTHENTICATED:
 	 	return "",errors.New("Connection already authenticated")
-	}else if conn.pendingAuth != nil{
+	case AUTH_STATE_PENDING:
 		return "",errors.New("Authentication request already issues - authentication pending")
+	case AUTH_STATE_FAILED:
+		return "",errors.New("Too many authentication attempts")
 	}
-		
-	//Get authKey TODO: add anynomous auth option
-	var secret string
-	if t.GetAuthSecret != nil{
-		var err error
-		secret,err = t.GetAuthSecret(authKey)
-		if err != nil{
-			return "",err //No matching secret: user probably doesn't exist
-		}
-	}else{
-		log.Error("GetAuthSecret nil: required method")
-		panic("Nil required method")
+	
+	//Pick auth method
+	method := AUTH_METHOD_WAMPCRA
+	if authKey == ""{
+		method = AUTH_METHOD_ANONYMOUS
+	}
+	if m,ok := authExtra["authmethod"].(string); ok{
+		method = m
 	}
 	
-	authID,_ := uuid.NewV4()
+	req := &AuthRequest{
+		AuthKey: authKey,
+		AuthExtra: authExtra,
+		Session: conn.id,
+	}
 	
-	//Create challenge
-	ch := map[string]interface{}{
-		"authid": authID,
-		"authkey": authKey,
-		"timestamp": time.Now().UTC().Format(time.RFC3339), //Might need to remove timezone information
-		"sessionid": conn.id,
-		"extra": authExtra,
-		"permissions":map[string]interface{}{ //Create false (always blank) permissions for autobahn compatability
-			"pubsub":[]string{},
-			"rpc":[]string{},
-		},
+	var ch string
+	a,ok := t.getAuthenticator(method)
+	err := t.checkLockout(conn,authKey)
+	if err == nil{
+		if !ok{
+			err = errors.New("Unsupported auth method: "+method)
+		}else if ch,err = a.Challenge(req); err != nil{
+			t.recordAuthFailure(conn,authKey) //Probing for auth keys counts too
+		}
 	}
 	
-	//Get Permission of this user
-	perms,err := t.GetAuthPermissions(authKey,authExtra)
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	
 	if err != nil{
-		log.Error("Error getting auth permissions")
+		t.authFailed(conn)
+		return "",err
 	}
 	
-	//Get signature for this key
-	authChallenge,_ := json.Marshal(ch) //Create challenge string
-	s := authSignature(authChallenge,secret,authExtra)
+	if !conn.authTransition(AUTH_EVENT_REQUEST){
+		return "",errors.New("Authentication request already issues - authentication pending") //Raced with another authreq
+	}
 	
-	pend := &PendingAuth{
+	req.Challenge = ch
+	conn.pendingAuth = &PendingAuth{ //Save for later auth rpc call
 		authKey:authKey,
 		authExtra:authExtra,
-		sig:s,
-		p: perms,
-		ch:authChallenge,
+		auth:a,
+		req:req,
 	}
 	
-	conn.pendingAuth = pend //Save for later auth rpc call
-	
-	return string(authChallenge),nil
+	return ch,nil
 } 
 //RPC endpoint for clients to actually authenticate after requesting authentication and computing a signature from the authentication challenge.
 func auth(t *Server, conn *Connection, signature string)(*Permissions,error){
-	if conn.isAuth{
-	 	return nil,errors.New("Connection already authenticated")
-	}else if conn.pendingAuth == nil{
-		return nil,errors.New("No pending authentication; call authreq first")
+	pend,err := conn.pendingAuthRequest()
+	if err != nil{
+		return nil,err
 	}
 	
-	log.Info(signature + "::" + conn.pendingAuth.sig)
+	//Check signature (without the lock; authenticators may be slow or panic)
+	defer func(){
+		if r := recover(); r != nil{
+			t.applyAuthResult(conn,pend,nil,ErrInvalidSignature) //Counts as a failure so the client can authreq again
+			panic(r)
+		}
+	}()
+	res,err := pend.auth.Authenticate(pend.req,signature)
+	if err == nil && res == nil{
+		err = errors.New("postmaster: Authenticate returned no result")
+	}
 	
-	//Check signature
-	if signature != conn.pendingAuth.sig{
-		conn.pendingAuth = nil
-		return nil,errors.New("Invalid signature; repeat with authreq")
+	p,failed,err := t.applyAuthResult(conn,pend,res,err)
+	if failed{
+		t.recordAuthFailure(conn,pend.authKey)
+	}
+	if err != nil{
+		return nil,err
 	}
 	
 	//
 	//Now sucessfully authenticated
 	//
 	
-	conn.isAuth = true
-	conn.P = &conn.pendingAuth.p //Set permissions
-	conn.Username = strings.ToLower(conn.pendingAuth.authKey) //FIXME probably best to do this outside of postmaster
+	conn.stopAuthTimer()
+	t.resetAuthFailures(pend.authKey)
 	
 	if t.OnAuthenticated != nil{
-		go t.OnAuthenticated(conn.Username, conn.pendingAuth.authExtra, *conn.P) //Signal to server that new conneciton made
+		go t.OnAuthenticated(res.Username, pend.authExtra, p) //Signal to server that new conneciton made
 	}
 
-	return conn.P,nil;
+	return &p,nil;
+}
+
+//Applies the outcome of Authenticate for pend. failed is set when the attempt counts towards lockout.
+func (t *Server) applyAuthResult(conn *Connection, pend *PendingAuth, res *AuthResult, authErr error)(p Permissions, failed bool, err error){
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	
+	if conn.pendingAuth != pend || conn.authState != AUTH_STATE_PENDING{
+		return p,false,errors.New("Authentication request no longer pending") //Raced with another auth or the auth deadline
+	}
+	if authErr != nil{
+		t.authFailed(conn)
+		return p,true,errors.New("Invalid signature; repeat with authreq")
+	}
+	
+	conn.authTransition(AUTH_EVENT_SUCCESS)
+	pend.p = res.Permissions
+	conn.perms = &pend.p //Set permissions
+	conn.username = res.Username
+	return pend.p,false,nil
+}
+
+//Returns the request an auth call answers; errors unless authreq is pending
+func (conn *Connection) pendingAuthRequest()(*PendingAuth,error){
+	conn.lock.RLock()
+	defer conn.lock.RUnlock()
+	
+	switch conn.authState{
+	case AUTH_STATE_AUTHENTICATED:
+	 	return nil,errors.New("Connection already authenticated")
+	case AUTH_STATE_NONE:
+		return nil,errors.New("No pending authentication; call authreq first")
+	case AUTH_STATE_FAILED:
+		return nil,errors.New("Too many authentication attempts")
+	}
+	return conn.pendingAuth,nil
+}
+
+//Looks up the authenticator for an auth method. Without a registered wampcra authenticator,
+//one is built from GetAuthSecret & GetAuthPermissions.
+func (t *Server) getAuthenticator(method string)(Authenticator,bool){
+	t.authLock.RLock()
+	a,ok := t.authenticators[method]
+	t.authLock.RUnlock()
+	
+	if !ok && method == AUTH_METHOD_WAMPCRA && t.GetAuthSecret != nil && t.GetAuthPermissions != nil{
+		return &CRAAuthenticator{GetSecret:t.GetAuthSecret, GetPermissions:t.GetAuthPermissions},true
+	}
+	return a,ok
 }
 
 
@@ -112,6 +263,37 @@ func auth(t *Server, conn *Connection, signature string)(*Permissions,error){
 // Crypto
 //
 
+//Defaults for PBKDF2 key derivation (same as Autobahn's WAMP v1 CRA)
+const (
+	CRA_ITERATIONS = 10000
+	CRA_KEYLEN = 32
+)
+
+//Secret for WAMP-CRA. With a Salt the client signs with a key derived from Secret by PBKDF2;
+//salt, iterations & keylen are sent to it in the challenge's "authextra".
+type CRASecret struct{
+	Secret string
+	Salt string //"" signs with Secret itself
+	Iterations int //Default CRA_ITERATIONS
+	KeyLen int //Default CRA_KEYLEN
+}
+
+//Derivation parameters for the challenge (nil without salt)
+func (s CRASecret) authExtra()(map[string]interface{}){
+	if s.Salt == ""{
+		return nil
+	}
+	
+	extra := map[string]interface{}{"salt": s.Salt}
+	if s.Iterations > 0{
+		extra["iterations"] = s.Iterations
+	}
+	if s.KeyLen > 0{
+		extra["keylen"] = s.KeyLen
+	}
+	return extra
+}
+
 /*
 	Computes a derived cryptographic key from a password according to PBKDF2 http://en.wikipedia.org/wiki/PBKDF2.
 
@@ -121,31 +303,31 @@ func auth(t *Server, conn *Connection, signature string)(*Permissions,error){
          iterations: Number of iterations of derivation algorithm to run.
          keylen: Key length to derive.
 
+	Numbers may be ints or float64 (as decoded from json).
+
 	returns the derived key or the original secret.
 */
 func deriveKey(secret string, extra map[string]interface{})(string){
 	//Salt needed to derive key
-	if salt,ok := extra["salt"]; ok{
-		iter := 10000
-		keyLen := 32
-		
-		//Check for custom values
-		if cIter,ok := extra["iterations"]; ok{
-			iter = cIter.(int)
-		}
-		if cKeylen,ok := extra["keylen"];ok{
-			keyLen = cKeylen.(int)
-		}
-		
-		dk := pbkdf2.Key([]byte(secret), []byte(salt.(string)), iter, keyLen, sha256.New)
-		key := base64.StdEncoding.EncodeToString(dk)
-		
-		return key
-		
-	}else{
+	salt,ok := extra["salt"].(string)
+	if !ok{
 		//just return secret
 		return secret
-	}	
+	}
+	
+	iter := CRA_ITERATIONS
+	keyLen := CRA_KEYLEN
+	
+	//Check for custom values
+	if cIter,ok := toInt(extra["iterations"]); ok && cIter > 0{
+		iter = cIter
+	}
+	if cKeylen,ok := toInt(extra["keylen"]); ok && cKeylen > 0{
+		keyLen = cKeylen
+	}
+	
+	dk := pbkdf2.Key([]byte(secret), []byte(salt), iter, keyLen, sha256.New)
+	return base64.StdEncoding.EncodeToString(dk)
 }
 
 func authSignature(authChallenge []byte,authSecret string, authExtra map[string]interface{})(string){
@@ -161,4 +343,21 @@ func authSignature(authChallenge []byte,authSecret string, authExtra map[string]
 	s := base64.StdEncoding.EncodeToString(sig)
 	
 	return s
-}
\ No newline at end of file
+}
+
+//Compares signatures in constant time
+func signaturesEqual(a string, b string)(bool){
+	return hmac.Equal([]byte(a),[]byte(b))
+}
+
+func toInt(v interface{})(int,bool){
+	switch n := v.(type){
+	case int:
+		return n,true
+	case int64:
+		return int(n),true
+	case float64:
+		return int(n),true
+	}
+	return 0,false
+}
@@ -0,0 +1,281 @@
+package postmaster
+
+import(
+	"errors"
+	"net"
+	"testing"
+	"time"
+	"code.google.com/p/go.net/websocket"
+)
+
+//Authenticator calling authenticate for each auth call
+type funcAuthenticator func(req *AuthRequest, signature string)(*AuthResult,error)
+
+func (f funcAuthenticator) Challenge(req *AuthRequest)(string,error){
+	return "challenge",nil
+}
+
+func (f funcAuthenticator) Authenticate(req *AuthRequest, signature string)(*AuthResult,error){
+	return f(req,signature)
+}
+
+//Connection with authreq answered by a
+func pendingConnection(t *testing.T, s *Server, a Authenticator)(*Connection){
+	s.RegisterAuthenticator("test", a)
+	conn := newConnection(s, "c", nil)
+	if _,err := authRequest(s, conn, "user", map[string]interface{}{"authmethod": "test"}); err != nil{
+		t.Fatal(err)
+	}
+	return conn
+}
+
+//A slow authenticator mustn't hold the connection lock
+func TestAuthenticateUnlocked(t *testing.T){
+	s := NewServer()
+	release := make(chan bool)
+	conn := pendingConnection(t, s, funcAuthenticator(func(req *AuthRequest, signature string)(*AuthResult,error){
+		<-release
+		return &AuthResult{Username: "user", Permissions: testPermissions()},nil
+	}))
+
+	done := make(chan error)
+	go func(){
+		_,err := auth(s, conn, "signature")
+		done <- err
+	}()
+
+	read := make(chan AuthState)
+	go func(){ read <- conn.AuthState() }()
+	select{
+	case state := <-read:
+		if state != AUTH_STATE_PENDING{
+			t.Errorf("state %d while authenticating, want pending", state)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection locked while authenticating")
+	}
+
+	close(release)
+	if err := <-done; err != nil{
+		t.Fatal(err)
+	}
+	if conn.Username() != "user" || conn.AuthState() != AUTH_STATE_AUTHENTICATED{
+		t.Errorf("not authenticated: %q %d", conn.Username(), conn.AuthState())
+	}
+
+	//A second auth racing the first doesn't authenticate again
+	if _,err := auth(s, conn, "signature"); err == nil{
+		t.Error("auth accepted twice")
+	}
+}
+
+//Only one of concurrent auth calls for the same authreq succeeds
+func TestConcurrentAuth(t *testing.T){
+	s := NewServer()
+	start := make(chan bool)
+	conn := pendingConnection(t, s, funcAuthenticator(func(req *AuthRequest, signature string)(*AuthResult,error){
+		<-start
+		if signature != "good"{
+			return nil,errors.New("bad signature")
+		}
+		return &AuthResult{Username: "user", Permissions: testPermissions()},nil
+	}))
+
+	results := make(chan error)
+	for _,sig := range []string{"good","good","bad"}{
+		go func(sig string){
+			_,err := auth(s, conn, sig)
+			results <- err
+		}(sig)
+	}
+	close(start)
+
+	succeeded := 0
+	for i := 0; i < 3; i++{
+		if <-results == nil{
+			succeeded++
+		}
+	}
+	if succeeded > 1{
+		t.Errorf("%d concurrent auth calls succeeded", succeeded)
+	}
+}
+
+func TestNextAuthState(t *testing.T){
+	tests := []struct{
+		state AuthState
+		ev authEvent
+		next AuthState
+		ok bool
+	}{
+		{AUTH_STATE_NONE, AUTH_EVENT_REQUEST, AUTH_STATE_PENDING, true},
+		{AUTH_STATE_NONE, AUTH_EVENT_SUCCESS, 0, false},
+		{AUTH_STATE_NONE, AUTH_EVENT_REJECT, AUTH_STATE_NONE, true},
+		{AUTH_STATE_NONE, AUTH_EVENT_LOCKOUT, AUTH_STATE_FAILED, true},
+		{AUTH_STATE_NONE, AUTH_EVENT_REVOKE, 0, false},
+
+		{AUTH_STATE_PENDING, AUTH_EVENT_REQUEST, 0, false},
+		{AUTH_STATE_PENDING, AUTH_EVENT_SUCCESS, AUTH_STATE_AUTHENTICATED, true},
+		{AUTH_STATE_PENDING, AUTH_EVENT_REJECT, AUTH_STATE_NONE, true},
+		{AUTH_STATE_PENDING, AUTH_EVENT_LOCKOUT, AUTH_STATE_FAILED, true},
+		{AUTH_STATE_PENDING, AUTH_EVENT_REVOKE, 0, false},
+
+		{AUTH_STATE_AUTHENTICATED, AUTH_EVENT_REQUEST, 0, false},
+		{AUTH_STATE_AUTHENTICATED, AUTH_EVENT_SUCCESS, 0, false},
+		{AUTH_STATE_AUTHENTICATED, AUTH_EVENT_REJECT, 0, false},
+		{AUTH_STATE_AUTHENTICATED, AUTH_EVENT_LOCKOUT, 0, false}, //The auth deadline doesn't close authenticated sessions
+		{AUTH_STATE_AUTHENTICATED, AUTH_EVENT_REVOKE, AUTH_STATE_NONE, true},
+
+		//Failed connections are only closed
+		{AUTH_STATE_FAILED, AUTH_EVENT_REQUEST, 0, false},
+		{AUTH_STATE_FAILED, AUTH_EVENT_SUCCESS, 0, false},
+		{AUTH_STATE_FAILED, AUTH_EVENT_REJECT, 0, false},
+		{AUTH_STATE_FAILED, AUTH_EVENT_LOCKOUT, 0, false},
+		{AUTH_STATE_FAILED, AUTH_EVENT_REVOKE, 0, false},
+	}
+	for _,test := range tests{
+		next,ok := nextAuthState(test.state, test.ev)
+		if ok != test.ok || (ok && next != test.next){
+			t.Errorf("nextAuthState(%s, %d) = %s %t, want %s %t", test.state, test.ev, next, ok, test.next, test.ok)
+		}
+	}
+}
+
+//Whether the server closes ws within wait
+func closedWithin(ws *websocket.Conn, wait time.Duration)(bool){
+	ws.SetReadDeadline(time.Now().Add(wait))
+	for{
+		var data []byte
+		err := websocket.Message.Receive(ws, &data)
+		if err == nil{
+			continue
+		}
+		if ne,ok := err.(net.Error); ok && ne.Timeout(){
+			return false
+		}
+		return true
+	}
+}
+
+func TestAuthTimeout(t *testing.T){
+	tests := []struct{
+		name string
+		login bool
+		closed bool
+	}{
+		{"unauthenticated", false, true},
+		{"authenticated", true, false},
+	}
+	for _,test := range tests{
+		s := newTestServer()
+		s.AuthTimeout = 100*time.Millisecond
+		ts := startServer(s)
+
+		ws := dial(t, ts)
+		if test.login{
+			login(t, ws, "alice")
+		}
+		if closed := closedWithin(ws, 500*time.Millisecond); closed != test.closed{
+			t.Errorf("%s: closed %t, want %t", test.name, closed, test.closed)
+		}
+
+		ws.Close()
+		ts.Close()
+	}
+}
+
+func TestMaxAuthAttempts(t *testing.T){
+	s := newTestServer()
+	s.MaxAuthAttempts = 2
+	ts := startServer(s)
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+	recv(t, ws) //WELCOME
+
+	for attempt := 1; attempt <= s.MaxAuthAttempts; attempt++{
+		send(t, ws, CALL, "authreq", WAMP_PROCEDURE_URL+"authreq", "alice")
+		if res := recv(t, ws); res[0] != float64(CALLRESULT){
+			t.Fatalf("attempt %d: authreq failed: %v", attempt, res)
+		}
+		send(t, ws, CALL, "auth", WAMP_PROCEDURE_URL+"auth", "wrong signature")
+		if res := recv(t, ws); res[0] != float64(CALLERROR){
+			t.Fatalf("attempt %d: wrong signature accepted: %v", attempt, res)
+		}
+
+		last := attempt == s.MaxAuthAttempts
+		if closed := closedWithin(ws, 200*time.Millisecond); closed != last{
+			t.Fatalf("attempt %d: closed %t, want %t", attempt, closed, last)
+		}
+	}
+}
+
+//Vectors from Autobahn's WAMP-CRA tests (autobahn.wamp.auth derive_key & compute_wcs)
+func TestCRAVectors(t *testing.T){
+	const secret = "L3L1YUE8Txlw"
+
+	keys := []struct{
+		extra map[string]interface{}
+		key string
+	}{
+		{nil, secret}, //No salt signs with the secret itself
+		{map[string]interface{}{"salt": "salt123", "iterations": 1000, "keylen": 32}, "qzcdsr9uu/L5hnss3kjNTRe490ETgA70ZBaB5rvnJ5Y="},
+		{map[string]interface{}{"salt": "salt123", "iterations": float64(1000), "keylen": float64(32)}, "qzcdsr9uu/L5hnss3kjNTRe490ETgA70ZBaB5rvnJ5Y="}, //As decoded from JSON
+		{map[string]interface{}{"salt": "salt123"}, "ekta8HNQe7+ee9fCuU6YITtA4f4qenDWgs/8PV1U23g="}, //CRA_ITERATIONS & CRA_KEYLEN
+	}
+	for _,test := range keys{
+		if got := deriveKey(secret, test.extra); got != test.key{
+			t.Errorf("deriveKey(%v) = %s, want %s", test.extra, got, test.key)
+		}
+	}
+
+	if got := authSignature([]byte("[1, 2, 3]"), secret, nil); got != "1njQtmmeYO41N5EWEzD2kAjjEKRZ5kPZt/TzpYXOzR0="{
+		t.Errorf("authSignature = %s, want 1njQtmmeYO41N5EWEzD2kAjjEKRZ5kPZt/TzpYXOzR0=", got)
+	}
+}
+
+//OnAuthenticated & OnDisconnect name the session by its authenticated username, not the auth key
+func TestCallbackIdentity(t *testing.T){
+	s := newTestServer()
+	s.RegisterAuthenticator(AUTH_METHOD_TICKET, funcAuthenticator(func(req *AuthRequest, signature string)(*AuthResult,error){
+		return &AuthResult{Username: "bob", Permissions: testPermissions()},nil
+	}))
+	authenticated := make(chan string,1)
+	disconnected := make(chan string,1)
+	s.OnAuthenticated = func(username string, authExtra map[string]interface{}, p Permissions){
+		authenticated <- username
+	}
+	s.OnDisconnect = func(username string, authExtra map[string]interface{}){
+		disconnected <- username
+	}
+	ts := startServer(s)
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	recv(t, ws) //WELCOME
+	send(t, ws, CALL, "1", WAMP_PROCEDURE_URL+"authreq", "alice", map[string]interface{}{"authmethod": AUTH_METHOD_TICKET})
+	recv(t, ws)
+	send(t, ws, CALL, "2", WAMP_PROCEDURE_URL+"auth", "ticket")
+	if res := recv(t, ws); res[0] != float64(CALLRESULT){
+		t.Fatalf("auth failed: %v", res)
+	}
+	ws.Close()
+
+	for _,cb := range []struct{
+		name string
+		got chan string
+	}{
+		{"OnAuthenticated", authenticated},
+		{"OnDisconnect", disconnected},
+	}{
+		select{
+		case username := <-cb.got:
+			if username != "bob"{
+				t.Errorf("%s: %q, want bob", cb.name, username)
+			}
+		case <-time.After(2*time.Second):
+			t.Errorf("%s not called", cb.name)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package postmaster
+
+import(
+	"github.com/nu7hatch/gouuid"
+	"errors"
+	"time"
+	"encoding/json"
+	"crypto/subtle"
+	"strings"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Authenticators
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Authentication methods clients select with authExtra["authmethod"] in authreq
+const (
+	AUTH_METHOD_WAMPCRA = "wampcra" //Default
+	AUTH_METHOD_ANONYMOUS = "anonymous" //Default when authreq has no auth key
+	AUTH_METHOD_TICKET = "ticket"
+)
+
+var ErrUnknownAuthKey = errors.New("postmaster: unknown auth key")
+var ErrInvalidSignature = errors.New("postmaster: invalid signature")
+
+//Authentication attempt, passed to both steps of an Authenticator
+type AuthRequest struct{
+	AuthKey string //"" for anonymous clients
+	AuthExtra map[string]interface{}
+	Session ConnectionID
+	Challenge string //Result of Authenticator.Challenge (set before Authenticate is called)
+}
+
+//Identity and permissions of an authenticated client
+type AuthResult struct{
+	Username string
+	Permissions Permissions
+}
+
+//Authenticates clients with one auth method (WAMP v1 authreq/auth calls).
+//Authenticators are shared by every connection and must be safe for concurrent use.
+type Authenticator interface{
+	//Returns the challenge sent back to the client as the authreq result
+	Challenge(req *AuthRequest)(string,error)
+
+	//Checks the client's answer to the challenge (the auth call argument)
+	Authenticate(req *AuthRequest, signature string)(*AuthResult,error)
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+//WAMP-CRA: the client signs the challenge with its secret
+type CRAAuthenticator struct{
+	//Get the authentication secret (and key derivation parameters) for an authentication key
+	GetSecret func(authKey string)(CRASecret,error) // Required
+
+	//Get the permissions the session is granted when the authentication succeeds
+	GetPermissions func(authKey string,authExtra map[string]interface{})(Permissions,error) // Required
+}
+
+func (a *CRAAuthenticator) Challenge(req *AuthRequest)(string,error){
+	secret,err := a.GetSecret(req.AuthKey)
+	if err != nil{
+		return "",err //No matching secret: user probably doesn't exist
+	}
+
+	authID,_ := uuid.NewV4()
+
+	//Create challenge
+	ch := map[string]interface{}{
+		"authid": authID,
+		"authkey": req.AuthKey,
+		"timestamp": time.Now().UTC().Format(time.RFC3339), //Might need to remove timezone information
+		"sessionid": req.Session,
+		"extra": req.AuthExtra,
+		"permissions":map[string]interface{}{ //Create false (always blank) permissions for autobahn compatability
+			"pubsub":[]string{},
+			"rpc":[]string{},
+		},
+	}
+	if extra := secret.authExtra(); extra != nil{
+		ch["authextra"] = extra //Client derives its signing key with these
+	}
+
+	authChallenge,_ := json.Marshal(ch) //Create challenge string
+	return string(authChallenge),nil
+}
+
+func (a *CRAAuthenticator) Authenticate(req *AuthRequest, signature string)(*AuthResult,error){
+	secret,err := a.GetSecret(req.AuthKey)
+	if err != nil{
+		return nil,err
+	}
+
+	//Get signature for this key
+	sig := authSignature([]byte(req.Challenge),secret.Secret,secret.authExtra())
+	if !signaturesEqual(signature,sig){
+		return nil,ErrInvalidSignature
+	}
+
+	perms,err := a.GetPermissions(req.AuthKey,req.AuthExtra)
+	if err != nil{
+		return nil,err
+	}
+
+	return &AuthResult{Username:strings.ToLower(req.AuthKey), Permissions:perms},nil //FIXME probably best to lowercase outside of postmaster
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Lets clients in without credentials (e.g. public read-only widgets)
+type AnonymousAuthenticator struct{
+	Username string //Name given to anonymous sessions (default "anonymous")
+	Permissions Permissions //Granted to every anonymous session
+}
+
+func (a *AnonymousAuthenticator) Challenge(req *AuthRequest)(string,error){
+	return "",nil //Nothing to sign
+}
+
+func (a *AnonymousAuthenticator) Authenticate(req *AuthRequest, signature string)(*AuthResult,error){
+	name := a.Username
+	if name == ""{
+		name = AUTH_METHOD_ANONYMOUS
+	}
+
+	return &AuthResult{Username:name, Permissions:a.Permissions},nil
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Static tickets (tokens): the client passes its ticket as the auth signature
+type TicketAuthenticator struct{
+	Tickets map[string]string //Maps auth key to ticket; not modified once serving
+
+	//Get the permissions for an auth key; Permissions is used if nil
+	GetPermissions func(authKey string,authExtra map[string]interface{})(Permissions,error) // Optional
+	Permissions Permissions
+}
+
+func (a *TicketAuthenticator) Challenge(req *AuthRequest)(string,error){
+	if _,ok := a.Tickets[req.AuthKey]; !ok{
+		return "",ErrUnknownAuthKey
+	}
+	return "",nil //Ticket is sent as is
+}
+
+func (a *TicketAuthenticator) Authenticate(req *AuthRequest, signature string)(*AuthResult,error){
+	ticket,ok := a.Tickets[req.AuthKey]
+	if !ok || subtle.ConstantTimeCompare([]byte(signature),[]byte(ticket)) != 1{
+		return nil,ErrInvalidSignature
+	}
+
+	perms := a.Permissions
+	if a.GetPermissions != nil{
+		var err error
+		if perms,err = a.GetPermissions(req.AuthKey,req.AuthExtra); err != nil{
+			return nil,err
+		}
+	}
+
+	return &AuthResult{Username:strings.ToLower(req.AuthKey), Permissions:perms},nil
+}
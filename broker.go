@@ -0,0 +1,103 @@
+package postmaster
+
+import(
+	"errors"
+	"sync"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Broker
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Event passed between postmaster instances
+type BrokerEvent struct{
+	Origin string //Node ID of the publishing instance
+	Realm string //WAMP v2 realm (Server.V1Realm for v1 publications)
+	TopicURI string
+	Event interface{} //Payload as seen by v1 subscribers
+	Arguments []interface{} //Payload of v2 publications
+	ArgumentsKw map[string]interface{}
+	ExcludeList []string //Session IDs that must not receive the event
+	EligibleList []string //If non-nil, only these session IDs may receive the event
+	Publication WAMPID //v2 publication ID (assigned on delivery if 0)
+	Retain bool //Kept for later subscribers, whether or not the topic is retained (see Server.RetainStore)
+}
+
+//Payload for v2 subscribers; v1 events become a single argument
+func (ev *BrokerEvent) v2Arguments()([]interface{},map[string]interface{}){
+	if ev.Arguments != nil || ev.ArgumentsKw != nil{
+		return ev.Arguments,ev.ArgumentsKw
+	}
+	return []interface{}{ev.Event},nil
+}
+
+//Distributes events between postmaster instances.
+//Nodes only deliver events they recieve locally and never forward them on, so events can't loop.
+type Broker interface{
+	//Registers a node with the broker; deliver is called for every event published by another node
+	Attach(nodeID string, deliver func(*BrokerEvent)) error
+
+	//Removes a node from the broker
+	Detach(nodeID string) error
+
+	//Sends an event to every other attached node (ev.Origin identifies the sender)
+	Publish(ev *BrokerEvent) error
+}
+
+var ErrNodeAttached = errors.New("postmaster: node already attached to broker")
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+//In process broker; connects several Servers in the same process (mostly useful for tests)
+type MemoryBroker struct{
+	nodes map[string]func(*BrokerEvent)
+	lock *sync.RWMutex
+}
+
+func NewMemoryBroker()*MemoryBroker{
+	return &MemoryBroker{
+		nodes: make(map[string]func(*BrokerEvent)),
+		lock: new(sync.RWMutex),
+	}
+}
+
+func (b *MemoryBroker) Attach(nodeID string, deliver func(*BrokerEvent)) error{
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _,ok := b.nodes[nodeID]; ok{
+		return ErrNodeAttached
+	}
+	b.nodes[nodeID] = deliver
+
+	return nil
+}
+
+func (b *MemoryBroker) Detach(nodeID string) error{
+	b.lock.Lock()
+	delete(b.nodes,nodeID)
+	b.lock.Unlock()
+
+	return nil
+}
+
+func (b *MemoryBroker) Publish(ev *BrokerEvent) error{
+	//Copy targets so delivery happens without lock held
+	b.lock.RLock()
+	var targets []func(*BrokerEvent)
+	for id,deliver := range b.nodes{
+		if id != ev.Origin{
+			targets = append(targets,deliver)
+		}
+	}
+	b.lock.RUnlock()
+
+	for _,deliver := range targets{
+		deliver(ev)
+	}
+
+	return nil
+}
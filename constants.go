@@ -1,6 +1,7 @@
 package postmaster
 
 import(
+	"time"
 	"github.com/jcelliott/lumber"
 )
 var (
@@ -13,7 +14,19 @@ const (
 )
 
 const ALLOWED_BACKLOG = 6
+const MAX_CALLS_IN_FLIGHT = 8 //Default Server.MaxCallsInFlight
+const INVOCATION_TIMEOUT = 30*time.Second //Default Server.InvocationTimeout
+const MAX_MESSAGE_DEPTH = 10000 //Nesting of lists & dictionaries allowed in a JSON message
 
 //Auth: wamp cra
 const WAMP_BASE_URL = "http://api.wamp.ws/"
 const WAMP_PROCEDURE_URL = WAMP_BASE_URL+"procedure#"
+
+//Error URIs sent in CALLERROR messages
+const WAMP_ERROR_URL = WAMP_BASE_URL+"error#"
+const ERROR_NOT_AUTHORIZED = WAMP_ERROR_URL+"not-authorized" //Session lacks Permissions.RPC for the procedure
+const ERROR_SHUTTING_DOWN = WAMP_ERROR_URL+"shutting-down" //Server is shutting down (see Server.Shutdown)
+const ERROR_INVALID_ARGUMENT = WAMP_ERROR_URL+"invalid-argument" //Call arguments don't fit a typed procedure (see Server.RegisterTypedRPC)
+const ERROR_RUNTIME = WAMP_ERROR_URL+"runtime-error" //Procedure failed, e.g. a typed procedure returned a Go error
+const ERROR_INTERNAL = WAMP_ERROR_URL+"internal-error" //Handling the message panicked (see Server.OnPanic)
+const ERROR_TIMEOUT = WAMP_ERROR_URL+"timeout" //Procedure didn't answer within its timeout (see Server.RegisterRPCContext)
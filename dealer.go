@@ -0,0 +1,378 @@
+package postmaster
+
+import(
+	"errors"
+	"sync"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Dealer (client registered procedures)
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+var ErrProcedureExists = errors.New("postmaster: procedure already registered")
+
+//Procedure implemented by a client
+type registration struct{
+	id WAMPID
+	key string //topicKey(realm, procedure)
+	procedure string
+	callee *Connection
+}
+
+//Call routed to a callee, waiting on its YIELD or ERROR
+type invocation struct{
+	id WAMPID
+	reg *registration
+	caller *Connection
+	callID string //v1 callers
+	request WAMPID //v2 callers
+	timer *time.Timer //Expires the invocation; nil if it never times out
+}
+
+type dealer struct{
+	procedures map[string]*registration //Keyed by topicKey(realm, procedure)
+	registrations map[WAMPID]*registration
+	invocations map[WAMPID]*invocation
+	calls *sync.WaitGroup //Server.calls; each invocation counts until it's removed
+	lock *sync.Mutex
+}
+
+func newDealer(calls *sync.WaitGroup)(*dealer){
+	return &dealer{
+		procedures: make(map[string]*registration),
+		registrations: make(map[WAMPID]*registration),
+		invocations: make(map[WAMPID]*invocation),
+		calls: calls,
+		lock: new(sync.Mutex),
+	}
+}
+
+func (d *dealer) register(callee *Connection, procedure string)(*registration,error){
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	key := topicKey(callee.realm,procedure)
+	if _,ok := d.procedures[key]; ok{
+		return nil,ErrProcedureExists
+	}
+
+	reg := &registration{id:newWAMPID(), key:key, procedure:procedure, callee:callee}
+	d.procedures[key] = reg
+	d.registrations[reg.id] = reg
+
+	return reg,nil
+}
+
+//Removes a registration owned by callee; false if there is none
+func (d *dealer) unregister(callee *Connection, id WAMPID)(bool){
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	reg,ok := d.registrations[id]
+	if !ok || reg.callee != callee{
+		return false
+	}
+
+	delete(d.registrations,id)
+	delete(d.procedures,reg.key)
+	return true
+}
+
+func (d *dealer) lookup(realm string, procedure string)(*registration,bool){
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	reg,ok := d.procedures[topicKey(realm,procedure)]
+	return reg,ok
+}
+
+//Records a call waiting on the callee; expired is called with it if the callee hasn't answered within timeout (0 never expires).
+//The caller has already added the invocation to d.calls (Server.beginCall).
+func (d *dealer) invoke(reg *registration, caller *Connection, callID string, request WAMPID, timeout time.Duration, expired func(*invocation))(*invocation){
+	inv := &invocation{id:newWAMPID(), reg:reg, caller:caller, callID:callID, request:request}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.invocations[inv.id] = inv
+	if timeout > 0{
+		inv.timer = time.AfterFunc(timeout, func(){
+			if d.expire(inv.id){
+				expired(inv)
+			}
+		})
+	}
+
+	return inv
+}
+
+//Removes an invocation that timed out; false if it was answered first
+func (d *dealer) expire(id WAMPID)(bool){
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	inv,ok := d.invocations[id]
+	if !ok{
+		return false
+	}
+	d.remove(inv)
+	return true
+}
+
+//Removes an invocation, stops its timer and releases its count in d.calls (d.lock held)
+func (d *dealer) remove(inv *invocation){
+	delete(d.invocations,inv.id)
+	if inv.timer != nil{
+		inv.timer.Stop()
+	}
+	d.calls.Done()
+}
+
+//Removes and returns the invocation answered by callee
+func (d *dealer) complete(callee *Connection, id WAMPID)(*invocation,bool){
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	inv,ok := d.invocations[id]
+	if !ok || inv.reg.callee != callee{
+		return nil,false
+	}
+
+	d.remove(inv)
+	return inv,true
+}
+
+//Registrations held by callee
+func (d *dealer) forSession(callee *Connection)([]*registration){
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var regs []*registration
+	for _,reg := range d.registrations{
+		if reg.callee == callee{
+			regs = append(regs,reg)
+		}
+	}
+	return regs
+}
+
+//Drops everything belonging to a disconnected session; returns calls its procedures left unanswered
+func (d *dealer) removeSession(c *Connection)([]*invocation){
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for id,reg := range d.registrations{
+		if reg.callee == c{
+			delete(d.registrations,id)
+			delete(d.procedures,reg.key)
+		}
+	}
+
+	var orphaned []*invocation
+	for _,inv := range d.invocations{
+		if inv.reg.callee == c{
+			orphaned = append(orphaned,inv)
+			d.remove(inv)
+		}else if inv.caller == c{
+			d.remove(inv) //No one to answer
+		}
+	}
+
+	return orphaned
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Dealer Message Handling
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+func (t *Server) handleRegister(conn *Connection, msg RegisterMsg){
+	log.Trace("postmaster: handling register message")
+
+	//Checked and registered under grantLock so permissions replaced meanwhile can't miss it (see SetPermissions)
+	conn.grantLock.Lock()
+	defer conn.grantLock.Unlock()
+
+	if !conn.Permissions().canRegister(msg.Procedure){
+		log.Warn("postmaster: RPC register not permitted for %s: %s", conn.Username(), msg.Procedure)
+		t.sendErrorV2(conn, V2_REGISTER, msg.Request, &RPCError{URI:V2_ERROR_NOT_AUTHORIZED, Description:"not authorized to register procedure", Details:msg.Procedure})
+		return
+	}
+
+	//Server procedures can't be replaced by clients
+	_,isHook := t.getHook(msg.Procedure, false)
+	_,isUnauthHook := t.getHook(msg.Procedure, true)
+
+	var reg *registration
+	err := ErrProcedureExists
+	if !isHook && !isUnauthHook{
+		reg,err = t.dealer.register(conn, msg.Procedure)
+	}
+	if err != nil{
+		t.sendErrorV2(conn, V2_REGISTER, msg.Request, &RPCError{URI:V2_ERROR_PROCEDURE_ALREADY_EXISTS, Description:"procedure already exists", Details:msg.Procedure})
+		return
+	}
+
+	registered := &RegisteredMsg{Request: msg.Request, Registration: reg.id}
+	conn.sendMessage(registered)
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+func (t *Server) handleUnregister(conn *Connection, msg UnregisterMsg){
+	if !t.dealer.unregister(conn, msg.Registration){
+		t.sendErrorV2(conn, V2_UNREGISTER, msg.Request, &RPCError{URI:V2_ERROR_NO_SUCH_REGISTRATION, Description:"no such registration"})
+		return
+	}
+
+	unregistered := &UnregisteredMsg{Request: msg.Request}
+	conn.sendMessage(unregistered)
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+func (t *Server) handleYield(conn *Connection, msg YieldMsg){
+	inv,ok := t.dealer.complete(conn, msg.Request)
+	if !ok{
+		log.Warn("postmaster: yield for unknown invocation dropped: %d", msg.Request)
+		return
+	}
+
+	t.sendInvocationResult(inv, msg.Arguments, msg.ArgumentsKw)
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Callee errors are passed back to the caller
+func (t *Server) handleInvocationError(conn *Connection, msg ErrorMsg){
+	inv,ok := t.dealer.complete(conn, msg.Request)
+	if !ok{
+		log.Warn("postmaster: error for unknown invocation dropped: %d", msg.Request)
+		return
+	}
+
+	t.sendInvocationError(inv, msg.Error, msg.Arguments, msg.ArgumentsKw)
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Dealer Utility Functions
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Routes a CALL to the client that registered the procedure; the caller gets wamp.error.canceled if no answer comes within timeout
+func (t *Server) invokeClient(caller *Connection, reg *registration, callID string, request WAMPID, args []interface{}, kwargs map[string]interface{}, timeout time.Duration){
+	//Counted like server procedures, so Shutdown waits for the callee's answer
+	if !t.beginCall(){
+		err := shutdownError(caller)
+		t.sendInvocationError(&invocation{caller:caller, callID:callID, request:request}, err.URI, []interface{}{err.Description}, nil)
+		return
+	}
+
+	inv := t.dealer.invoke(reg, caller, callID, request, timeout, func(inv *invocation){
+		log.Warn("postmaster: invocation of %s timed out after %s", reg.procedure, timeout)
+		t.sendInvocationError(inv, V2_ERROR_CANCELED, []interface{}{"call timed out"}, nil)
+	})
+
+	msg := &InvocationMsg{
+		Request: inv.id,
+		Registration: reg.id,
+		Arguments: args,
+		ArgumentsKw: kwargs,
+	}
+	if !reg.callee.sendMessage(msg){
+		t.dealer.complete(reg.callee, inv.id)
+		t.sendInvocationError(inv, V2_ERROR_CANCELED, []interface{}{"callee unavailable"}, nil)
+	}
+}
+
+//Time a client procedure has to answer (0 never expires). v2 callers may shorten it with the CALL "timeout"
+//option (ms), to at most INVOCATION_TIMEOUT when the server never times out.
+func (t *Server) invocationTimeout(options map[string]interface{})(time.Duration){
+	timeout := t.InvocationTimeout
+	if timeout == 0{
+		timeout = INVOCATION_TIMEOUT
+	}else if timeout < 0{
+		timeout = 0
+	}
+
+	if ms,ok := options["timeout"].(float64); ok && ms > 0{
+		//Clamp before converting; huge values would overflow to a negative Duration
+		limit := timeout
+		if limit == 0{
+			limit = INVOCATION_TIMEOUT
+		}
+		if ms > float64(limit/time.Millisecond){
+			ms = float64(limit/time.Millisecond)
+		}
+		if requested := time.Duration(ms*float64(time.Millisecond)); requested > 0{
+			timeout = requested
+		}
+	}
+	return timeout
+}
+
+//Answers the caller of an invocation
+func (t *Server) sendInvocationResult(inv *invocation, args []interface{}, kwargs map[string]interface{}){
+	var out wampMessage
+	if inv.caller.version == 2{
+		out = &ResultMsg{Request: inv.request, Arguments: args, ArgumentsKw: kwargs}
+	}else{
+		//v1 results are a single value
+		var res interface{}
+		switch{
+		case len(args) == 1:
+			res = args[0]
+		case len(args) > 1:
+			res = args
+		case kwargs != nil:
+			res = kwargs
+		}
+		out = &CallResultMsg{CallID: inv.callID, Result: res}
+	}
+	inv.caller.sendMessage(out)
+}
+
+//Passes an error to the caller of an invocation
+func (t *Server) sendInvocationError(inv *invocation, uri string, args []interface{}, kwargs map[string]interface{}){
+	if inv.caller.version == 2{
+		errMsg := &ErrorMsg{
+			RequestType: V2_CALL,
+			Request: inv.request,
+			Error: uri,
+			Arguments: args,
+			ArgumentsKw: kwargs,
+		}
+		inv.caller.sendMessage(errMsg)
+		return
+	}
+
+	//v1 errors carry a description and optional details
+	callError := &CallErrorMsg{CallID: inv.callID, ErrorURI: uri, ErrorDesc: uri}
+	if len(args) > 0{
+		if desc,ok := args[0].(string); ok{
+			callError.ErrorDesc = desc
+			args = args[1:]
+		}
+	}
+	if len(args) > 0{
+		callError.ErrorDetails = args[0]
+	}else if kwargs != nil{
+		callError.ErrorDetails = kwargs
+	}
+	inv.caller.sendMessage(callError)
+}
+
+//Unregisters a departing session's procedures and fails calls waiting on it
+func (t *Server) releaseProcedures(c *Connection){
+	for _,inv := range t.dealer.removeSession(c){
+		t.sendInvocationError(inv, V2_ERROR_CANCELED, []interface{}{"callee disconnected"}, nil)
+	}
+}
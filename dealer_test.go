@@ -0,0 +1,90 @@
+package postmaster
+
+import(
+	"testing"
+	"time"
+)
+
+func TestInvocationTimeout(t *testing.T){
+	tests := []struct{
+		name string
+		serverTimeout time.Duration
+		options map[string]interface{}
+		canceled bool
+	}{
+		{"server default", 50*time.Millisecond, map[string]interface{}{}, true},
+		{"call option", -1, map[string]interface{}{"timeout": 50}, true},
+		{"option can't extend", 50*time.Millisecond, map[string]interface{}{"timeout": 60000}, true},
+		{"never", -1, map[string]interface{}{}, false},
+	}
+	for _,test := range tests{
+		s := newTestServer()
+		s.InvocationTimeout = test.serverTimeout
+		ts := startServer(s)
+
+		callee := dial(t, ts, WAMP_V2_JSON_PROTOCOL)
+		join(t, callee, nil)
+		send(t, callee, V2_REGISTER, 1, map[string]interface{}{}, "add")
+		if msg := recv(t, callee); msg[0] != float64(V2_REGISTERED){
+			t.Fatalf("%s: register failed: %v", test.name, msg)
+		}
+
+		caller := dial(t, ts, WAMP_V2_JSON_PROTOCOL)
+		join(t, caller, nil)
+		send(t, caller, V2_CALL, 2, test.options, "add", []interface{}{1, 2})
+		invocation := recv(t, callee) //Never answered in time
+
+		if test.canceled{
+			msg := recv(t, caller)
+			if msg[0] != float64(V2_ERROR) || msg[4] != V2_ERROR_CANCELED{
+				t.Errorf("%s: expected canceled error, got %v", test.name, msg)
+			}
+			s.dealer.lock.Lock()
+			if n := len(s.dealer.invocations); n != 0{
+				t.Errorf("%s: %d invocations left after timeout", test.name, n)
+			}
+			s.dealer.lock.Unlock()
+
+			//A late answer is dropped
+			send(t, callee, V2_YIELD, invocation[1], map[string]interface{}{}, []interface{}{3})
+			recvNothing(t, caller)
+		}else{
+			recvNothing(t, caller)
+			send(t, callee, V2_YIELD, invocation[1], map[string]interface{}{}, []interface{}{3})
+			if msg := recv(t, caller); msg[0] != float64(V2_RESULT){
+				t.Errorf("%s: expected result, got %v", test.name, msg)
+			}
+		}
+
+		callee.Close()
+		caller.Close()
+		ts.Close()
+	}
+}
+
+func TestInvocationTimeoutOption(t *testing.T){
+	tests := []struct{
+		server time.Duration
+		option interface{}
+		timeout time.Duration
+	}{
+		{0, nil, INVOCATION_TIMEOUT},
+		{-1, nil, 0},
+		{time.Minute, float64(100), 100*time.Millisecond},
+		{time.Minute, float64(0.5), 500*time.Microsecond},
+		{time.Minute, float64(0), time.Minute},
+		{time.Minute, float64(-100), time.Minute},
+		{time.Minute, "100", time.Minute},
+		{time.Minute, float64(120000), time.Minute}, //Can't extend
+		{time.Minute, float64(1e300), time.Minute}, //Would overflow
+		{-1, float64(100), 100*time.Millisecond},
+		{-1, float64(1e300), INVOCATION_TIMEOUT},
+	}
+	for _,test := range tests{
+		s := NewServer()
+		s.InvocationTimeout = test.server
+		if got := s.invocationTimeout(map[string]interface{}{"timeout": test.option}); got != test.timeout{
+			t.Errorf("server %s, option %v: timeout %s, want %s", test.server, test.option, got, test.timeout)
+		}
+	}
+}
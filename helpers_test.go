@@ -0,0 +1,139 @@
+package postmaster
+
+import(
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"code.google.com/p/go.net/websocket"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Test Utility Functions
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+const testSecret = "secret"
+
+//Server granting every v1 user pub/sub on "topic" (password testSecret) and v2 sessions in "realm1" the same
+func newTestServer()(*Server){
+	s := NewServer()
+	s.V1Realm = "realm1"
+	s.GetAuthSecret = func(authKey string)(CRASecret,error){
+		return CRASecret{Secret: testSecret},nil
+	}
+	s.GetAuthPermissions = func(authKey string, authExtra map[string]interface{})(Permissions,error){
+		return testPermissions(),nil
+	}
+	s.GetRealmPermissions = func(realm string, details map[string]interface{})(Permissions,error){
+		if realm != "realm1"{
+			return Permissions{},ErrNoSuchRealm
+		}
+		return testPermissions(),nil
+	}
+	return s
+}
+
+func testPermissions()(Permissions){
+	return Permissions{
+		RPC: map[string]RPCPermission{"add": {CanCall: true, CanRegister: true}},
+		PubSub: map[string]PubSubPermission{"topic": {CanPublish: true, CanSubscribe: true}},
+	}
+}
+
+func startServer(s *Server)(*httptest.Server){
+	return httptest.NewServer(websocket.Server{Handler: HandleWebsocket(s), Handshake: Handshake})
+}
+
+//Opens a websocket offering protocols (none speaks WAMP v1)
+func dial(t testing.TB, ts *httptest.Server, protocols ...string)(*websocket.Conn){
+	cfg,err := websocket.NewConfig("ws"+strings.TrimPrefix(ts.URL,"http")+"/", ts.URL)
+	if err != nil{
+		t.Fatal(err)
+	}
+	cfg.Protocol = protocols
+	ws,err := websocket.DialConfig(cfg)
+	if err != nil{
+		t.Fatal(err)
+	}
+	return ws
+}
+
+//Sends a JSON message
+func send(t testing.TB, ws *websocket.Conn, msg ...interface{}){
+	data,err := json.Marshal(msg)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if err := websocket.Message.Send(ws, string(data)); err != nil{
+		t.Fatal(err)
+	}
+}
+
+//Recieves a JSON message (failing after 2s)
+func recv(t testing.TB, ws *websocket.Conn)([]interface{}){
+	ws.SetReadDeadline(time.Now().Add(2*time.Second))
+	var data []byte
+	if err := websocket.Message.Receive(ws, &data); err != nil{
+		t.Fatalf("recieve: %s", err)
+	}
+	var msg []interface{}
+	if err := json.Unmarshal(data, &msg); err != nil{
+		t.Fatalf("invalid message %s: %s", data, err)
+	}
+	return msg
+}
+
+//Fails if a message arrives within 200ms
+func recvNothing(t testing.TB, ws *websocket.Conn){
+	ws.SetReadDeadline(time.Now().Add(200*time.Millisecond))
+	var data []byte
+	if err := websocket.Message.Receive(ws, &data); err == nil{
+		t.Fatalf("unexpected message %s", data)
+	}
+}
+
+//Reads WELCOME and authenticates a v1 connection with WAMP-CRA
+func login(t testing.TB, ws *websocket.Conn, user string){
+	recv(t, ws) //WELCOME
+	authenticate(t, ws, user)
+}
+
+//Authenticates a v1 connection with WAMP-CRA
+func authenticate(t testing.TB, ws *websocket.Conn, user string){
+	send(t, ws, CALL, "authreq", WAMP_PROCEDURE_URL+"authreq", user)
+	challenge := recv(t, ws)
+	if challenge[0] != float64(CALLRESULT){
+		t.Fatalf("authreq failed: %v", challenge)
+	}
+	send(t, ws, CALL, "auth", WAMP_PROCEDURE_URL+"auth", authSignature([]byte(challenge[2].(string)), testSecret, nil))
+	if res := recv(t, ws); res[0] != float64(CALLRESULT){
+		t.Fatalf("auth failed: %v", res)
+	}
+}
+
+//Joins realm1 over WAMP v2 JSON; returns the session ID
+func join(t testing.TB, ws *websocket.Conn, details map[string]interface{})(float64){
+	if details == nil{
+		details = map[string]interface{}{}
+	}
+	send(t, ws, V2_HELLO, "realm1", details)
+	welcome := recv(t, ws)
+	if welcome[0] != float64(V2_WELCOME){
+		t.Fatalf("expected WELCOME: %v", welcome)
+	}
+	return welcome[1].(float64)
+}
+
+//Waits for cond, failing after 2s
+func waitFor(t testing.TB, what string, cond func()(bool)){
+	deadline := time.Now().Add(2*time.Second)
+	for !cond(){
+		if time.Now().After(deadline){
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5*time.Millisecond)
+	}
+}
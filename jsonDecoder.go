@@ -0,0 +1,362 @@
+package postmaster
+
+import(
+	"fmt"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	JSON Decoding
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Decodes a JSON message in a single pass over the frame, to the same values encoding/json decodes
+//into an interface{} (numbers float64, dictionaries map[string]interface{}). With binary set (WAMP v2),
+//binary strings (NUL followed by base64) become []byte as they are read.
+type jsonDecoder struct{
+	data []byte
+	pos int
+	depth int //Lists & dictionaries currently open
+	binary bool //Decode binary strings
+}
+
+func decodeJSON(data []byte, binary bool)([]interface{},error){
+	d := &jsonDecoder{data: data, binary: binary}
+
+	d.skipSpace()
+	if d.peek() != '['{
+		return nil,d.error("message is not a list")
+	}
+	msg,err := d.list()
+	if err != nil{
+		return nil,err
+	}
+
+	d.skipSpace()
+	if d.pos != len(d.data){
+		return nil,d.error("data after message")
+	}
+	return msg,nil
+}
+
+func (d *jsonDecoder) value()(interface{},error){
+	d.skipSpace()
+	switch c := d.peek(); {
+	case c == '[':
+		return d.list()
+	case c == '{':
+		return d.dict()
+	case c == '"':
+		s,err := d.str()
+		if err != nil || !d.binary{
+			return s,err
+		}
+		return binaryString(s),nil
+	case c == '-' || (c >= '0' && c <= '9'):
+		return d.number()
+	case c == 't':
+		return true,d.literal("true")
+	case c == 'f':
+		return false,d.literal("false")
+	case c == 'n':
+		return nil,d.literal("null")
+	case c == 0 && d.pos >= len(d.data):
+		return nil,d.error("unexpected end of message")
+	}
+	return nil,d.error("invalid character")
+}
+
+func (d *jsonDecoder) list()([]interface{},error){
+	if err := d.open(); err != nil{
+		return nil,err
+	}
+
+	list := []interface{}{}
+	d.skipSpace()
+	if d.peek() == ']'{
+		d.pos++
+		d.depth--
+		return list,nil
+	}
+
+	for{
+		v,err := d.value()
+		if err != nil{
+			return nil,err
+		}
+		list = append(list,v)
+
+		d.skipSpace()
+		switch d.peek(){
+		case ',':
+			d.pos++
+		case ']':
+			d.pos++
+			d.depth--
+			return list,nil
+		default:
+			return nil,d.error("expected , or ] in list")
+		}
+	}
+}
+
+func (d *jsonDecoder) dict()(map[string]interface{},error){
+	if err := d.open(); err != nil{
+		return nil,err
+	}
+
+	dict := make(map[string]interface{})
+	d.skipSpace()
+	if d.peek() == '}'{
+		d.pos++
+		d.depth--
+		return dict,nil
+	}
+
+	for{
+		d.skipSpace()
+		if d.peek() != '"'{
+			return nil,d.error("expected string key in dictionary")
+		}
+		key,err := d.str()
+		if err != nil{
+			return nil,err
+		}
+
+		d.skipSpace()
+		if d.peek() != ':'{
+			return nil,d.error("expected : after dictionary key")
+		}
+		d.pos++
+
+		v,err := d.value()
+		if err != nil{
+			return nil,err
+		}
+		dict[key] = v
+
+		d.skipSpace()
+		switch d.peek(){
+		case ',':
+			d.pos++
+		case '}':
+			d.pos++
+			d.depth--
+			return dict,nil
+		default:
+			return nil,d.error("expected , or } in dictionary")
+		}
+	}
+}
+
+//Enters a list or dictionary
+func (d *jsonDecoder) open()(error){
+	if d.depth++; d.depth > MAX_MESSAGE_DEPTH{
+		return d.error("message nested too deeply")
+	}
+	d.pos++
+	return nil
+}
+
+//Reads a string; d.pos is on the opening quote
+func (d *jsonDecoder) str()(string,error){
+	start := d.pos+1
+
+	//Fast path: plain ASCII, no escapes
+	for i := start; i < len(d.data); i++{
+		c := d.data[i]
+		if c == '"'{
+			d.pos = i+1
+			return string(d.data[start:i]),nil
+		}
+		if c == '\\' || c < 0x20 || c >= utf8.RuneSelf{
+			break
+		}
+	}
+
+	buf := make([]byte,0,len(d.data)-start)
+	for i := start; i < len(d.data);{
+		c := d.data[i]
+		switch{
+		case c == '"':
+			d.pos = i+1
+			return string(buf),nil
+		case c < 0x20:
+			d.pos = i
+			return "",d.error("control character in string")
+		case c >= utf8.RuneSelf:
+			//Invalid UTF-8 is replaced, as encoding/json does
+			r,size := utf8.DecodeRune(d.data[i:])
+			buf = utf8.AppendRune(buf,r)
+			i += size
+			continue
+		case c != '\\':
+			buf = append(buf,c)
+			i++
+			continue
+		}
+
+		//Escape
+		if i+1 >= len(d.data){
+			break
+		}
+		switch e := d.data[i+1]; e{
+		case '"','\\','/':
+			buf = append(buf,e)
+		case 'b':
+			buf = append(buf,'\b')
+		case 'f':
+			buf = append(buf,'\f')
+		case 'n':
+			buf = append(buf,'\n')
+		case 'r':
+			buf = append(buf,'\r')
+		case 't':
+			buf = append(buf,'\t')
+		case 'u':
+			r,ok := hexRune(d.data[i+2:])
+			if !ok{
+				d.pos = i
+				return "",d.error("invalid \\u escape in string")
+			}
+			i += 6
+			if utf16.IsSurrogate(r){
+				//Lone surrogates are replaced, as encoding/json does
+				r2,ok := rune(-1),false
+				if len(d.data) > i+1 && d.data[i] == '\\' && d.data[i+1] == 'u'{
+					r2,ok = hexRune(d.data[i+2:])
+				}
+				if dec := utf16.DecodeRune(r,r2); ok && dec != utf8.RuneError{
+					r = dec
+					i += 6
+				}else{
+					r = utf8.RuneError
+				}
+			}
+			buf = utf8.AppendRune(buf,r)
+			continue
+		default:
+			d.pos = i
+			return "",d.error("invalid escape in string")
+		}
+		i += 2
+	}
+
+	d.pos = len(d.data)
+	return "",d.error("unterminated string")
+}
+
+//Reads a number; d.pos is on its first character
+func (d *jsonDecoder) number()(interface{},error){
+	start := d.pos
+	i := start
+	if d.data[i] == '-'{
+		i++
+	}
+
+	//Integer part: 0 or digits without leading zero
+	switch{
+	case i < len(d.data) && d.data[i] == '0':
+		i++
+	case i < len(d.data) && d.data[i] >= '1' && d.data[i] <= '9':
+		i = d.digits(i)
+	default:
+		d.pos = i
+		return nil,d.error("invalid number")
+	}
+
+	//Fraction
+	if i < len(d.data) && d.data[i] == '.'{
+		j := d.digits(i+1)
+		if j == i+1{
+			d.pos = j
+			return nil,d.error("invalid number")
+		}
+		i = j
+	}
+
+	//Exponent
+	if i < len(d.data) && (d.data[i] == 'e' || d.data[i] == 'E'){
+		i++
+		if i < len(d.data) && (d.data[i] == '+' || d.data[i] == '-'){
+			i++
+		}
+		j := d.digits(i)
+		if j == i{
+			d.pos = j
+			return nil,d.error("invalid number")
+		}
+		i = j
+	}
+
+	f,err := strconv.ParseFloat(string(d.data[start:i]),64)
+	if err != nil{
+		return nil,d.error("number out of range")
+	}
+	d.pos = i
+	return f,nil
+}
+
+//Index after the run of digits starting at i
+func (d *jsonDecoder) digits(i int)(int){
+	for i < len(d.data) && d.data[i] >= '0' && d.data[i] <= '9'{
+		i++
+	}
+	return i
+}
+
+func (d *jsonDecoder) literal(lit string)(error){
+	if len(d.data)-d.pos < len(lit) || string(d.data[d.pos:d.pos+len(lit)]) != lit{
+		return d.error("invalid literal")
+	}
+	d.pos += len(lit)
+	return nil
+}
+
+func (d *jsonDecoder) skipSpace(){
+	for d.pos < len(d.data){
+		switch d.data[d.pos]{
+		case ' ','\t','\n','\r':
+			d.pos++
+		default:
+			return
+		}
+	}
+}
+
+//Next byte, 0 at the end of the data
+func (d *jsonDecoder) peek()(byte){
+	if d.pos < len(d.data){
+		return d.data[d.pos]
+	}
+	return 0
+}
+
+func (d *jsonDecoder) error(msg string)(error){
+	return fmt.Errorf("postmaster: invalid JSON message: %s at offset %d", msg, d.pos)
+}
+
+//Reads the 4 hex digits of a \u escape
+func hexRune(b []byte)(rune,bool){
+	if len(b) < 4{
+		return -1,false
+	}
+	var r rune
+	for _,c := range b[:4]{
+		switch{
+		case c >= '0' && c <= '9':
+			c -= '0'
+		case c >= 'a' && c <= 'f':
+			c -= 'a'-10
+		case c >= 'A' && c <= 'F':
+			c -= 'A'-10
+		default:
+			return -1,false
+		}
+		r = r<<4 | rune(c)
+	}
+	return r,true
+}
@@ -0,0 +1,252 @@
+package postmaster
+
+import(
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Reference Decoder (encoding/json, as messages were decoded before jsonDecoder)
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+var typeReg = regexp.MustCompile("^\\s*\\[\\s*(\\d+)\\s*,")
+
+func parseType(msg string) MessageType {
+	match := typeReg.FindStringSubmatch(msg)
+	if match == nil {
+		return -1
+	}
+	i, _ := strconv.Atoi(match[1])
+	return MessageType(i)
+}
+
+func referenceDecode(data []byte, binary bool)([]interface{},error){
+	var msg []interface{}
+	if err := json.Unmarshal(data,&msg); err != nil{
+		return nil,err
+	}
+	if msg == nil{
+		return nil,fmt.Errorf("message is not a list") //null
+	}
+	if !binary{
+		return msg,nil
+	}
+	return decodeBinary(msg).([]interface{}),nil
+}
+
+//Replaces binary strings by []byte in place
+func decodeBinary(v interface{})(interface{}){
+	switch x := v.(type){
+	case string:
+		return binaryString(x)
+	case []interface{}:
+		for i,e := range x{
+			x[i] = decodeBinary(e)
+		}
+	case map[string]interface{}:
+		for k,e := range x{
+			x[k] = decodeBinary(e)
+		}
+	}
+	return v
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+var decoderCases = []string{
+	//Messages
+	`[2,"call1","add",1,2]`,
+	` [ 7 , "topic" , {"a": [1, 2.5, -3e2, true, false, null]} ] `,
+	`[16,1,{"exclude_me":false},"topic",[1],{"k":"v"}]`,
+	`[]`,
+	`[[],{},[[]],{"a":{}}]`,
+	`[1,{"a":1,"a":2}]`, //Last duplicate key wins
+
+	//Numbers
+	`[0,-0,1.5e10,1E-3,-12.75,123456789012345678901234567890]`,
+	`[1e400]`,
+	`[01]`,
+	`[1.]`,
+	`[.5]`,
+	`[-]`,
+	`[1e]`,
+	`[+1]`,
+
+	//Escapes
+	`["\"\\\/\b\f\n\r\t"]`,
+	`["Aé中"]`,
+	`["\u00"]`,
+	`["\x"]`,
+	`["tab	inside"]`,
+	`["unterminated]`,
+
+	//Surrogates
+	`["😀"]`,
+	`["\ud83d"]`,
+	`["\ude00"]`,
+	`["\ud83dx"]`,
+	`["\ud83dA"]`,
+	`["\ud83d😀"]`,
+
+	//UTF-8
+	"[\"caf\xc3\xa9 \xe2\x82\xac \xf0\x9f\x98\x80\"]",
+	"[\"bad \xff byte\"]",
+	"[\"truncated \xe2\x82\"]",
+	"[\"overlong \xc0\xaf\"]",
+	"[\"surrogate \xed\xa0\x80\"]",
+	"[1,\xff]",
+
+	//Binary strings
+	`["\u0000aGVsbG8="]`,
+	`[{"b":["\u0000aGVsbG8="]}]`,
+	`["\u0000not base64!"]`,
+
+	//Not a message
+	`null`,
+	`{}`,
+	`"string"`,
+	`[1,2`,
+	`[1,]`,
+	`[1 2]`,
+	`[1],`,
+	`[tru]`,
+	`[{"a" 1}]`,
+	`[{1:2}]`,
+	``,
+}
+
+//jsonDecoder decodes what encoding/json accepts to the same values and refuses the rest
+func TestDecodeJSONMatchesEncodingJSON(t *testing.T){
+	for _,binary := range []bool{false, true}{
+		for _,data := range decoderCases{
+			want,wantErr := referenceDecode([]byte(data), binary)
+			got,err := decodeJSON([]byte(data), binary)
+			if (err != nil) != (wantErr != nil){
+				t.Errorf("%q (binary %t): error %v, encoding/json error %v", data, binary, err, wantErr)
+				continue
+			}
+			if !reflect.DeepEqual(got, want){
+				t.Errorf("%q (binary %t): decoded %#v, encoding/json %#v", data, binary, got, want)
+			}
+		}
+	}
+}
+
+func TestDecodeJSONDepth(t *testing.T){
+	nested := func(depth int)(string){
+		return strings.Repeat("[", depth) + strings.Repeat("]", depth)
+	}
+	for _,depth := range []int{MAX_MESSAGE_DEPTH, MAX_MESSAGE_DEPTH+1, 100*MAX_MESSAGE_DEPTH}{
+		_,err := decodeJSON([]byte(nested(depth)), true)
+		if tooDeep := depth > MAX_MESSAGE_DEPTH; (err != nil) != tooDeep{
+			t.Errorf("depth %d: error %v", depth, err)
+		}
+		_,refErr := referenceDecode([]byte(nested(depth)), true)
+		if (err != nil) != (refErr != nil){
+			t.Errorf("depth %d: error %v, encoding/json error %v", depth, err, refErr)
+		}
+	}
+}
+
+func FuzzDecodeJSON(f *testing.F){
+	for _,data := range decoderCases{
+		f.Add([]byte(data))
+	}
+	f.Fuzz(func(t *testing.T, data []byte){
+		want,wantErr := referenceDecode(data, true)
+		got,err := decodeJSON(data, true)
+		if (err != nil) != (wantErr != nil){
+			t.Fatalf("%q: error %v, encoding/json error %v", data, err, wantErr)
+		}
+		if !reflect.DeepEqual(got, want){
+			t.Fatalf("%q: decoded %#v, encoding/json %#v", data, got, want)
+		}
+	})
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Benchmarks
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+var benchMessages = map[string][]byte{
+	"v1 call": []byte(`[2,"7DK6TdN4wLiUJgNM","http://example.com/api#add",23,99]`),
+	"v2 publish": []byte(`[16,239714735,{"exclude_me":false,"retain":true},"com.myapp.mytopic1",["Hello, world!",42],{"color":"orange","sizes":[23,42,7]}]`),
+	"v2 binary": []byte(`[16,1,{},"com.myapp.thumbnail",["\u0000` + base64.StdEncoding.EncodeToString(make([]byte,1024)) + `"]]`),
+}
+
+func BenchmarkDecodeJSON(b *testing.B){
+	for name,data := range benchMessages{
+		b.Run(name, func(b *testing.B){
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++{
+				msg,err := decodeJSON(data, true)
+				if err != nil || messageType(msg) < 0{
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+//Type by regexp, then encoding/json and a scan for binary strings
+func BenchmarkDecodeReference(b *testing.B){
+	for name,data := range benchMessages{
+		b.Run(name, func(b *testing.B){
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++{
+				if parseType(string(data)) < 0{
+					b.Fatal("no type")
+				}
+				var msg []interface{}
+				if err := json.Unmarshal(data,&msg); err != nil{
+					b.Fatal(err)
+				}
+				if strings.Contains(string(data),`\u0000`){
+					decodeBinary(msg)
+				}
+			}
+		})
+	}
+}
+
+//Publishing one event to subscribed v1 & v2 sessions
+func BenchmarkEventFanOut(b *testing.B){
+	for _,n := range []int{10,200}{
+		b.Run(fmt.Sprint(n), func(b *testing.B){
+			s := NewServer()
+			s.Backlog = 1
+			conns := make([]*Connection,n)
+			for i := range conns{
+				c := newConnection(s, ConnectionID(fmt.Sprint(i)), nil)
+				if i%2 == 1{
+					c.version = 2
+					c.serializer = JSONSerializer{}
+				}
+				s.addConnection(c)
+				s.subscriptions.Add(c.realm, "topic", MATCH_EXACT, c.id)
+				conns[i] = c
+			}
+			event := map[string]interface{}{"price": 12.5, "symbol": "ACME", "volume": []interface{}{1,2,3}}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++{
+				s.PublishEvent("topic", event)
+				for _,c := range conns{
+					<-c.out
+				}
+			}
+		})
+	}
+}
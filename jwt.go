@@ -0,0 +1,332 @@
+package postmaster
+
+import(
+	"errors"
+	"time"
+	"strings"
+	"math/big"
+	"io/ioutil"
+	"encoding/json"
+	"encoding/base64"
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/rsa"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	JWT Authentication
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+const AUTH_METHOD_JWT = "jwt"
+
+var ErrMalformedToken = errors.New("postmaster: malformed token")
+var ErrUnsupportedAlg = errors.New("postmaster: unsupported token algorithm")
+var ErrUnknownKey = errors.New("postmaster: no key for token")
+var ErrTokenExpired = errors.New("postmaster: token expired")
+var ErrTokenNotValidYet = errors.New("postmaster: token not valid yet")
+var ErrTokenAudience = errors.New("postmaster: token audience mismatch")
+
+//Bearer tokens: the client passes a signed JWT as the auth signature (authreq extra {"authmethod":"jwt"}).
+//HS256, RS256 & ES256 signatures are checked, then exp/nbf/aud.
+type JWTAuthenticator struct{
+	//Maps key ID ("kid" header) to verification key: []byte (HS256), *rsa.PublicKey (RS256) or
+	//*ecdsa.PublicKey (ES256, P-256). Tokens without a kid are checked against every key for their alg.
+	//Not modified once serving; see LoadJWKS.
+	Keys map[string]interface{}
+
+	Audience string //Required "aud" ("" skips the check)
+	Leeway time.Duration //Allowed clock skew for exp/nbf
+
+	//Maps verified claims to the session's username & permissions. Username defaults to the "sub" claim.
+	GetPermissions func(claims map[string]interface{})(*AuthResult,error) // Required
+}
+
+func (a *JWTAuthenticator) Challenge(req *AuthRequest)(string,error){
+	return "",nil //Token is sent as is
+}
+
+func (a *JWTAuthenticator) Authenticate(req *AuthRequest, token string)(*AuthResult,error){
+	claims,err := a.verify(token,time.Now())
+	if err != nil{
+		return nil,err
+	}
+
+	if a.GetPermissions == nil{
+		return nil,errors.New("postmaster: JWTAuthenticator.GetPermissions nil")
+	}
+	res,err := a.GetPermissions(claims)
+	if err != nil{
+		return nil,err
+	}
+	if res == nil{
+		return nil,errors.New("postmaster: JWTAuthenticator.GetPermissions returned no result")
+	}
+	if res.Username == ""{
+		res.Username,_ = claims["sub"].(string)
+	}
+
+	return res,nil
+}
+
+//Checks signature & registered claims; returns the token claims
+func (a *JWTAuthenticator) verify(token string, now time.Time)(map[string]interface{},error){
+	parts := strings.Split(token,".")
+	if len(parts) != 3{
+		return nil,ErrMalformedToken
+	}
+
+	var header struct{
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0],&header); err != nil{
+		return nil,err
+	}
+	sig,err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil{
+		return nil,ErrMalformedToken
+	}
+
+	switch header.Alg{
+	case "HS256","RS256","ES256":
+	default:
+		return nil,ErrUnsupportedAlg //Includes "none"
+	}
+
+	var keys []interface{}
+	if header.Kid != ""{
+		if key,ok := a.Keys[header.Kid]; ok{
+			keys = append(keys,key)
+		}
+	}else{
+		for _,key := range a.Keys{
+			keys = append(keys,key)
+		}
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _,key := range keys{
+		ok,err := verifySignature(header.Alg,key,signed,sig)
+		if err != nil{
+			return nil,err
+		}
+		if ok{
+			verified = true
+			break
+		}
+	}
+	if !verified{
+		if len(keys) == 0{
+			return nil,ErrUnknownKey
+		}
+		return nil,ErrInvalidSignature
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1],&claims); err != nil{
+		return nil,err
+	}
+
+	//Registered claims
+	exp,hasExp,err := numericDate(claims,"exp")
+	if err != nil{
+		return nil,err
+	}
+	nbf,hasNbf,err := numericDate(claims,"nbf")
+	if err != nil{
+		return nil,err
+	}
+	if hasExp && now.After(exp.Add(a.Leeway)){
+		return nil,ErrTokenExpired
+	}
+	if hasNbf && now.Before(nbf.Add(-a.Leeway)){
+		return nil,ErrTokenNotValidYet
+	}
+	if a.Audience != "" && !hasAudience(claims["aud"],a.Audience){
+		return nil,ErrTokenAudience
+	}
+
+	return claims,nil
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	JWT Utility Functions
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Checks sig against key. Keys of the wrong type for alg never match, so an RSA public key
+//can't be used as an HMAC secret.
+func verifySignature(alg string, key interface{}, signed []byte, sig []byte)(bool,error){
+	hash := sha256.Sum256(signed)
+
+	switch alg{
+	case "HS256":
+		secret,ok := key.([]byte)
+		if !ok{
+			return false,nil
+		}
+		mac := hmac.New(sha256.New,secret)
+		mac.Write(signed)
+		return hmac.Equal(sig,mac.Sum(nil)),nil
+	case "RS256":
+		pub,ok := key.(*rsa.PublicKey)
+		if !ok{
+			return false,nil
+		}
+		return rsa.VerifyPKCS1v15(pub,crypto.SHA256,hash[:],sig) == nil,nil
+	case "ES256":
+		pub,ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != elliptic.P256(){
+			return false,nil
+		}
+		if len(sig) != 64{
+			return false,nil //r & s, 32 bytes each
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub,hash[:],r,s),nil
+	}
+	return false,ErrUnsupportedAlg
+}
+
+//Reads an optional NumericDate claim (seconds since the epoch); ErrMalformedToken if it isn't a number
+func numericDate(claims map[string]interface{}, name string)(time.Time,bool,error){
+	v,ok := claims[name]
+	if !ok{
+		return time.Time{},false,nil
+	}
+	secs,ok := v.(float64)
+	if !ok{
+		return time.Time{},false,ErrMalformedToken
+	}
+	return time.Unix(int64(secs),0),true,nil
+}
+
+//"aud" may be a string or a list of strings
+func hasAudience(aud interface{}, want string)(bool){
+	switch v := aud.(type){
+	case string:
+		return v == want
+	case []interface{}:
+		for _,a := range v{
+			if a == want{
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(seg string, v interface{})(error){
+	data,err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil{
+		return ErrMalformedToken
+	}
+	if err := json.Unmarshal(data,v); err != nil{
+		return ErrMalformedToken
+	}
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Reads a JWK Set file (RFC 7517) into keys usable as JWTAuthenticator.Keys.
+//Supports "RSA" (RS256), "EC" (P-256, ES256) and "oct" (HS256) signing keys. Keys for other curves or
+//algorithms ("alg"), and keys whose "use" isn't "sig", are skipped. Key IDs must be unique; one key
+//may leave out "kid".
+func LoadJWKS(path string)(map[string]interface{},error){
+	data,err := ioutil.ReadFile(path)
+	if err != nil{
+		return nil,err
+	}
+
+	var set struct{
+		Keys []struct{
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Alg string `json:"alg"`
+			Crv string `json:"crv"`
+			N string `json:"n"` //RSA
+			E string `json:"e"`
+			X string `json:"x"` //EC
+			Y string `json:"y"`
+			K string `json:"k"` //oct
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data,&set); err != nil{
+		return nil,err
+	}
+
+	keys := make(map[string]interface{})
+	for _,jwk := range set.Keys{
+		if jwk.Use != "" && jwk.Use != "sig"{
+			log.Warn("postmaster: skipping JWKS key %s: use %s", jwk.Kid, jwk.Use)
+			continue
+		}
+
+		var key interface{}
+		var alg string //Only algorithm the key can verify (see verifySignature)
+		switch jwk.Kty{
+		case "RSA":
+			n,err1 := decodeBigInt(jwk.N)
+			e,err2 := decodeBigInt(jwk.E)
+			if err1 != nil || err2 != nil{
+				return nil,errors.New("postmaster: invalid RSA key in JWKS: "+jwk.Kid)
+			}
+			key,alg = &rsa.PublicKey{N:n, E:int(e.Int64())},"RS256"
+		case "EC":
+			if jwk.Crv != "P-256"{
+				log.Warn("postmaster: skipping JWKS key %s: unsupported curve %s", jwk.Kid, jwk.Crv)
+				continue
+			}
+			x,err1 := decodeBigInt(jwk.X)
+			y,err2 := decodeBigInt(jwk.Y)
+			if err1 != nil || err2 != nil || !elliptic.P256().IsOnCurve(x,y){
+				return nil,errors.New("postmaster: invalid EC key in JWKS: "+jwk.Kid)
+			}
+			key,alg = &ecdsa.PublicKey{Curve:elliptic.P256(), X:x, Y:y},"ES256"
+		case "oct":
+			k,err := base64.RawURLEncoding.DecodeString(jwk.K)
+			if err != nil{
+				return nil,errors.New("postmaster: invalid oct key in JWKS: "+jwk.Kid)
+			}
+			key,alg = k,"HS256"
+		default:
+			log.Warn("postmaster: skipping JWKS key %s: unsupported type %s", jwk.Kid, jwk.Kty)
+			continue
+		}
+
+		//A key meant for another algorithm must not verify tokens signed with this one
+		if jwk.Alg != "" && jwk.Alg != alg{
+			log.Warn("postmaster: skipping JWKS key %s: unsupported algorithm %s", jwk.Kid, jwk.Alg)
+			continue
+		}
+
+		if _,dup := keys[jwk.Kid]; dup{
+			if jwk.Kid == ""{
+				return nil,errors.New("postmaster: JWKS has more than one key without a kid")
+			}
+			return nil,errors.New("postmaster: duplicate kid in JWKS: "+jwk.Kid)
+		}
+		keys[jwk.Kid] = key
+	}
+
+	return keys,nil
+}
+
+func decodeBigInt(s string)(*big.Int,error){
+	b,err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0{
+		return nil,ErrMalformedToken
+	}
+	return new(big.Int).SetBytes(b),nil
+}
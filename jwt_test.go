@@ -0,0 +1,279 @@
+package postmaster
+
+import(
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//Keys generated for the tests; verification keys are the public halves
+type jwtKeys struct{
+	hmac []byte
+	rsa *rsa.PrivateKey
+	ec *ecdsa.PrivateKey
+}
+
+func newJWTKeys(t *testing.T)(*jwtKeys){
+	r,err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil{
+		t.Fatal(err)
+	}
+	e,err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil{
+		t.Fatal(err)
+	}
+	return &jwtKeys{hmac: []byte("hmac secret"), rsa: r, ec: e}
+}
+
+//Signs claims with the key for alg (kid "" leaves it out of the header)
+func (k *jwtKeys) token(t *testing.T, alg string, kid string, claims map[string]interface{})(string){
+	header := map[string]interface{}{"alg": alg, "typ": "JWT"}
+	if kid != ""{
+		header["kid"] = kid
+	}
+	signed := encodeSegment(t, header) + "." + encodeSegment(t, claims)
+	hash := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch alg{
+	case "HS256":
+		mac := hmac.New(sha256.New, k.hmac)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case "RS256":
+		var err error
+		if sig,err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, hash[:]); err != nil{
+			t.Fatal(err)
+		}
+	case "ES256":
+		r,s,err := ecdsa.Sign(rand.Reader, k.ec, hash[:])
+		if err != nil{
+			t.Fatal(err)
+		}
+		sig = make([]byte,64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func encodeSegment(t *testing.T, v interface{})(string){
+	data,err := json.Marshal(v)
+	if err != nil{
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func testJWTAuthenticator(keys map[string]interface{})(*JWTAuthenticator){
+	return &JWTAuthenticator{
+		Keys: keys,
+		GetPermissions: func(claims map[string]interface{})(*AuthResult,error){
+			return &AuthResult{Permissions: testPermissions()},nil
+		},
+	}
+}
+
+func TestJWTSignatures(t *testing.T){
+	k := newJWTKeys(t)
+	other := newJWTKeys(t)
+	other.hmac = []byte("other secret")
+	a := testJWTAuthenticator(map[string]interface{}{
+		"hs": k.hmac,
+		"rs": &k.rsa.PublicKey,
+		"es": &k.ec.PublicKey,
+	})
+	claims := map[string]interface{}{"sub": "alice"}
+
+	tests := []struct{
+		name string
+		token string
+		err error
+	}{
+		{"HS256", k.token(t, "HS256", "hs", claims), nil},
+		{"RS256", k.token(t, "RS256", "rs", claims), nil},
+		{"ES256", k.token(t, "ES256", "es", claims), nil},
+		{"no kid", k.token(t, "ES256", "", claims), nil},
+		{"wrong HS256 key", other.token(t, "HS256", "hs", claims), ErrInvalidSignature},
+		{"wrong RS256 key", other.token(t, "RS256", "rs", claims), ErrInvalidSignature},
+		{"wrong ES256 key", other.token(t, "ES256", "es", claims), ErrInvalidSignature},
+		{"kid of other alg", k.token(t, "RS256", "es", claims), ErrInvalidSignature},
+		{"unknown kid", k.token(t, "HS256", "nope", claims), ErrUnknownKey},
+		{"alg none", encodeSegment(t, map[string]interface{}{"alg": "none"}) + "." + encodeSegment(t, claims) + ".", ErrUnsupportedAlg},
+		{"two segments", "a.b", ErrMalformedToken},
+	}
+	for _,test := range tests{
+		res,err := a.Authenticate(&AuthRequest{}, test.token)
+		if err != test.err{
+			t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+		}else if err == nil && res.Username != "alice"{
+			t.Errorf("%s: username %q, want alice from sub", test.name, res.Username)
+		}
+	}
+}
+
+//An RSA public key must not be accepted as an HMAC secret
+func TestJWTKeyConfusion(t *testing.T){
+	k := newJWTKeys(t)
+	a := testJWTAuthenticator(map[string]interface{}{"rs": &k.rsa.PublicKey})
+
+	forger := &jwtKeys{hmac: k.rsa.PublicKey.N.Bytes()}
+	if _,err := a.Authenticate(&AuthRequest{}, forger.token(t, "HS256", "rs", nil)); err != ErrInvalidSignature{
+		t.Errorf("error %v, want ErrInvalidSignature", err)
+	}
+}
+
+func TestJWTClaims(t *testing.T){
+	k := newJWTKeys(t)
+	a := testJWTAuthenticator(map[string]interface{}{"hs": k.hmac})
+	a.Audience = "postmaster"
+	a.Leeway = time.Minute
+	now := float64(time.Now().Unix())
+
+	tests := []struct{
+		name string
+		claims map[string]interface{}
+		err error
+	}{
+		{"valid", map[string]interface{}{"aud": "postmaster", "exp": now+60, "nbf": now-60}, nil},
+		{"expired", map[string]interface{}{"aud": "postmaster", "exp": now-120}, ErrTokenExpired},
+		{"expired within leeway", map[string]interface{}{"aud": "postmaster", "exp": now-30}, nil},
+		{"not valid yet", map[string]interface{}{"aud": "postmaster", "nbf": now+120}, ErrTokenNotValidYet},
+		{"nbf within leeway", map[string]interface{}{"aud": "postmaster", "nbf": now+30}, nil},
+		{"exp not a number", map[string]interface{}{"aud": "postmaster", "exp": "tomorrow"}, ErrMalformedToken},
+		{"nbf not a number", map[string]interface{}{"aud": "postmaster", "nbf": []interface{}{now}}, ErrMalformedToken},
+		{"null exp", map[string]interface{}{"aud": "postmaster", "exp": nil}, ErrMalformedToken},
+		{"audience list", map[string]interface{}{"aud": []interface{}{"other", "postmaster"}}, nil},
+		{"wrong audience", map[string]interface{}{"aud": "other"}, ErrTokenAudience},
+		{"no audience", map[string]interface{}{}, ErrTokenAudience},
+	}
+	for _,test := range tests{
+		if _,err := a.Authenticate(&AuthRequest{}, k.token(t, "HS256", "hs", test.claims)); err != test.err{
+			t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestJWTGetPermissions(t *testing.T){
+	k := newJWTKeys(t)
+	a := testJWTAuthenticator(map[string]interface{}{"hs": k.hmac})
+	token := k.token(t, "HS256", "hs", map[string]interface{}{"sub": "alice", "name": "Alice"})
+
+	a.GetPermissions = func(claims map[string]interface{})(*AuthResult,error){
+		return &AuthResult{Username: claims["name"].(string)},nil
+	}
+	if res,err := a.Authenticate(&AuthRequest{}, token); err != nil || res.Username != "Alice"{
+		t.Errorf("got %v %v, want username Alice", res, err)
+	}
+
+	a.GetPermissions = func(claims map[string]interface{})(*AuthResult,error){
+		return nil,nil
+	}
+	if _,err := a.Authenticate(&AuthRequest{}, token); err == nil{
+		t.Error("nil result accepted")
+	}
+
+	a.GetPermissions = nil
+	if _,err := a.Authenticate(&AuthRequest{}, token); err == nil{
+		t.Error("nil GetPermissions accepted")
+	}
+}
+
+func TestLoadJWKS(t *testing.T){
+	k := newJWTKeys(t)
+	b64 := func(b []byte)(string){ return base64.RawURLEncoding.EncodeToString(b) }
+	coord := func(n *big.Int)(string){
+		b := make([]byte,32)
+		return b64(n.FillBytes(b))
+	}
+	rsaKey := func(params ...string)(map[string]interface{}){
+		jwk := map[string]interface{}{"kty": "RSA", "n": b64(k.rsa.N.Bytes()), "e": b64(big.NewInt(int64(k.rsa.E)).Bytes())}
+		for i := 0; i < len(params); i += 2{
+			jwk[params[i]] = params[i+1]
+		}
+		return jwk
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	load := func(keys ...interface{})(map[string]interface{},error){
+		data,err := json.Marshal(map[string]interface{}{"keys": keys})
+		if err != nil{
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0600); err != nil{
+			t.Fatal(err)
+		}
+		return LoadJWKS(path)
+	}
+
+	keys,err := load(
+		rsaKey("kid", "rs"),
+		rsaKey("kid", "rs-sig", "use", "sig", "alg", "RS256"),
+		map[string]interface{}{"kty": "EC", "kid": "es", "crv": "P-256", "x": coord(k.ec.X), "y": coord(k.ec.Y)},
+		map[string]interface{}{"kty": "oct", "kid": "hs", "k": b64(k.hmac)},
+		map[string]interface{}{"kty": "oct", "k": b64(k.hmac)}, //No kid
+		rsaKey("kid", "rs-enc", "use", "enc"), //Skipped: not for signatures
+		rsaKey("kid", "ps", "alg", "PS256"), //Skipped: not RS256
+		map[string]interface{}{"kty": "oct", "kid": "hs512", "alg": "HS512", "k": b64(k.hmac)}, //Skipped
+		map[string]interface{}{"kty": "EC", "kid": "p384", "crv": "P-384", "x": "AA", "y": "AA"}, //Skipped
+		map[string]interface{}{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": "AA"}, //Skipped
+	)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if len(keys) != 5{
+		t.Errorf("loaded %d keys, want 5", len(keys))
+	}
+
+	a := testJWTAuthenticator(keys)
+	for _,test := range []struct{
+		alg string
+		kid string
+		err error
+	}{
+		{"RS256", "rs", nil},
+		{"RS256", "rs-sig", nil},
+		{"ES256", "es", nil},
+		{"HS256", "hs", nil},
+		{"HS256", "", nil},
+		{"RS256", "", nil},
+		{"RS256", "rs-enc", ErrUnknownKey},
+		{"RS256", "ps", ErrUnknownKey},
+		{"HS256", "rs", ErrInvalidSignature}, //Token alg doesn't fit the key
+	}{
+		if _,err := a.Authenticate(&AuthRequest{}, k.token(t, test.alg, test.kid, nil)); err != test.err{
+			t.Errorf("%s token, kid %q: error %v, want %v", test.alg, test.kid, err, test.err)
+		}
+	}
+
+	//Refused sets
+	for _,test := range []struct{
+		name string
+		keys []interface{}
+	}{
+		{"point off the curve", []interface{}{
+			map[string]interface{}{"kty": "EC", "kid": "es", "crv": "P-256", "x": coord(big.NewInt(1)), "y": coord(big.NewInt(1))},
+		}},
+		{"duplicate kid", []interface{}{rsaKey("kid", "rs"), rsaKey("kid", "rs")}},
+		{"several keys without kid", []interface{}{rsaKey(), map[string]interface{}{"kty": "oct", "k": b64(k.hmac)}}},
+	}{
+		if _,err := load(test.keys...); err == nil{
+			t.Errorf("%s: loaded", test.name)
+		}
+	}
+
+	//Keys that are skipped don't take up their kid
+	if _,err := load(rsaKey(), rsaKey("use", "enc")); err != nil{
+		t.Errorf("skipped key without kid: %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+package postmaster
+
+import(
+	"errors"
+	"net"
+	"sync"
+	"time"
+	"code.google.com/p/go.net/websocket"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Brute Force Protection
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Defaults for Server lockout settings left at 0
+const (
+	LOCKOUT_THRESHOLD = 5 //Failures allowed before backoff starts
+	LOCKOUT_BACKOFF = time.Second //First lockout; doubles with each further failure
+	LOCKOUT_MAX = 15*time.Minute //Longest lockout
+	LOCKOUT_RESET_AFTER = time.Hour //Default NewMemoryLockoutStore resetAfter
+)
+
+var ErrLockedOut = errors.New("postmaster: too many failed authentication attempts; try again later")
+
+//Failed authentication attempts for one subject ("authkey:<key>" or "addr:<host>")
+type LockoutRecord struct{
+	Failures int
+	LastFailure time.Time
+	LockedUntil time.Time //End of the latest lockout (see LockoutStore.Lock)
+}
+
+//Tracks failed authentication. Implementations backed by shared storage let several
+//instances enforce the same lockouts.
+type LockoutStore interface{
+	//Counts a failed attempt for subject and returns its updated record
+	Fail(subject string, now time.Time)(LockoutRecord,error)
+
+	//Returns the record for subject (zero value if none)
+	Get(subject string, now time.Time)(LockoutRecord,error)
+
+	//Records that subject is locked out until the given time; its record must be kept at least that long
+	Lock(subject string, until time.Time) error
+
+	//Forgets subject (after sucessful authentication)
+	Reset(subject string) error
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+//In process LockoutStore; records are forgotten once a subject has had no failures for resetAfter and
+//isn't locked out
+type MemoryLockoutStore struct{
+	resetAfter time.Duration
+	records map[string]LockoutRecord
+	lastSweep time.Time
+	lock *sync.Mutex
+}
+
+//resetAfter <= 0 uses LOCKOUT_RESET_AFTER
+func NewMemoryLockoutStore(resetAfter time.Duration)*MemoryLockoutStore{
+	if resetAfter <= 0{
+		resetAfter = LOCKOUT_RESET_AFTER
+	}
+	return &MemoryLockoutStore{
+		resetAfter: resetAfter,
+		records: make(map[string]LockoutRecord),
+		lock: new(sync.Mutex),
+	}
+}
+
+func (s *MemoryLockoutStore) Fail(subject string, now time.Time)(LockoutRecord,error){
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	//Drop stale records now and then so memory stays bounded
+	if now.Sub(s.lastSweep) > s.resetAfter{
+		for k,r := range s.records{
+			if s.expired(r,now){
+				delete(s.records,k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	r := s.get(subject,now)
+	r.Failures++
+	r.LastFailure = now
+	s.records[subject] = r
+
+	return r,nil
+}
+
+func (s *MemoryLockoutStore) Get(subject string, now time.Time)(LockoutRecord,error){
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.get(subject,now),nil
+}
+
+func (s *MemoryLockoutStore) Lock(subject string, until time.Time) error{
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if r,ok := s.records[subject]; ok && until.After(r.LockedUntil){
+		r.LockedUntil = until
+		s.records[subject] = r
+	}
+	return nil
+}
+
+func (s *MemoryLockoutStore) Reset(subject string) error{
+	s.lock.Lock()
+	delete(s.records,subject)
+	s.lock.Unlock()
+
+	return nil
+}
+
+func (s *MemoryLockoutStore) get(subject string, now time.Time)(LockoutRecord){
+	r := s.records[subject]
+	if s.expired(r,now){
+		return LockoutRecord{}
+	}
+	return r
+}
+
+//Records last until the later of resetAfter past the last failure and the end of the lockout
+func (s *MemoryLockoutStore) expired(r LockoutRecord, now time.Time)(bool){
+	return now.After(r.LastFailure.Add(s.resetAfter)) && now.After(r.LockedUntil)
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Lockout Utility Functions
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Subjects failures are tracked under for a connection, with the failures each allows before lockout.
+//Clients without an auth key (anonymous) aren't tracked by key, or they would all share one subject.
+func (t *Server) lockoutSubjects(conn *Connection, authKey string)(map[string]int){
+	threshold := t.LockoutThreshold
+	if threshold <= 0{
+		threshold = LOCKOUT_THRESHOLD
+	}
+
+	subjects := make(map[string]int)
+	if authKey != ""{
+		subjects["authkey:" + authKey] = threshold
+	}
+	if conn.remoteAddr != "" && t.LockoutAddressThreshold >= 0{
+		if t.LockoutAddressThreshold > 0{
+			threshold = t.LockoutAddressThreshold
+		}
+		subjects["addr:" + conn.remoteAddr] = threshold
+	}
+	return subjects
+}
+
+//End of the lockout a record earns (zero time if under the threshold)
+func (t *Server) lockedUntil(r LockoutRecord, threshold int)(time.Time){
+	backoff,max := t.LockoutBackoff,t.LockoutMax
+	if backoff <= 0{
+		backoff = LOCKOUT_BACKOFF
+	}
+	if max <= 0{
+		max = LOCKOUT_MAX
+	}
+
+	if r.Failures < threshold{
+		return time.Time{}
+	}
+
+	d := backoff
+	for i := threshold; i < r.Failures && d < max; i++{
+		d *= 2
+	}
+	if d > max{
+		d = max
+	}
+	return r.LastFailure.Add(d)
+}
+
+//Returns ErrLockedOut if the auth key or client address is locked out
+func (t *Server) checkLockout(conn *Connection, authKey string)(error){
+	if t.LockoutStore == nil{
+		return nil
+	}
+
+	now := time.Now()
+	for subject,threshold := range t.lockoutSubjects(conn,authKey){
+		r,err := t.LockoutStore.Get(subject,now)
+		if err != nil{
+			log.Error("postmaster: lockout store error: %s", err) //Don't lock everyone out when the store is down
+			continue
+		}
+		if now.Before(t.lockedUntil(r,threshold)){
+			return ErrLockedOut
+		}
+	}
+	return nil
+}
+
+//Counts a failed authentication against the auth key & client address
+func (t *Server) recordAuthFailure(conn *Connection, authKey string){
+	if t.LockoutStore == nil{
+		return
+	}
+
+	now := time.Now()
+	for subject,threshold := range t.lockoutSubjects(conn,authKey){
+		r,err := t.LockoutStore.Fail(subject,now)
+		if err != nil{
+			log.Error("postmaster: lockout store error: %s", err)
+			continue
+		}
+
+		if until := t.lockedUntil(r,threshold); now.Before(until){
+			if err := t.LockoutStore.Lock(subject,until); err != nil{
+				log.Error("postmaster: lockout store error: %s", err)
+			}
+			log.Warn("postmaster: %s locked out until %s after %d failed attempts", subject, until, r.Failures)
+			if t.OnLockout != nil{
+				go t.OnLockout(subject, r.Failures, until)
+			}
+		}
+	}
+}
+
+//Clears the auth key's failures after sucessful authentication. The client address keeps its
+//record so one valid account can't be used to reset it.
+func (t *Server) resetAuthFailures(authKey string){
+	if t.LockoutStore == nil || authKey == ""{
+		return
+	}
+
+	if err := t.LockoutStore.Reset("authkey:" + authKey); err != nil{
+		log.Error("postmaster: lockout store error: %s", err)
+	}
+}
+
+//Host part of the client's address
+func remoteHost(ws *websocket.Conn)(string){
+	req := ws.Request()
+	if req == nil{
+		return ""
+	}
+
+	host,_,err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil{
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,116 @@
+package postmaster
+
+import(
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLockoutSubjects(t *testing.T){
+	tests := []struct{
+		authKey string
+		addr string
+		addrThreshold int
+		subjects map[string]int
+	}{
+		{"alice", "10.0.0.1", 0, map[string]int{"authkey:alice": 3, "addr:10.0.0.1": 3}},
+		{"", "10.0.0.1", 0, map[string]int{"addr:10.0.0.1": 3}}, //Anonymous clients don't share a key subject
+		{"alice", "", 0, map[string]int{"authkey:alice": 3}},
+		{"alice", "10.0.0.1", 50, map[string]int{"authkey:alice": 3, "addr:10.0.0.1": 50}},
+		{"alice", "10.0.0.1", -1, map[string]int{"authkey:alice": 3}},
+		{"", "10.0.0.1", -1, map[string]int{}},
+	}
+	for _,test := range tests{
+		s := NewServer()
+		s.LockoutThreshold = 3
+		s.LockoutAddressThreshold = test.addrThreshold
+		conn := newConnection(s, "c", nil)
+		conn.remoteAddr = test.addr
+
+		if got := s.lockoutSubjects(conn, test.authKey); !reflect.DeepEqual(got, test.subjects){
+			t.Errorf("key %q, addr %q, address threshold %d: subjects %v, want %v", test.authKey, test.addr, test.addrThreshold, got, test.subjects)
+		}
+	}
+}
+
+//Failures from one address behind a proxy don't lock out other clients there before LockoutAddressThreshold
+func TestAddressLockout(t *testing.T){
+	s := NewServer()
+	s.LockoutStore = NewMemoryLockoutStore(time.Hour)
+	s.LockoutThreshold = 2
+	s.LockoutAddressThreshold = 4
+
+	clients := make([]*Connection,5)
+	for i := range clients{
+		clients[i] = newConnection(s, ConnectionID(string(rune('a'+i))), nil)
+		clients[i].remoteAddr = "10.0.0.1"
+	}
+
+	//Anonymous failures
+	for i := 0; i < 3; i++{
+		s.recordAuthFailure(clients[i], "")
+	}
+	if err := s.checkLockout(clients[3], "bob"); err != nil{
+		t.Fatalf("locked out under the address threshold: %s", err)
+	}
+	if err := s.checkLockout(clients[3], ""); err != nil{
+		t.Fatalf("anonymous client locked out by shared key subject: %s", err)
+	}
+
+	s.recordAuthFailure(clients[3], "")
+	if err := s.checkLockout(clients[4], "bob"); err != ErrLockedOut{
+		t.Errorf("address not locked out after %d failures: %v", s.LockoutAddressThreshold, err)
+	}
+}
+
+//Records outlive resetAfter while their subject is locked out
+func TestMemoryLockoutStoreExpiry(t *testing.T){
+	start := time.Now()
+	tests := []struct{
+		name string
+		resetAfter time.Duration
+		lockedFor time.Duration //0 isn't locked
+		at time.Duration
+		failures int
+	}{
+		{"within resetAfter", time.Minute, 0, 30*time.Second, 1},
+		{"after resetAfter", time.Minute, 0, 2*time.Minute, 0},
+		{"locked past resetAfter", time.Minute, time.Hour, 30*time.Minute, 1},
+		{"lockout over", time.Minute, time.Hour, 2*time.Hour, 0},
+		{"lockout shorter than resetAfter", time.Hour, time.Minute, 30*time.Minute, 1},
+		{"no resetAfter", 0, 0, 30*time.Minute, 1}, //LOCKOUT_RESET_AFTER
+		{"no resetAfter, locked", 0, 2*time.Hour, 90*time.Minute, 1},
+	}
+	for _,test := range tests{
+		s := NewMemoryLockoutStore(test.resetAfter)
+		s.Fail("subject", start)
+		if test.lockedFor > 0{
+			s.Lock("subject", start.Add(test.lockedFor))
+		}
+
+		r,_ := s.Get("subject", start.Add(test.at))
+		if r.Failures != test.failures{
+			t.Errorf("%s: %d failures, want %d", test.name, r.Failures, test.failures)
+		}
+
+		//A further failure counts on from the kept record
+		r,_ = s.Fail("subject", start.Add(test.at))
+		if r.Failures != test.failures+1{
+			t.Errorf("%s: %d failures after failing again, want %d", test.name, r.Failures, test.failures+1)
+		}
+	}
+}
+
+func TestLockoutOutlivesResetAfter(t *testing.T){
+	s := NewServer()
+	s.LockoutStore = NewMemoryLockoutStore(time.Millisecond)
+	s.LockoutThreshold = 1
+	s.LockoutBackoff = time.Hour
+	conn := newConnection(s, "c", nil)
+
+	s.recordAuthFailure(conn, "alice")
+	time.Sleep(10*time.Millisecond)
+	if err := s.checkLockout(conn, "alice"); err != ErrLockedOut{
+		t.Errorf("lockout ended with resetAfter: %v", err)
+	}
+}
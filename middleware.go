@@ -0,0 +1,389 @@
+package postmaster
+
+import(
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Middleware
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Decoded inbound CALL, SUBSCRIBE, UNSUBSCRIBE or PUBLISH of either protocol version.
+//Middleware may rewrite URI, Args & ArgsKw before passing it on.
+type Message struct{
+	Type MessageType //CALL, SUBSCRIBE, UNSUBSCRIBE or PUBLISH (also for v2 messages)
+	Conn *Connection
+	URI string //Procedure or topic (for v2 UNSUBSCRIBE the subscribed topic; rewriting it has no effect)
+	Args []interface{} //Call arguments or published event (v1 events are Args[0])
+	ArgsKw map[string]interface{} //v2 keyword arguments
+	Raw interface{} //Underlying message, e.g. *CallMsg or *PublishMsgV2
+}
+
+//Handles an inbound message. A returned error rejects it: calls (and v2 subscribe, unsubscribe &
+//acknowledged publish) are answered with the error, anything else is dropped.
+type MessageHandler func(msg *Message)(*RPCError)
+
+//Wraps the handling of every inbound message; call next to continue
+type Middleware func(next MessageHandler) MessageHandler
+
+//Wraps every server procedure (RegisterRPC, RegisterRPCContext, RegisterTypedRPC...) invocation.
+//Plain handlers are passed conn's context.
+type RPCMiddleware func(next ContextRPCHandler) ContextRPCHandler
+
+//Adds message middleware; the first added sees messages first
+func (t *Server) Use(mw ...Middleware){
+	t.middlewareLock.Lock()
+	defer t.middlewareLock.Unlock()
+
+	t.middleware = append(t.middleware,mw...)
+
+	h := MessageHandler(t.dispatch)
+	for i := len(t.middleware)-1; i >= 0; i--{
+		h = t.middleware[i](h)
+	}
+	t.inbound = h
+}
+
+//Adds procedure middleware; the first added runs outermost
+func (t *Server) UseRPC(mw ...RPCMiddleware){
+	t.middlewareLock.Lock()
+	t.rpcMiddleware = append(t.rpcMiddleware,mw...)
+	t.middlewareLock.Unlock()
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Built-in Middleware
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Logs every inbound message with its outcome & handling time
+func LogMessages() Middleware{
+	return func(next MessageHandler) MessageHandler{
+		return func(msg *Message)(*RPCError){
+			start := time.Now()
+			err := next(msg)
+			if err != nil{
+				log.Info("postmaster: %s %s from %s rejected in %s: %s", messageTypeName(msg.Type), msg.URI, msg.Conn.id, time.Since(start), err.URI)
+			}else{
+				log.Info("postmaster: %s %s from %s handled in %s", messageTypeName(msg.Type), msg.URI, msg.Conn.id, time.Since(start))
+			}
+			return err
+		}
+	}
+}
+
+//Logs every server procedure call with its outcome & duration
+func LogCalls() RPCMiddleware{
+	return func(next ContextRPCHandler) ContextRPCHandler{
+		return func(ctx context.Context, conn *Connection, uri string, args ...interface{})(interface{}, *RPCError){
+			start := time.Now()
+			res,err := next(ctx, conn, uri, args...)
+			if err != nil{
+				log.Info("postmaster: call %s by %s failed in %s: %s", uri, conn.id, time.Since(start), err.URI)
+			}else{
+				log.Info("postmaster: call %s by %s answered in %s", uri, conn.id, time.Since(start))
+			}
+			return res,err
+		}
+	}
+}
+
+//Turns a panic in later middleware or the handler into a rejection that earlier middleware sees.
+//Reported like any other panic (see Server.OnPanic & Server.PanicPolicy).
+func RecoverMessages() Middleware{
+	return func(next MessageHandler) MessageHandler{
+		return func(msg *Message)(err *RPCError){
+			defer func(){
+				if r := recover(); r != nil{
+					err = internalError(msg.Conn)
+					msg.Conn.server.reportPanic(msg.Conn, msg.URI, r, debug.Stack())
+				}
+			}()
+			return next(msg)
+		}
+	}
+}
+
+//Turns a panicking procedure into an error result that earlier procedure middleware sees.
+//Reported like any other panic (see Server.OnPanic & Server.PanicPolicy).
+func RecoverCalls() RPCMiddleware{
+	return func(next ContextRPCHandler) ContextRPCHandler{
+		return func(ctx context.Context, conn *Connection, uri string, args ...interface{})(res interface{}, err *RPCError){
+			defer func(){
+				if r := recover(); r != nil{
+					res,err = nil,internalError(conn)
+					conn.server.reportPanic(conn, uri, r, debug.Stack())
+				}
+			}()
+			return next(ctx, conn, uri, args...)
+		}
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Counters for one URI
+type URIStats struct{
+	Messages int //Inbound messages (Metrics.Messages)
+	Rejected int //Messages rejected by later middleware or handlers
+	Calls int //Server procedure calls (Metrics.Calls)
+	Errors int //Calls that returned an error
+	CallTime time.Duration //Total time spent in procedures
+	MaxCallTime time.Duration
+}
+
+//URIs Metrics counts separately by default; clients choose URIs, so the rest share METRICS_OVERFLOW
+const METRICS_MAX_URIS = 1000
+const METRICS_OVERFLOW = "postmaster.metrics.overflow"
+
+//Per URI message & call counters; add with Server.Use(m.Messages()) and Server.UseRPC(m.Calls())
+type Metrics struct{
+	MaxURIs int //URIs counted separately before the rest go to METRICS_OVERFLOW (default METRICS_MAX_URIS; set before use)
+
+	stats map[string]*URIStats
+	lock *sync.Mutex
+}
+
+func NewMetrics()*Metrics{
+	return &Metrics{
+		stats: make(map[string]*URIStats),
+		lock: new(sync.Mutex),
+	}
+}
+
+//Counts inbound messages & rejections
+func (m *Metrics) Messages() Middleware{
+	return func(next MessageHandler) MessageHandler{
+		return func(msg *Message)(*RPCError){
+			uri := msg.URI
+			err := next(msg)
+
+			m.lock.Lock()
+			s := m.get(uri)
+			s.Messages++
+			if err != nil{
+				s.Rejected++
+			}
+			m.lock.Unlock()
+
+			return err
+		}
+	}
+}
+
+//Counts procedure calls, errors & time spent
+func (m *Metrics) Calls() RPCMiddleware{
+	return func(next ContextRPCHandler) ContextRPCHandler{
+		return func(ctx context.Context, conn *Connection, uri string, args ...interface{})(interface{}, *RPCError){
+			start := time.Now()
+			res,err := next(ctx, conn, uri, args...)
+			d := time.Since(start)
+
+			m.lock.Lock()
+			s := m.get(uri)
+			s.Calls++
+			if err != nil{
+				s.Errors++
+			}
+			s.CallTime += d
+			if d > s.MaxCallTime{
+				s.MaxCallTime = d
+			}
+			m.lock.Unlock()
+
+			return res,err
+		}
+	}
+}
+
+//Copy of the counters by URI
+func (m *Metrics) Snapshot()(map[string]URIStats){
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	snap := make(map[string]URIStats,len(m.stats))
+	for uri,s := range m.stats{
+		snap[uri] = *s
+	}
+	return snap
+}
+
+//Forgets all counters
+func (m *Metrics) Reset(){
+	m.lock.Lock()
+	m.stats = make(map[string]*URIStats)
+	m.lock.Unlock()
+}
+
+//Counters for uri, or METRICS_OVERFLOW once MaxURIs are counted (lock must be held)
+func (m *Metrics) get(uri string)(*URIStats){
+	s,ok := m.stats[uri]
+	if ok{
+		return s
+	}
+
+	max := m.MaxURIs
+	if max <= 0{
+		max = METRICS_MAX_URIS
+	}
+	if len(m.stats) >= max{
+		uri = METRICS_OVERFLOW
+		if s,ok = m.stats[uri]; ok{
+			return s
+		}
+	}
+
+	s = &URIStats{}
+	m.stats[uri] = s
+	return s
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Middleware Utility Functions
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Passes a decoded message through the middleware; rejections are answered according to the message
+func (t *Server) handleInbound(conn *Connection, raw interface{}){
+	msg := t.newMessage(conn,raw)
+	defer t.recoverInbound(msg)
+
+	t.middlewareLock.RLock()
+	h := t.inbound
+	t.middlewareLock.RUnlock()
+	if h == nil{
+		h = t.dispatch
+	}
+
+	if err := h(msg); err != nil{
+		t.rejectMessage(msg,err)
+	}
+}
+
+func (t *Server) newMessage(conn *Connection, raw interface{})(*Message){
+	msg := &Message{Conn: conn, Raw: raw}
+	switch m := raw.(type){
+	case *CallMsg:
+		msg.Type,msg.URI,msg.Args = CALL,m.ProcURI,m.CallArgs
+	case *SubscribeMsg:
+		msg.Type,msg.URI = SUBSCRIBE,m.TopicURI
+	case *UnsubscribeMsg:
+		msg.Type,msg.URI = UNSUBSCRIBE,m.TopicURI
+	case *PublishMsg:
+		msg.Type,msg.URI,msg.Args = PUBLISH,m.TopicURI,[]interface{}{m.Event}
+	case *CallMsgV2:
+		msg.Type,msg.URI,msg.Args,msg.ArgsKw = CALL,m.Procedure,m.Arguments,m.ArgumentsKw
+	case *SubscribeMsgV2:
+		msg.Type,msg.URI = SUBSCRIBE,m.Topic
+	case *UnsubscribeMsgV2:
+		msg.Type = UNSUBSCRIBE
+		for _,sub := range t.subscriptions.ForConnection(conn.id){
+			if sub.id == m.Subscription{
+				msg.URI = sub.pattern
+			}
+		}
+	case *PublishMsgV2:
+		msg.Type,msg.URI,msg.Args,msg.ArgsKw = PUBLISH,m.Topic,m.Arguments,m.ArgumentsKw
+	}
+	return msg
+}
+
+//End of the middleware chain: applies rewrites and runs the message's handler
+func (t *Server) dispatch(msg *Message)(*RPCError){
+	conn := msg.Conn
+	switch m := msg.Raw.(type){
+	case *CallMsg:
+		m.ProcURI,m.CallArgs = msg.URI,msg.Args
+		t.handleCall(conn,*m)
+	case *SubscribeMsg:
+		m.TopicURI = msg.URI
+		t.handleSubscribe(conn,*m)
+	case *UnsubscribeMsg:
+		m.TopicURI = msg.URI
+		t.handleUnsubscribe(conn,*m)
+	case *PublishMsg:
+		m.TopicURI = msg.URI
+		switch len(msg.Args){
+		case 0:
+			m.Event = nil
+		case 1:
+			m.Event = msg.Args[0]
+		default:
+			m.Event = msg.Args
+		}
+		t.handlePublish(conn,*m)
+	case *CallMsgV2:
+		m.Procedure,m.Arguments,m.ArgumentsKw = msg.URI,msg.Args,msg.ArgsKw
+		t.handleCallV2(conn,*m)
+	case *SubscribeMsgV2:
+		m.Topic = msg.URI
+		t.handleSubscribeV2(conn,*m)
+	case *UnsubscribeMsgV2:
+		t.handleUnsubscribeV2(conn,*m)
+	case *PublishMsgV2:
+		m.Topic,m.Arguments,m.ArgumentsKw = msg.URI,msg.Args,msg.ArgsKw
+		t.handlePublishV2(conn,*m)
+	}
+	return nil
+}
+
+//Answers a message rejected by middleware (v1 has no error for anything but calls)
+func (t *Server) rejectMessage(msg *Message, err *RPCError){
+	log.Warn("postmaster: %s %s from %s rejected: %s %s", messageTypeName(msg.Type), msg.URI, msg.Conn.id, err.URI, err.Description)
+
+	conn := msg.Conn
+	switch m := msg.Raw.(type){
+	case *CallMsg:
+		callError := &CallErrorMsg{
+			CallID: m.CallID,
+			ErrorURI: err.URI,
+			ErrorDesc: err.Description,
+			ErrorDetails: err.Details,
+		}
+		conn.sendMessage(callError)
+	case *CallMsgV2:
+		t.sendErrorV2(conn, V2_CALL, m.Request, err)
+	case *SubscribeMsgV2:
+		t.sendErrorV2(conn, V2_SUBSCRIBE, m.Request, err)
+	case *UnsubscribeMsgV2:
+		t.sendErrorV2(conn, V2_UNSUBSCRIBE, m.Request, err)
+	case *PublishMsgV2:
+		if acknowledge,_ := m.Options["acknowledge"].(bool); acknowledge{
+			t.sendErrorV2(conn, V2_PUBLISH, m.Request, err)
+		}
+	}
+}
+
+//Applies procedure middleware to a handler
+func (t *Server) wrapRPC(h ContextRPCHandler)(ContextRPCHandler){
+	t.middlewareLock.RLock()
+	defer t.middlewareLock.RUnlock()
+
+	for i := len(t.rpcMiddleware)-1; i >= 0; i--{
+		h = t.rpcMiddleware[i](h)
+	}
+	return h
+}
+
+func messageTypeName(typ MessageType)(string){
+	switch typ{
+	case CALL:
+		return "CALL"
+	case SUBSCRIBE:
+		return "SUBSCRIBE"
+	case UNSUBSCRIBE:
+		return "UNSUBSCRIBE"
+	case PUBLISH:
+		return "PUBLISH"
+	}
+	return fmt.Sprintf("message %d", typ)
+}
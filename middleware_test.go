@@ -0,0 +1,27 @@
+package postmaster
+
+import(
+	"reflect"
+	"testing"
+)
+
+func TestMetricsMaxURIs(t *testing.T){
+	m := NewMetrics()
+	m.MaxURIs = 2
+	handle := m.Messages()(func(msg *Message)(*RPCError){
+		return nil
+	})
+
+	for _,uri := range []string{"a","b","c","a","d","c"}{
+		handle(&Message{URI: uri})
+	}
+
+	counts := make(map[string]int)
+	for uri,s := range m.Snapshot(){
+		counts[uri] = s.Messages
+	}
+	want := map[string]int{"a": 2, "b": 1, METRICS_OVERFLOW: 3}
+	if !reflect.DeepEqual(counts, want){
+		t.Errorf("counts %v, want %v", counts, want)
+	}
+}
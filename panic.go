@@ -0,0 +1,67 @@
+package postmaster
+
+import(
+	"context"
+	"runtime/debug"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Panic Recovery
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//What happens to a connection whose message or procedure panicked
+type PanicPolicy int
+const (
+	PANIC_KEEP_CONNECTION PanicPolicy = iota //Answer with an internal error and carry on (default)
+	PANIC_CLOSE_CONNECTION //Answer with an internal error, then close the connection
+)
+
+//Recovers a panic while decoding or handling a message (deferred)
+func (t *Server) recoverMessage(conn *Connection){
+	if r := recover(); r != nil{
+		t.reportPanic(conn, "", r, debug.Stack())
+	}
+}
+
+//Recovers a panic in middleware or a message handler (deferred); calls are answered with an internal error
+func (t *Server) recoverInbound(msg *Message){
+	if r := recover(); r != nil{
+		stack := debug.Stack()
+		t.rejectMessage(msg, internalError(msg.Conn))
+		t.reportPanic(msg.Conn, msg.URI, r, stack)
+	}
+}
+
+//Runs a server procedure; a panic becomes an internal error
+func (t *Server) runHandler(h ContextRPCHandler, ctx context.Context, conn *Connection, uri string, args []interface{})(res interface{}, err *RPCError){
+	defer func(){
+		if r := recover(); r != nil{
+			res,err = nil,internalError(conn)
+			t.reportPanic(conn, uri, r, debug.Stack())
+		}
+	}()
+	return h(ctx, conn, uri, args...)
+}
+
+//Logs a recovered panic, passes it to Server.OnPanic and applies Server.PanicPolicy
+func (t *Server) reportPanic(conn *Connection, uri string, r interface{}, stack []byte){
+	log.Error("postmaster: panic handling %s from %s: %v\n%s", uri, conn.id, r, stack)
+
+	if t.OnPanic != nil{
+		go t.OnPanic(conn, uri, r, stack)
+	}
+
+	if t.PanicPolicy == PANIC_CLOSE_CONNECTION{
+		log.Warn("postmaster: closing connection %s after panic", conn.id)
+		conn.closeAfterFlush()
+	}
+}
+
+func internalError(conn *Connection)(*RPCError){
+	if conn.version == 2{
+		return &RPCError{URI:V2_ERROR_INTERNAL, Description:"internal error"}
+	}
+	return &RPCError{URI:ERROR_INTERNAL, Description:"internal error"}
+}
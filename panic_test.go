@@ -0,0 +1,85 @@
+package postmaster
+
+import(
+	"context"
+	"testing"
+	"time"
+)
+
+//Panics in an Authenticator or handler are answered with an internal error and leave the
+//session usable (no locks left held) under PANIC_KEEP_CONNECTION
+func TestPanicKeepsConnection(t *testing.T){
+	s := newTestServer()
+	panicked := make(chan string,4)
+	s.OnPanic = func(conn *Connection, uri string, recovered interface{}, stack []byte){
+		panicked <- uri
+	}
+	s.RegisterAuthenticator("panic", funcAuthenticator(func(req *AuthRequest, signature string)(*AuthResult,error){
+		panic("authenticator")
+	}))
+	s.RegisterRPCContext("add", func(ctx context.Context, conn *Connection, uri string, args ...interface{})(interface{}, *RPCError){
+		panic("handler")
+	}, 0)
+	ts := startServer(s)
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+	recv(t, ws) //WELCOME
+
+	expectPanic := func(what string, uri string){
+		res := recv(t, ws)
+		if res[0] != float64(CALLERROR) || res[2] != ERROR_INTERNAL{
+			t.Fatalf("%s: expected internal error, got %v", what, res)
+		}
+		select{
+		case got := <-panicked:
+			if got != uri{
+				t.Errorf("%s: OnPanic uri %q, want %q", what, got, uri)
+			}
+		case <-time.After(2*time.Second):
+			t.Fatalf("%s: OnPanic not called", what)
+		}
+	}
+
+	//Authenticator
+	send(t, ws, CALL, "1", WAMP_PROCEDURE_URL+"authreq", "alice", map[string]interface{}{"authmethod": "panic"})
+	recv(t, ws) //Challenge
+	send(t, ws, CALL, "2", WAMP_PROCEDURE_URL+"auth", "signature")
+	expectPanic("authenticator", WAMP_PROCEDURE_URL+"auth")
+
+	var c *Connection
+	waitFor(t, "session", func()(bool){
+		conns := s.allConnections()
+		if len(conns) == 1{
+			c = conns[0]
+		}
+		return c != nil
+	})
+	if c.AuthState() != AUTH_STATE_NONE{
+		t.Errorf("state %s after authenticator panic, want none", c.AuthState())
+	}
+	authenticate(t, ws, "alice")
+
+	//Handler
+	send(t, ws, CALL, "4", "add", 1, 2)
+	expectPanic("handler", "add")
+
+	//Session management still works
+	if n := len(s.UserSessions("alice")); n != 1{
+		t.Errorf("%d sessions for alice, want 1", n)
+	}
+	if err := s.SetPermissions(c.id, testPermissions()); err != nil{
+		t.Error(err)
+	}
+	send(t, ws, SUBSCRIBE, "topic")
+	send(t, ws, CALL, "5", "nope") //Answered once the subscribe is handled
+	recv(t, ws)
+	s.PublishEvent("topic", "hi")
+	if ev := recv(t, ws); ev[0] != float64(EVENT){
+		t.Errorf("expected event, got %v", ev)
+	}
+	if err := s.Reauthenticate(c.id); err != nil{
+		t.Error(err)
+	}
+}
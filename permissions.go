@@ -0,0 +1,158 @@
+package postmaster
+
+import(
+	"strings"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Permission Checks
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Permission entries are keyed by URI or pattern (PubSubPermission.Match/RPCPermission.Match).
+//Precedence when checking a URI:
+//	1. An exact entry for the URI decides on its own (Deny refuses, otherwise its flags apply)
+//	2. Any matching pattern entry with Deny refuses
+//	3. Otherwise the action is allowed if any matching pattern entry allows it
+//Pattern entries are scanned on each check, so keep their number modest.
+
+//Whether the session may publish to topic
+func (p *Permissions) canPublish(topic string)(bool){
+	return p.checkPubSub(topic, MATCH_EXACT, allowsPublish)
+}
+
+//Whether the session may subscribe to pattern. A pattern subscription is allowed when an entry
+//covers every topic it could match; topics refused by narrower deny entries are filtered on delivery.
+func (p *Permissions) canSubscribe(pattern string, match MatchPolicy)(bool){
+	return p.checkPubSub(pattern, match, allowsSubscribe)
+}
+
+//Whether the session may have events it publishes to topic retained (v2 PUBLISH "retain" option)
+func (p *Permissions) canRetain(topic string)(bool){
+	return p.checkPubSub(topic, MATCH_EXACT, allowsRetain)
+}
+
+//Whether the session may call procedure
+func (p *Permissions) canCall(procedure string)(bool){
+	return p.checkRPC(procedure, false)
+}
+
+//Whether the session may register procedure
+func (p *Permissions) canRegister(procedure string)(bool){
+	return p.checkRPC(procedure, true)
+}
+
+//Flags an entry needs for each pub/sub action
+func allowsPublish(r PubSubPermission)(bool){ return r.CanPublish }
+func allowsSubscribe(r PubSubPermission)(bool){ return r.CanSubscribe }
+func allowsRetain(r PubSubPermission)(bool){ return r.CanPublish && r.CanRetain }
+
+func (p *Permissions) checkPubSub(uri string, match MatchPolicy, allows func(PubSubPermission)(bool))(bool){
+	if p == nil{
+		return false
+	}
+
+	if r,ok := p.PubSub[uri]; ok && r.Match == MATCH_EXACT && match == MATCH_EXACT{
+		return !r.Deny && allows(r)
+	}
+
+	allowed := false
+	for pattern,r := range p.PubSub{
+		if r.Match == MATCH_EXACT || !covers(pattern, r.Match, uri, match){
+			continue
+		}
+		if r.Deny{
+			return false
+		}
+		allowed = allowed || allows(r)
+	}
+	return allowed
+}
+
+func (p *Permissions) checkRPC(procedure string, register bool)(bool){
+	if p == nil{
+		return false
+	}
+
+	allows := func(r RPCPermission)(bool){
+		if register{
+			return r.CanRegister
+		}
+		return r.CanCall
+	}
+
+	if r,ok := p.RPC[procedure]; ok && r.Match == MATCH_EXACT{
+		return !r.Deny && allows(r)
+	}
+
+	allowed := false
+	for pattern,r := range p.RPC{
+		if r.Match == MATCH_EXACT || !covers(pattern, r.Match, procedure, MATCH_EXACT){
+			continue
+		}
+		if r.Deny{
+			return false
+		}
+		allowed = allowed || allows(r)
+	}
+	return allowed
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Pattern Matching
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Whether every URI matched by uri (itself a pattern unless um is MATCH_EXACT) is matched by pattern
+func covers(pattern string, m MatchPolicy, uri string, um MatchPolicy)(bool){
+	uriSegs := strings.Split(uri,".")
+	if um == MATCH_WILDCARD && wildcardAt(uriSegs) < 0{
+		um = MATCH_EXACT //No wildcard segments; matches just itself
+	}
+
+	switch m{
+	case MATCH_PREFIX:
+		if um == MATCH_WILDCARD{
+			//Matched URIs all start with the segments before the first wildcard
+			i := wildcardAt(uriSegs)
+			literal := ""
+			if i > 0{
+				literal = strings.Join(uriSegs[:i],".") + "."
+			}
+			return strings.HasPrefix(literal,pattern)
+		}
+		return strings.HasPrefix(uri,pattern)
+	case MATCH_WILDCARD:
+		if um == MATCH_PREFIX{
+			return false //Prefix patterns match any number of segments
+		}
+		segs := strings.Split(pattern,".")
+		if len(segs) != len(uriSegs){
+			return false
+		}
+		for i,seg := range segs{
+			switch{
+			case seg == "":
+				if uriSegs[i] == "" && um == MATCH_EXACT{
+					return false //Wildcard segments match non-empty segments only
+				}
+			case seg != uriSegs[i]:
+				return false
+			}
+		}
+		return true
+	}
+	return um == MATCH_EXACT && pattern == uri
+}
+
+//Index of the first wildcard (empty) segment, -1 if there is none
+func wildcardAt(segs []string)(int){
+	for i,seg := range segs{
+		if seg == ""{
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,187 @@
+package postmaster
+
+import(
+	"testing"
+)
+
+func TestCovers(t *testing.T){
+	tests := []struct{
+		pattern string
+		m MatchPolicy
+		uri string
+		um MatchPolicy
+		covered bool
+	}{
+		//Exact
+		{"com.app.topic", MATCH_EXACT, "com.app.topic", MATCH_EXACT, true},
+		{"com.app.topic", MATCH_EXACT, "com.app.other", MATCH_EXACT, false},
+		{"com.app.topic", MATCH_EXACT, "com.app.topic", MATCH_PREFIX, false},
+		{"com.app..topic", MATCH_EXACT, "com.app..topic", MATCH_WILDCARD, false},
+		{"com.app.topic", MATCH_EXACT, "com.app.topic", MATCH_WILDCARD, true}, //No wildcard segments
+
+		//Prefix
+		{"com.app.", MATCH_PREFIX, "com.app.topic", MATCH_EXACT, true},
+		{"com.app.", MATCH_PREFIX, "com.other.topic", MATCH_EXACT, false},
+		{"com.app", MATCH_PREFIX, "com.apple", MATCH_EXACT, true}, //Prefixes aren't segment aligned
+		{"com.app.", MATCH_PREFIX, "com.app.sub.", MATCH_PREFIX, true},
+		{"com.app.sub.", MATCH_PREFIX, "com.app.", MATCH_PREFIX, false},
+		{"com.app.", MATCH_PREFIX, "com.app..topic", MATCH_WILDCARD, true},
+		{"com.app.", MATCH_PREFIX, "com..topic", MATCH_WILDCARD, false},
+		{"com.app.", MATCH_PREFIX, ".app.topic", MATCH_WILDCARD, false},
+		{"", MATCH_PREFIX, ".app.topic", MATCH_WILDCARD, true},
+
+		//Wildcard
+		{"com..topic", MATCH_WILDCARD, "com.app.topic", MATCH_EXACT, true},
+		{"com..topic", MATCH_WILDCARD, "com.app.other", MATCH_EXACT, false},
+		{"com..topic", MATCH_WILDCARD, "com.app.sub.topic", MATCH_EXACT, false},
+		{"com..topic", MATCH_WILDCARD, "com..topic", MATCH_EXACT, false}, //Wildcards match non-empty segments only
+		{"com..topic", MATCH_WILDCARD, "com..topic", MATCH_WILDCARD, true},
+		{"com...", MATCH_WILDCARD, "com.app..", MATCH_WILDCARD, true},
+		{"com.app.", MATCH_WILDCARD, "com..topic", MATCH_WILDCARD, false},
+		{"com..topic", MATCH_WILDCARD, "com.app.", MATCH_PREFIX, false},
+	}
+	for _,test := range tests{
+		if got := covers(test.pattern, test.m, test.uri, test.um); got != test.covered{
+			t.Errorf("covers(%q %d, %q %d) = %t, want %t", test.pattern, test.m, test.uri, test.um, got, test.covered)
+		}
+	}
+}
+
+func TestCheckPubSub(t *testing.T){
+	p := &Permissions{PubSub: map[string]PubSubPermission{
+		"com.app.": {Match: MATCH_PREFIX, CanPublish: true, CanSubscribe: true},
+		"com.app.admin.": {Match: MATCH_PREFIX, Deny: true},
+		"com.app.admin.status": {CanSubscribe: true}, //Exact entry beats the deny pattern
+		"com.app.secret": {Deny: true, CanPublish: true}, //Deny beats the entry's own flags
+		"com..feed": {Match: MATCH_WILDCARD, CanSubscribe: true},
+		"com.news.feed": {CanPublish: true}, //Exact entry beats the wildcard
+		"com.log.": {Match: MATCH_PREFIX, CanPublish: true},
+		"com.log..": {Match: MATCH_WILDCARD, CanSubscribe: true}, //Allows combine across patterns
+	}}
+
+	tests := []struct{
+		uri string
+		match MatchPolicy
+		subscribe bool
+		allowed bool
+	}{
+		//Exact vs pattern
+		{"com.app.topic", MATCH_EXACT, false, true},
+		{"com.app.admin.status", MATCH_EXACT, true, true},
+		{"com.app.admin.status", MATCH_EXACT, false, false},
+		{"com.news.feed", MATCH_EXACT, false, true},
+		{"com.news.feed", MATCH_EXACT, true, false},
+		{"com.sports.feed", MATCH_EXACT, true, true},
+		{"com.sports.feed", MATCH_EXACT, false, false},
+
+		//Deny vs allow
+		{"com.app.admin.users", MATCH_EXACT, true, false},
+		{"com.app.admin.users", MATCH_EXACT, false, false},
+		{"com.app.secret", MATCH_EXACT, false, false},
+		{"com.app.secret", MATCH_EXACT, true, false},
+		{"com.log.app.error", MATCH_EXACT, false, true},
+		{"com.log.app.error", MATCH_EXACT, true, true},
+
+		//Prefix vs wildcard coverage
+		{"com.app.", MATCH_PREFIX, true, true}, //Narrower deny entries are filtered on delivery
+		{"com.app.admin.", MATCH_PREFIX, true, false},
+		{"com.app.public.", MATCH_PREFIX, true, true},
+		{"com.app..status", MATCH_WILDCARD, true, true},
+		{"com..feed", MATCH_WILDCARD, true, true},
+		{"com.", MATCH_PREFIX, true, false},
+		{"com..", MATCH_WILDCARD, true, false},
+		{"com.app.admin.status", MATCH_PREFIX, true, false}, //Exact entries don't grant patterns
+
+		//Unknown
+		{"org.app.topic", MATCH_EXACT, true, false},
+	}
+	for _,test := range tests{
+		allows := allowsPublish
+		if test.subscribe{
+			allows = allowsSubscribe
+		}
+		if got := p.checkPubSub(test.uri, test.match, allows); got != test.allowed{
+			t.Errorf("checkPubSub(%q, %d, subscribe %t) = %t, want %t", test.uri, test.match, test.subscribe, got, test.allowed)
+		}
+	}
+
+	var none *Permissions
+	if none.canSubscribe("com.app.topic", MATCH_EXACT){
+		t.Error("nil permissions allowed subscribe")
+	}
+}
+
+//Retaining takes CanRetain on top of CanPublish, with the usual precedence
+func TestCanRetain(t *testing.T){
+	p := &Permissions{PubSub: map[string]PubSubPermission{
+		"com.status.": {Match: MATCH_PREFIX, CanPublish: true, CanRetain: true},
+		"com.status.private": {Deny: true, CanPublish: true, CanRetain: true},
+		"com.status.feed": {CanPublish: true}, //Exact entry without CanRetain
+		"com.chat.": {Match: MATCH_PREFIX, CanPublish: true},
+		"com.flag": {CanRetain: true}, //CanRetain alone doesn't allow publishing
+	}}
+
+	tests := []struct{
+		topic string
+		allowed bool
+	}{
+		{"com.status.server", true},
+		{"com.status.private", false},
+		{"com.status.feed", false},
+		{"com.chat.room", false},
+		{"com.flag", false},
+		{"org.status.server", false},
+	}
+	for _,test := range tests{
+		if got := p.canRetain(test.topic); got != test.allowed{
+			t.Errorf("canRetain(%q) = %t, want %t", test.topic, got, test.allowed)
+		}
+	}
+}
+
+func TestCheckRPC(t *testing.T){
+	p := &Permissions{RPC: map[string]RPCPermission{
+		"com.app.": {Match: MATCH_PREFIX, CanCall: true},
+		"com.app.admin.": {Match: MATCH_PREFIX, Deny: true},
+		"com.app.admin.ping": {CanCall: true}, //Exact entry beats the deny pattern
+		"com.app.reset": {Deny: true, CanCall: true},
+		"com..worker": {Match: MATCH_WILDCARD, CanRegister: true},
+		"com.jobs.worker": {CanCall: true}, //Exact entry beats the wildcard
+	}}
+
+	tests := []struct{
+		procedure string
+		register bool
+		allowed bool
+	}{
+		//Exact vs pattern
+		{"com.app.add", false, true},
+		{"com.app.add", true, false},
+		{"com.app.admin.ping", false, true},
+		{"com.jobs.worker", false, true},
+		{"com.jobs.worker", true, false},
+		{"com.mail.worker", true, true},
+		{"com.mail.worker", false, false},
+
+		//Deny vs allow
+		{"com.app.admin.kick", false, false},
+		{"com.app.reset", false, false},
+
+		//Wildcards match one non-empty segment
+		{"com..worker", true, false},
+		{"com.mail.sub.worker", true, false},
+
+		//Unknown
+		{"org.app.add", false, false},
+	}
+	for _,test := range tests{
+		if got := p.checkRPC(test.procedure, test.register); got != test.allowed{
+			t.Errorf("checkRPC(%q, register %t) = %t, want %t", test.procedure, test.register, got, test.allowed)
+		}
+	}
+
+	var none *Permissions
+	if none.canCall("com.app.add"){
+		t.Error("nil permissions allowed call")
+	}
+}
@@ -2,6 +2,7 @@ package postmaster
 
 import(
 	"code.google.com/p/go.net/websocket"
+	"net/http"
 )
 
 type Handler interface {
@@ -13,4 +14,22 @@ func HandleWebsocket(t Handler) func(*websocket.Conn) {
 	return func(conn *websocket.Conn) {
 		t.HandleWebsocket(conn)
 	}
-}
\ No newline at end of file
+}
+
+//Subprotocols in order of preference
+var supportedProtocols = []string{WAMP_V2_MSGPACK_PROTOCOL, WAMP_V2_JSON_PROTOCOL, WAMP_V1_PROTOCOL}
+
+// Handshake selects the WAMP version from the subprotocols offered by the client.
+// Use as websocket.Server.Handshake; clients offering no known subprotocol speak WAMP v1.
+func Handshake(config *websocket.Config, req *http.Request) error {
+	for _, p := range supportedProtocols {
+		for _, offered := range config.Protocol {
+			if offered == p {
+				config.Protocol = []string{p}
+				return nil
+			}
+		}
+	}
+	config.Protocol = nil
+	return nil
+}
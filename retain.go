@@ -0,0 +1,229 @@
+package postmaster
+
+import(
+	"errors"
+	"sort"
+	"sync"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Retained Events
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+var ErrNoRetainStore = errors.New("postmaster: no RetainStore set")
+
+//Keeps the last retained event of each topic for sessions that subscribe later. Implementations
+//backed by shared storage let several instances serve the same retained events.
+type RetainStore interface{
+	//Keeps ev as the retained event of its realm & topic, replacing the previous one
+	Set(ev *BrokerEvent) error
+
+	//Returns the retained event of topic in realm (nil if none)
+	Get(realm string, topic string)(*BrokerEvent,error)
+
+	//Returns the retained events of all topics in realm
+	List(realm string)([]*BrokerEvent,error)
+
+	//Forgets the retained event of topic in realm
+	Delete(realm string, topic string) error
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+//In process RetainStore
+type MemoryRetainStore struct{
+	events map[string]map[string]*BrokerEvent //Realm -> topic -> event
+	lock *sync.RWMutex
+}
+
+func NewMemoryRetainStore()*MemoryRetainStore{
+	return &MemoryRetainStore{
+		events: make(map[string]map[string]*BrokerEvent),
+		lock: new(sync.RWMutex),
+	}
+}
+
+func (s *MemoryRetainStore) Set(ev *BrokerEvent) error{
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	topics,ok := s.events[ev.Realm]
+	if !ok{
+		topics = make(map[string]*BrokerEvent)
+		s.events[ev.Realm] = topics
+	}
+	topics[ev.TopicURI] = ev
+
+	return nil
+}
+
+func (s *MemoryRetainStore) Get(realm string, topic string)(*BrokerEvent,error){
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.events[realm][topic],nil
+}
+
+func (s *MemoryRetainStore) List(realm string)([]*BrokerEvent,error){
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	events := make([]*BrokerEvent,0,len(s.events[realm]))
+	for _,ev := range s.events[realm]{
+		events = append(events,ev)
+	}
+	sort.Slice(events,func(i, j int)(bool){
+		return events[i].TopicURI < events[j].TopicURI
+	})
+	return events,nil
+}
+
+func (s *MemoryRetainStore) Delete(realm string, topic string) error{
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if topics,ok := s.events[realm]; ok{
+		delete(topics,topic)
+		if len(topics) == 0{
+			delete(s.events,realm)
+		}
+	}
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Server Retention
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Retains the last event published to uri (in every realm) and sends it to sessions as they subscribe.
+//v2 publications can also ask for retention with the "retain" option. Needs Server.RetainStore.
+func (t *Server) RetainTopic(uri string){
+	t.retainLock.Lock()
+	t.retainedTopics[uri] = true
+	t.retainLock.Unlock()
+}
+
+//Stops retaining events published to uri; the event already retained stays until ClearRetained
+func (t *Server) UnretainTopic(uri string){
+	t.retainLock.Lock()
+	delete(t.retainedTopics,uri)
+	t.retainLock.Unlock()
+}
+
+//Returns the event retained for uri in realm (nil if none)
+func (t *Server) RetainedEvent(realm string, uri string)(*BrokerEvent,error){
+	if t.RetainStore == nil{
+		return nil,ErrNoRetainStore
+	}
+	return t.RetainStore.Get(realm,uri)
+}
+
+//Returns the events retained in realm, one per topic
+func (t *Server) RetainedEvents(realm string)([]*BrokerEvent,error){
+	if t.RetainStore == nil{
+		return nil,ErrNoRetainStore
+	}
+	return t.RetainStore.List(realm)
+}
+
+//Forgets the event retained for uri in realm
+func (t *Server) ClearRetained(realm string, uri string) error{
+	if t.RetainStore == nil{
+		return ErrNoRetainStore
+	}
+	return t.RetainStore.Delete(realm,uri)
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Retention Utility Functions
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+func (t *Server) retainsTopic(uri string)(bool){
+	t.retainLock.RLock()
+	defer t.retainLock.RUnlock()
+
+	return t.retainedTopics[uri]
+}
+
+//Stores a copy of ev if it is to be retained. Targeted events (eligible list) are never retained;
+//excluded sessions stay excluded when they subscribe later.
+func (t *Server) retain(ev *BrokerEvent){
+	if t.RetainStore == nil || ev.EligibleList != nil || !(ev.Retain || t.retainsTopic(ev.TopicURI)){
+		return
+	}
+
+	//ev may be shared with other instances; keep a copy
+	kept := *ev
+	if kept.Publication == 0{
+		kept.Publication = newWAMPID()
+	}
+
+	if err := t.RetainStore.Set(&kept); err != nil{
+		log.Error("postmaster: error retaining event for %s: %s", ev.TopicURI, err)
+	}
+}
+
+//Sends a new subscription the retained events it matches (subID is the v2 subscription)
+func (t *Server) sendRetained(conn *Connection, subID WAMPID, pattern string, match MatchPolicy){
+	if t.RetainStore == nil{
+		return
+	}
+
+	var events []*BrokerEvent
+	var err error
+	if match == MATCH_EXACT{
+		var ev *BrokerEvent
+		if ev,err = t.RetainStore.Get(conn.realm,pattern); ev != nil{
+			events = []*BrokerEvent{ev}
+		}
+	}else{
+		events,err = t.RetainStore.List(conn.realm)
+	}
+	if err != nil{
+		log.Error("postmaster: error loading retained events for %s: %s", pattern, err)
+		return
+	}
+
+	for _,ev := range events{
+		if ev.excludes(conn.id){
+			continue
+		}
+
+		//Pattern subscriptions may reach topics refused by a narrower deny entry
+		if match != MATCH_EXACT && (!covers(pattern,match,ev.TopicURI,MATCH_EXACT) || !conn.Permissions().canSubscribe(ev.TopicURI,MATCH_EXACT)){
+			continue
+		}
+
+		if conn.version == 2{
+			event := &EventMsgV2{
+				Subscription: subID,
+				Publication: ev.Publication,
+				Details: map[string]interface{}{"retained": true},
+			}
+			if match != MATCH_EXACT{
+				event.Details["topic"] = ev.TopicURI
+			}
+			event.Arguments,event.ArgumentsKw = ev.v2Arguments()
+			conn.sendMessage(event)
+		}else{
+			conn.sendMessage(&EventMsg{TopicURI: ev.TopicURI, Event: ev.Event})
+		}
+	}
+}
+
+//Whether the publisher excluded session id from ev
+func (ev *BrokerEvent) excludes(id ConnectionID)(bool){
+	for _,excluded := range ev.ExcludeList{
+		if ConnectionID(excluded) == id{
+			return true
+		}
+	}
+	return false
+}
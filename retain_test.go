@@ -0,0 +1,101 @@
+package postmaster
+
+import(
+	"testing"
+	"code.google.com/p/go.net/websocket"
+)
+
+//Sessions excluded from a publication don't get it as a retained event either
+func TestRetainedExcludeList(t *testing.T){
+	s := newTestServer()
+	s.RetainStore = NewMemoryRetainStore()
+	s.RetainTopic("topic")
+	ts := startServer(s)
+	defer ts.Close()
+
+	publisher := dial(t, ts, WAMP_V2_JSON_PROTOCOL)
+	defer publisher.Close()
+	join(t, publisher, nil)
+
+	excluded := dial(t, ts, WAMP_V2_JSON_PROTOCOL)
+	defer excluded.Close()
+	excludedID := join(t, excluded, nil)
+
+	other := dial(t, ts, WAMP_V2_JSON_PROTOCOL)
+	defer other.Close()
+	join(t, other, nil)
+
+	send(t, publisher, V2_PUBLISH, 1, map[string]interface{}{"acknowledge": true, "exclude": []interface{}{excludedID}}, "topic", []interface{}{"hi"})
+	if msg := recv(t, publisher); msg[0] != float64(V2_PUBLISHED){
+		t.Fatalf("publish failed: %v", msg)
+	}
+
+	tests := []struct{
+		name string
+		ws *websocket.Conn
+		retained bool
+	}{
+		{"excluded", excluded, false},
+		{"publisher", publisher, false}, //exclude_me
+		{"other", other, true},
+	}
+	for _,test := range tests{
+		send(t, test.ws, V2_SUBSCRIBE, 2, map[string]interface{}{}, "topic")
+		if msg := recv(t, test.ws); msg[0] != float64(V2_SUBSCRIBED){
+			t.Fatalf("%s: subscribe failed: %v", test.name, msg)
+		}
+		if test.retained{
+			if msg := recv(t, test.ws); msg[0] != float64(V2_EVENT){
+				t.Errorf("%s: expected retained event, got %v", test.name, msg)
+			}
+		}else{
+			recvNothing(t, test.ws)
+		}
+	}
+}
+
+//The retain PUBLISH option only keeps events for sessions with CanRetain on the topic
+func TestRetainOptionPermission(t *testing.T){
+	tests := []struct{
+		name string
+		perm PubSubPermission
+		retained bool
+	}{
+		{"publish only", PubSubPermission{CanPublish: true, CanSubscribe: true}, false},
+		{"can retain", PubSubPermission{CanPublish: true, CanSubscribe: true, CanRetain: true}, true},
+	}
+	for _,test := range tests{
+		s := newTestServer()
+		s.RetainStore = NewMemoryRetainStore()
+		perm := test.perm
+		s.GetRealmPermissions = func(realm string, details map[string]interface{})(Permissions,error){
+			return Permissions{PubSub: map[string]PubSubPermission{"topic": perm}},nil
+		}
+		ts := startServer(s)
+
+		publisher := dial(t, ts, WAMP_V2_JSON_PROTOCOL)
+		join(t, publisher, nil)
+		send(t, publisher, V2_PUBLISH, 1, map[string]interface{}{"acknowledge": true, "retain": true}, "topic", []interface{}{"hi"})
+		if msg := recv(t, publisher); msg[0] != float64(V2_PUBLISHED){
+			t.Fatalf("%s: publish failed: %v", test.name, msg)
+		}
+
+		subscriber := dial(t, ts, WAMP_V2_JSON_PROTOCOL)
+		join(t, subscriber, nil)
+		send(t, subscriber, V2_SUBSCRIBE, 2, map[string]interface{}{}, "topic")
+		if msg := recv(t, subscriber); msg[0] != float64(V2_SUBSCRIBED){
+			t.Fatalf("%s: subscribe failed: %v", test.name, msg)
+		}
+		if test.retained{
+			if msg := recv(t, subscriber); msg[0] != float64(V2_EVENT){
+				t.Errorf("%s: expected retained event, got %v", test.name, msg)
+			}
+		}else{
+			recvNothing(t, subscriber)
+		}
+
+		publisher.Close()
+		subscriber.Close()
+		ts.Close()
+	}
+}
@@ -0,0 +1,449 @@
+package postmaster
+
+import(
+	"code.google.com/p/go.net/websocket"
+	"errors"
+	"io"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	WAMP v2 Router (Basic Profile)
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Returned from GetRealmPermissions or AuthenticateRealm to reject a HELLO for an unknown realm
+var ErrNoSuchRealm = errors.New("postmaster: no such realm")
+
+//Roles announced in WELCOME
+var v2RouterRoles = map[string]interface{}{
+	"broker": map[string]interface{}{},
+	"dealer": map[string]interface{}{},
+}
+
+//Handles a WAMP v2 session for the life of the websocket
+func (t *Server) handleWebsocketV2(conn *websocket.Conn){
+	c,err := t.registerConnectionV2(conn)
+	if err != nil{
+		log.Error("postmaster: error registering v2 connection: %s", err)
+		return
+	}
+
+	//Shutdown started while registering; it may have missed this connection
+	if t.shuttingDown(){
+		t.closeForShutdown(c)
+	}
+
+	go t.sendOnConn(c,conn)
+
+	t.recieveOnConnV2(c,conn)
+
+	t.disconnect(c)
+}
+
+//Waits for HELLO, joins realm and sends WELCOME
+func (t *Server) registerConnectionV2(conn *websocket.Conn)(*Connection,error){
+	s := serializerFor(negotiatedProtocol(conn))
+
+	var rec []byte
+	if err := websocket.Message.Receive(conn, &rec); err != nil{
+		return nil,err
+	}
+
+	var hello HelloMsg
+	data,err := s.Deserialize(rec)
+	if err != nil || messageType(data) != V2_HELLO || hello.fromArray(data) != nil{
+		sendAbort(conn, s, V2_ERROR_PROTOCOL_VIOLATION, "expected HELLO")
+		return nil,errors.New("first message not HELLO")
+	}
+
+	if t.GetRealmPermissions == nil && t.AuthenticateRealm == nil{
+		log.Error("GetRealmPermissions nil: required for v2 clients")
+		sendAbort(conn, s, V2_ERROR_NO_SUCH_REALM, "realms not supported")
+		return nil,ErrNoSuchRealm
+	}
+
+	res,err := t.joinRealm(hello.Realm, hello.Details)
+	if err == ErrNoSuchRealm{
+		sendAbort(conn, s, V2_ERROR_NO_SUCH_REALM, "no such realm: "+hello.Realm)
+		return nil,err
+	}else if err != nil{
+		sendAbort(conn, s, V2_ERROR_NOT_AUTHORIZED, err.Error())
+		return nil,err
+	}
+	perms := res.Permissions
+	authID := res.Username //HELLO's authid is a claim, not an identity
+
+	session := newWAMPID()
+
+	//Create Connection (v2 sessions are authenticated once they join a realm; only AuthenticateRealm names them)
+	newConn := newConnection(t, ConnectionID(session.String()), conn)
+	newConn.version = 2
+	newConn.serializer = s
+	newConn.realm = hello.Realm
+	newConn.remoteAddr = remoteHost(conn)
+	newConn.authState = AUTH_STATE_AUTHENTICATED
+	newConn.perms = &perms
+	newConn.username = authID
+	newConn.pendingAuth = &PendingAuth{authKey:authID, authExtra:hello.Details, p:perms}
+
+	welcome := &WelcomeMsgV2{
+		Session: session,
+		Details: map[string]interface{}{
+			"roles": v2RouterRoles,
+			"agent": POSTMASTER_SERVER_ID,
+		},
+	}
+	out,_ := serialize(s, welcome)
+	if err := writeFrame(conn, s, out); err != nil{
+		return nil,errors.New("error sending welcome message, aborting connection:"+ err.Error())
+	}
+
+	t.addConnection(newConn)
+
+	log.Info("client joined realm %s: %s", hello.Realm, newConn.id)
+
+	if t.OnAuthenticated != nil{
+		go t.OnAuthenticated(authID, hello.Details, perms)
+	}
+
+	return newConn,nil
+}
+
+//Grants a session joining realm its permissions and, through AuthenticateRealm only, a verified username
+func (t *Server) joinRealm(realm string, details map[string]interface{})(*AuthResult,error){
+	if t.AuthenticateRealm == nil{
+		perms,err := t.GetRealmPermissions(realm, details)
+		if err != nil{
+			return nil,err
+		}
+		return &AuthResult{Permissions:perms},nil
+	}
+
+	res,err := t.AuthenticateRealm(realm, details)
+	if err == nil && res == nil{
+		err = errors.New("postmaster: AuthenticateRealm returned no result")
+	}
+	return res,err
+}
+
+//Recieves on channel for life of connection
+func (t *Server) recieveOnConnV2(conn *Connection, ws *websocket.Conn){
+	Connection_Loop:
+	for {
+		//Recieve message (text frames are kept as bytes too)
+		var rec []byte
+		err := websocket.Message.Receive(ws, &rec)
+		if err != nil {
+			//Don't error on normal socket close
+			if err != io.EOF {
+				log.Error("postmaster: error receiving message, aborting connection: %s", err)
+			}
+			break Connection_Loop
+		}
+		traceInbound(conn, rec)
+
+		if !t.handleMessageV2(conn, ws, rec){
+			break Connection_Loop
+		}
+	}
+}
+
+//Decodes & handles one message; false ends the session. A panic is recovered and reported (see Server.PanicPolicy).
+func (t *Server) handleMessageV2(conn *Connection, ws *websocket.Conn, rec []byte)(bool){
+	defer t.recoverMessage(conn)
+
+	data,err := conn.serializer.Deserialize(rec)
+	if err != nil{
+		log.Error("postmaster: invalid message format, message dropped: %q", rec)
+		return true
+	}
+
+	switch typ := messageType(data); typ {
+	case V2_SUBSCRIBE:
+		var msg SubscribeMsgV2
+		if err := msg.fromArray(data); err != nil {
+			log.Error("postmaster: error unmarshalling subscribe message: %s", err)
+			return true
+		}
+		t.handleInbound(conn, &msg)
+	case V2_UNSUBSCRIBE:
+		var msg UnsubscribeMsgV2
+		if err := msg.fromArray(data); err != nil {
+			log.Error("postmaster: error unmarshalling unsubscribe message: %s", err)
+			return true
+		}
+		t.handleInbound(conn, &msg)
+	case V2_PUBLISH:
+		var msg PublishMsgV2
+		if err := msg.fromArray(data); err != nil {
+			log.Error("postmaster: error unmarshalling publish message: %s", err)
+			return true
+		}
+		t.handleInbound(conn, &msg)
+	case V2_CALL:
+		var msg CallMsgV2
+		if err := msg.fromArray(data); err != nil {
+			log.Error("postmaster: error unmarshalling call message: %s", err)
+			return true
+		}
+		t.handleInbound(conn, &msg)
+	case V2_REGISTER:
+		var msg RegisterMsg
+		if err := msg.fromArray(data); err != nil {
+			log.Error("postmaster: error unmarshalling register message: %s", err)
+			return true
+		}
+		t.handleRegister(conn, msg)
+	case V2_UNREGISTER:
+		var msg UnregisterMsg
+		if err := msg.fromArray(data); err != nil {
+			log.Error("postmaster: error unmarshalling unregister message: %s", err)
+			return true
+		}
+		t.handleUnregister(conn, msg)
+	case V2_YIELD:
+		var msg YieldMsg
+		if err := msg.fromArray(data); err != nil {
+			log.Error("postmaster: error unmarshalling yield message: %s", err)
+			return true
+		}
+		t.handleYield(conn, msg)
+	case V2_ERROR:
+		var msg ErrorMsg
+		if err := msg.fromArray(data); err != nil || msg.RequestType != V2_INVOCATION {
+			log.Error("postmaster: invalid error message dropped: %v", data)
+			return true
+		}
+		t.handleInvocationError(conn, msg)
+	case V2_GOODBYE:
+		goodbye := &GoodbyeMsg{Reason: V2_CLOSE_GOODBYE_AND_OUT}
+		out,_ := serialize(conn.serializer, goodbye)
+		writeFrame(ws, conn.serializer, out)
+		return false
+	case V2_HELLO:
+		sendAbort(ws, conn.serializer, V2_ERROR_PROTOCOL_VIOLATION, "HELLO recieved after session established")
+		return false
+	default:
+		log.Error("postmaster: invalid message format, message dropped: %v", data)
+	}
+	return true
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	WAMP v2 Message Handling
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+func (t *Server) handlePublishV2(conn *Connection, msg PublishMsgV2){
+	log.Trace("postmaster: handling v2 publish message")
+
+	acknowledge,_ := msg.Options["acknowledge"].(bool)
+
+	//Make sure this connection can publish on this uri
+	if !conn.Permissions().canPublish(msg.Topic){
+		log.Error("postmaster: Connection tried to publish to incorrect uri: %s",msg.Topic)
+		if acknowledge{
+			t.sendErrorV2(conn, V2_PUBLISH, msg.Request, &RPCError{URI:V2_ERROR_NOT_AUTHORIZED, Description:"not authorized to publish to topic"})
+		}
+		return
+	}
+
+	ev := &BrokerEvent{
+		Origin: t.localID,
+		Realm: conn.realm,
+		TopicURI: msg.Topic,
+		Arguments: msg.Arguments,
+		ArgumentsKw: msg.ArgumentsKw,
+		ExcludeList: idList(msg.Options["exclude"]),
+		EligibleList: idList(msg.Options["eligible"]),
+		Publication: newWAMPID(),
+	}
+	if retain,_ := msg.Options["retain"].(bool); retain{
+		//Published either way; only kept if the session may retain on the topic
+		if ev.Retain = conn.Permissions().canRetain(msg.Topic); !ev.Retain{
+			log.Debug("postmaster: retain option ignored, not permitted on %s", msg.Topic)
+		}
+	}
+
+	//v1 subscribers get a single value
+	switch{
+	case len(msg.Arguments) == 1:
+		ev.Event = msg.Arguments[0]
+	case len(msg.Arguments) > 1:
+		ev.Event = msg.Arguments
+	default:
+		ev.Event = msg.ArgumentsKw
+	}
+
+	//Publisher is excluded unless it asks otherwise
+	if excludeMe,ok := msg.Options["exclude_me"].(bool); !ok || excludeMe{
+		ev.ExcludeList = append(ev.ExcludeList, string(conn.id))
+	}
+
+	//Give server option to intercept and/or kill event
+	if t.MessageToPublish != nil{
+		intercept := PublishMsg{
+			TopicURI: ev.TopicURI,
+			Event: ev.Event,
+			ExcludeList: ev.ExcludeList,
+			EligibleList: ev.EligibleList,
+		}
+		if !t.MessageToPublish(conn,intercept){
+			log.Debug("postmaster: event vetoed by server: %s",ev.Event)
+			return
+		}
+	}
+
+	t.distribute(ev)
+	t.forward(ev)
+
+	if acknowledge{
+		published := &PublishedMsg{Request: msg.Request, Publication: ev.Publication}
+		conn.sendMessage(published)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+func (t *Server) handleSubscribeV2(conn *Connection, msg SubscribeMsgV2){
+	match,ok := parseMatchPolicy(msg.Options["match"])
+	if !ok{
+		t.sendErrorV2(conn, V2_SUBSCRIBE, msg.Request, &RPCError{URI:V2_ERROR_INVALID_ARGUMENT, Description:"unknown match policy", Details:msg.Options["match"]})
+		return
+	}
+
+	id := t.subscribe(conn,msg.Topic,match)
+	if id == 0{
+		log.Error("postmaster: Connection tried to subscribe to incorrect uri: %s",msg.Topic)
+		t.sendErrorV2(conn, V2_SUBSCRIBE, msg.Request, &RPCError{URI:V2_ERROR_NOT_AUTHORIZED, Description:"not authorized to subscribe to topic"})
+		return
+	}
+
+	subscribed := &SubscribedMsg{Request: msg.Request, Subscription: id}
+	conn.sendMessage(subscribed)
+
+	//Retained events follow SUBSCRIBED unless the client opts out
+	if get,ok := msg.Options["get_retained"].(bool); !ok || get{
+		t.sendRetained(conn,id,msg.Topic,match)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+func (t *Server) handleUnsubscribeV2(conn *Connection, msg UnsubscribeMsgV2){
+	//Remove from subscriptions
+	if !t.subscriptions.RemoveByID(msg.Subscription,conn.id){
+		t.sendErrorV2(conn, V2_UNSUBSCRIBE, msg.Request, &RPCError{URI:V2_ERROR_NO_SUCH_SUBSCRIPTION, Description:"no such subscription"})
+		return
+	}
+
+	unsubscribed := &UnsubscribedMsg{Request: msg.Request}
+	conn.sendMessage(unsubscribed)
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+func (t *Server) handleCallV2(conn *Connection, msg CallMsgV2){
+	log.Trace("postmaster: handling v2 call message")
+
+	//Registered procedures need permission; unauth procedures are open to every session
+	canCall := conn.Permissions().canCall(msg.Procedure)
+	hook,ok := t.getHook(msg.Procedure, false)
+	denied := ok && !canCall
+	if !ok || denied{
+		hook,ok = t.getHook(msg.Procedure, true)
+	}
+
+	//Procedures registered by clients answer asynchronously
+	if !ok && !denied{
+		if reg,found := t.dealer.lookup(conn.realm, msg.Procedure); found{
+			if canCall{
+				t.invokeClient(conn, reg, "", msg.Request, msg.Arguments, msg.ArgumentsKw, t.invocationTimeout(msg.Options))
+				return
+			}
+			denied = true
+		}
+	}
+
+	if !ok && denied{
+		log.Warn("postmaster: RPC call not permitted for %s: %s", conn.Username(), msg.Procedure)
+		t.sendErrorV2(conn, V2_CALL, msg.Request, &RPCError{URI:V2_ERROR_NOT_AUTHORIZED, Description:"not authorized to call procedure", Details:msg.Procedure})
+		return
+	}else if !ok || hook == nil{
+		log.Warn("postmaster: RPC call not registered: %s", msg.Procedure)
+		t.sendErrorV2(conn, V2_CALL, msg.Request, &RPCError{URI:V2_ERROR_NO_SUCH_PROCEDURE, Description:"no such procedure", Details:msg.Procedure})
+		return
+	}
+
+	// Perform function
+	t.callHook(conn, hook, msg.Procedure, msg.Arguments, func(res interface{}, err *RPCError){
+		if err != nil{
+			t.sendErrorV2(conn, V2_CALL, msg.Request, err)
+			return
+		}
+
+		result := &ResultMsg{Request: msg.Request, Arguments: []interface{}{res}}
+		conn.sendMessage(result)
+	})
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Utility Functions
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Sends ERROR in response to a request; the description (and details if present) become the arguments
+func (t *Server) sendErrorV2(conn *Connection, typ MessageType, request WAMPID, err *RPCError){
+	args := []interface{}{err.Description}
+	if err.Details != nil{
+		args = append(args, err.Details)
+	}
+
+	errMsg := &ErrorMsg{
+		RequestType: typ,
+		Request: request,
+		Error: err.URI,
+		Arguments: args,
+	}
+	conn.sendMessage(errMsg)
+}
+
+//Sends ABORT directly on the socket (before a session exists)
+func sendAbort(ws *websocket.Conn, s Serializer, reason string, message string){
+	abort := &AbortMsg{
+		Details: map[string]interface{}{"message": message},
+		Reason: reason,
+	}
+	out,_ := serialize(s, abort)
+	writeFrame(ws, s, out)
+}
+
+//Converts a list of v2 session IDs from publish options to ConnectionIDs (nil if absent)
+func idList(v interface{})([]string){
+	arr,ok := v.([]interface{})
+	if !ok{
+		return nil
+	}
+
+	ids := make([]string, 0, len(arr))
+	for _,val := range arr{
+		if id,ok := toWAMPID(val); ok{
+			ids = append(ids, id.String())
+		}
+	}
+	return ids
+}
+
+//Subprotocol selected during the websocket handshake ("" if none)
+func negotiatedProtocol(ws *websocket.Conn)(string){
+	if protocols := ws.Config().Protocol; len(protocols) == 1{
+		return protocols[0]
+	}
+	return ""
+}
@@ -0,0 +1,57 @@
+package postmaster
+
+import(
+	"testing"
+)
+
+//The authid in HELLO never names a session; only AuthenticateRealm does
+func TestV2Identity(t *testing.T){
+	tests := []struct{
+		name string
+		authenticate func(realm string, details map[string]interface{})(*AuthResult,error)
+		username string //"" when the session isn't named
+		aborted bool
+	}{
+		{"claimed authid", nil, "", false},
+		{"verified", func(realm string, details map[string]interface{})(*AuthResult,error){
+			if details["ticket"] != "bob's ticket"{
+				return nil,ErrInvalidSignature
+			}
+			return &AuthResult{Username: "bob", Permissions: testPermissions()},nil
+		}, "bob", false},
+		{"rejected", func(realm string, details map[string]interface{})(*AuthResult,error){
+			return nil,ErrInvalidSignature
+		}, "", true},
+		{"no result", func(realm string, details map[string]interface{})(*AuthResult,error){
+			return nil,nil
+		}, "", true},
+	}
+	for _,test := range tests{
+		s := newTestServer()
+		s.AuthenticateRealm = test.authenticate
+		ts := startServer(s)
+
+		ws := dial(t, ts, WAMP_V2_JSON_PROTOCOL)
+		send(t, ws, V2_HELLO, "realm1", map[string]interface{}{"authid": "alice", "ticket": "bob's ticket"})
+		if msg := recv(t, ws); (msg[0] == float64(V2_ABORT)) != test.aborted{
+			t.Errorf("%s: got %v, aborted want %t", test.name, msg, test.aborted)
+		}
+
+		if !test.aborted{
+			waitFor(t, "session", func()(bool){
+				return len(s.allConnections()) == 1
+			})
+			if got := s.allConnections()[0].Username(); got != test.username{
+				t.Errorf("%s: username %q, want %q", test.name, got, test.username)
+			}
+		}
+		if n := len(s.UserSessions("alice")); n != 0{
+			t.Errorf("%s: claimed authid named %d sessions", test.name, n)
+		}
+		if n := len(s.UserSessions("")); n != 0{
+			t.Errorf("%s: %d unnamed sessions returned as a user", test.name, n)
+		}
+		ws.Close()
+		ts.Close()
+	}
+}
@@ -0,0 +1,143 @@
+package postmaster
+
+import(
+	"context"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Server Procedures
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Procedure handler that runs on its own goroutine. ctx is cancelled when the call times out or the
+//client disconnects; results returned after that are discarded.
+type ContextRPCHandler func(ctx context.Context, conn *Connection, uri string, args ...interface{})(interface{}, *RPCError)
+
+//Procedure registered with RegisterRPC/RegisterRPCContext (one of f/cf is set)
+type rpcHook struct{
+	f RPCHandler //Runs inline; later messages from the client wait for it
+	cf ContextRPCHandler //Runs concurrently
+	timeout time.Duration //cf only; 0 never times out
+}
+
+//Registers a context aware procedure for authenticated clients. Calls that haven't answered within
+//timeout (0 never times out) get a timeout error.
+func (t *Server) RegisterRPCContext(uri string, f ContextRPCHandler, timeout time.Duration) {
+	if f != nil {
+		t.hookLock.Lock()
+		t.rpcHooks[uri] = &rpcHook{cf: f, timeout: timeout}
+		t.hookLock.Unlock()
+	}
+}
+
+//Registers a context aware procedure available before authentication (see RegisterRPCContext)
+func (t *Server) RegisterUnauthRPCContext(uri string, f ContextRPCHandler, timeout time.Duration) {
+	if f != nil {
+		t.hookLock.Lock()
+		t.unauthRPCHooks[uri] = &rpcHook{cf: f, timeout: timeout}
+		t.hookLock.Unlock()
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Procedure Utility Functions
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Runs a server procedure and passes its outcome to reply. Context handlers run on their own
+//goroutine (at most Server.MaxCallsInFlight per connection; further calls wait for a slot).
+func (t *Server) callHook(conn *Connection, hook *rpcHook, uri string, args []interface{}, reply func(interface{}, *RPCError)){
+	h := hook.cf
+	if h == nil{
+		f := hook.f
+		h = func(ctx context.Context, conn *Connection, uri string, args ...interface{})(interface{}, *RPCError){
+			return f(conn, uri, args...)
+		}
+	}
+	h = t.wrapRPC(h)
+
+	if hook.cf == nil{
+		if !t.beginCall(){
+			reply(nil, shutdownError(conn))
+			return
+		}
+		res,err := t.runHandler(h, conn.ctx, conn, uri, args)
+		reply(res,err)
+		t.calls.Done()
+		return
+	}
+
+	//Wait for a slot
+	select{
+	case conn.inflight <- struct{}{}:
+	case <-conn.ctx.Done():
+		return //Client gone
+	}
+
+	if !t.beginCall(){
+		<-conn.inflight
+		reply(nil, shutdownError(conn))
+		return
+	}
+
+	ctx,cancel := conn.ctx,context.CancelFunc(func(){})
+	if hook.timeout > 0{
+		ctx,cancel = context.WithTimeout(conn.ctx, hook.timeout)
+	}
+
+	type result struct{
+		res interface{}
+		err *RPCError
+	}
+	done := make(chan result,1)
+
+	go func(){
+		defer func(){ <-conn.inflight }()
+
+		res,err := t.runHandler(h, ctx, conn, uri, args)
+		done <- result{res,err}
+	}()
+
+	//Answer with the result or the timeout, whichever comes first. The call counts for Shutdown
+	//until the answer is queued and the handler has returned.
+	go func(){
+		defer t.calls.Done()
+		defer cancel()
+
+		select{
+		case r := <-done:
+			reply(r.res, r.err)
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded{
+				log.Warn("postmaster: RPC call timed out after %s: %s", hook.timeout, uri)
+				reply(nil, timeoutError(conn))
+			}
+			//Cancelled: client disconnected, nothing to answer
+			<-done
+		}
+	}()
+}
+
+func shutdownError(conn *Connection)(*RPCError){
+	if conn.version == 2{
+		return &RPCError{URI:V2_ERROR_CANCELED, Description:"server shutting down"}
+	}
+	return &RPCError{URI:ERROR_SHUTTING_DOWN, Description:"server shutting down"}
+}
+
+func timeoutError(conn *Connection)(*RPCError){
+	if conn.version == 2{
+		return &RPCError{URI:V2_ERROR_TIMEOUT, Description:"call timed out"}
+	}
+	return &RPCError{URI:ERROR_TIMEOUT, Description:"call timed out"}
+}
+
+func runtimeError(conn *Connection, desc string)(*RPCError){
+	if conn.version == 2{
+		return &RPCError{URI:V2_ERROR_RUNTIME, Description:desc}
+	}
+	return &RPCError{URI:ERROR_RUNTIME, Description:desc}
+}
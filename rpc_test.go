@@ -0,0 +1,146 @@
+package postmaster
+
+import(
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+//Context handlers that outlast their timeout get a timeout error; their late results are dropped
+func TestRPCContextTimeout(t *testing.T){
+	tests := []struct{
+		name string
+		protocols []string
+	}{
+		{"v1", nil},
+		{"v2", []string{WAMP_V2_JSON_PROTOCOL}},
+	}
+	for _,test := range tests{
+		s := newTestServer()
+		cancelled := make(chan error,1)
+		s.RegisterRPCContext("add", func(ctx context.Context, conn *Connection, uri string, args ...interface{})(interface{}, *RPCError){
+			<-ctx.Done()
+			cancelled <- ctx.Err()
+			return 3,nil
+		}, 50*time.Millisecond)
+		ts := startServer(s)
+
+		ws := dial(t, ts, test.protocols...)
+		if test.protocols == nil{
+			login(t, ws, "alice")
+			send(t, ws, CALL, "1", "add", 1, 2)
+			if msg := recv(t, ws); msg[0] != float64(CALLERROR) || msg[2] != ERROR_TIMEOUT{
+				t.Errorf("%s: expected %s, got %v", test.name, ERROR_TIMEOUT, msg)
+			}
+		}else{
+			join(t, ws, nil)
+			send(t, ws, V2_CALL, 1, map[string]interface{}{}, "add", []interface{}{1, 2})
+			if msg := recv(t, ws); msg[0] != float64(V2_ERROR) || msg[4] != V2_ERROR_TIMEOUT{
+				t.Errorf("%s: expected %s, got %v", test.name, V2_ERROR_TIMEOUT, msg)
+			}
+		}
+
+		select{
+		case err := <-cancelled:
+			if err != context.DeadlineExceeded{
+				t.Errorf("%s: ctx error %v, want DeadlineExceeded", test.name, err)
+			}
+		case <-time.After(2*time.Second):
+			t.Errorf("%s: ctx not cancelled", test.name)
+		}
+		recvNothing(t, ws)
+
+		ws.Close()
+		ts.Close()
+	}
+}
+
+//A handler's ctx is cancelled when its client disconnects
+func TestRPCContextDisconnect(t *testing.T){
+	s := newTestServer()
+	started := make(chan bool,1)
+	cancelled := make(chan error,1)
+	s.RegisterRPCContext("add", func(ctx context.Context, conn *Connection, uri string, args ...interface{})(interface{}, *RPCError){
+		started <- true
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return nil,nil
+	}, 0)
+	ts := startServer(s)
+	defer ts.Close()
+
+	ws := dial(t, ts, WAMP_V2_JSON_PROTOCOL)
+	join(t, ws, nil)
+	send(t, ws, V2_CALL, 1, map[string]interface{}{}, "add", []interface{}{1, 2})
+	<-started
+	ws.Close()
+
+	select{
+	case err := <-cancelled:
+		if err != context.Canceled{
+			t.Errorf("ctx error %v, want Canceled", err)
+		}
+	case <-time.After(2*time.Second):
+		t.Error("ctx not cancelled on disconnect")
+	}
+}
+
+//At most MaxCallsInFlight handlers run at once per connection; the rest wait for a slot
+func TestMaxCallsInFlight(t *testing.T){
+	const calls = 5
+	s := newTestServer()
+	s.MaxCallsInFlight = 2
+
+	lock := new(sync.Mutex)
+	running,most := 0,0
+	release := make(chan bool)
+	s.RegisterRPCContext("add", func(ctx context.Context, conn *Connection, uri string, args ...interface{})(interface{}, *RPCError){
+		lock.Lock()
+		running++
+		if running > most{
+			most = running
+		}
+		lock.Unlock()
+
+		<-release
+
+		lock.Lock()
+		running--
+		lock.Unlock()
+		return 3,nil
+	}, 0)
+	ts := startServer(s)
+	defer ts.Close()
+
+	ws := dial(t, ts, WAMP_V2_JSON_PROTOCOL)
+	defer ws.Close()
+	join(t, ws, nil)
+	for i := 1; i <= calls; i++{
+		send(t, ws, V2_CALL, i, map[string]interface{}{}, "add", []interface{}{1, 2})
+	}
+
+	waitFor(t, "handlers", func()(bool){
+		lock.Lock()
+		defer lock.Unlock()
+		return running == s.MaxCallsInFlight
+	})
+	time.Sleep(100*time.Millisecond) //Give extra calls a chance to start
+	lock.Lock()
+	if running != s.MaxCallsInFlight{
+		t.Errorf("%d handlers running, want %d", running, s.MaxCallsInFlight)
+	}
+	lock.Unlock()
+
+	close(release)
+	for i := 0; i < calls; i++{
+		if msg := recv(t, ws); msg[0] != float64(V2_RESULT){
+			t.Errorf("expected result, got %v", msg)
+		}
+	}
+	lock.Lock()
+	if most > s.MaxCallsInFlight{
+		t.Errorf("%d handlers ran at once, limit %d", most, s.MaxCallsInFlight)
+	}
+	lock.Unlock()
+}
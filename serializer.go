@@ -0,0 +1,233 @@
+package postmaster
+
+import(
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"code.google.com/p/go.net/websocket"
+	"github.com/ugorji/go/codec"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Serialization
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Encodes WAMP messages for the wire; chosen per connection by websocket subprotocol
+type Serializer interface{
+	//Encodes a message given as its list of elements
+	Serialize(msg []interface{})([]byte,error)
+
+	//Decodes a message into its list of elements. Values must have the types encoding/json decodes to
+	//(numbers float64, dictionaries map[string]interface{}), except binary values which are []byte.
+	Deserialize(data []byte)([]interface{},error)
+
+	//Whether messages go in binary websocket frames
+	Binary()(bool)
+}
+
+//Serializers for WAMP v2 subprotocols (v1 is always JSON)
+var v2Serializers = map[string]Serializer{
+	WAMP_V2_JSON_PROTOCOL: JSONSerializer{},
+	WAMP_V2_MSGPACK_PROTOCOL: MsgpackSerializer{},
+}
+
+//Message that can be encoded by any Serializer
+type wampMessage interface{
+	toArray()([]interface{})
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+//WAMP v2 JSON in text frames. []byte values in lists & dictionaries are sent as a NUL character followed
+//by their base64 encoding, and such strings are decoded back to []byte (WAMP v2 binary conversion).
+type JSONSerializer struct{}
+
+func (s JSONSerializer) Serialize(msg []interface{})([]byte,error){
+	v,_ := encodeBinary(msg)
+	return json.Marshal(v)
+}
+
+func (s JSONSerializer) Deserialize(data []byte)([]interface{},error){
+	return decodeJSON(data,true)
+}
+
+func (s JSONSerializer) Binary()(bool){
+	return false
+}
+
+//WAMP v1 JSON in text frames. v1 has no binary convention: []byte is sent as encoding/json's plain
+//base64 string and strings are never decoded to []byte.
+type v1Serializer struct{}
+
+func (s v1Serializer) Serialize(msg []interface{})([]byte,error){
+	return json.Marshal(msg)
+}
+
+func (s v1Serializer) Deserialize(data []byte)([]interface{},error){
+	return decodeJSON(data,false)
+}
+
+func (s v1Serializer) Binary()(bool){
+	return false
+}
+
+//Replaces []byte values by binary strings, copying lists & dictionaries that contain them
+func encodeBinary(v interface{})(interface{},bool){
+	switch x := v.(type){
+	case []byte:
+		return "\x00" + base64.StdEncoding.EncodeToString(x),true
+	case []interface{}:
+		var cp []interface{}
+		for i,e := range x{
+			if enc,changed := encodeBinary(e); changed{
+				if cp == nil{
+					cp = append([]interface{}(nil),x...)
+				}
+				cp[i] = enc
+			}
+		}
+		if cp != nil{
+			return cp,true
+		}
+	case map[string]interface{}:
+		var cp map[string]interface{}
+		for k,e := range x{
+			if enc,changed := encodeBinary(e); changed{
+				if cp == nil{
+					cp = make(map[string]interface{},len(x))
+					for k2,e2 := range x{
+						cp[k2] = e2
+					}
+				}
+				cp[k] = enc
+			}
+		}
+		if cp != nil{
+			return cp,true
+		}
+	}
+	return v,false
+}
+
+//Binary value of a string received from a JSON client (the string itself if it isn't binary)
+func binaryString(s string)(interface{}){
+	if len(s) > 0 && s[0] == 0{
+		if b,err := base64.StdEncoding.DecodeString(s[1:]); err == nil{
+			return b
+		}
+	}
+	return s
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+var msgpackHandle = newMsgpackHandle()
+
+func newMsgpackHandle()(*codec.MsgpackHandle){
+	h := new(codec.MsgpackHandle)
+	h.WriteExt = true //str8 & bin (current spec); str decodes to string, bin to []byte
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	return h
+}
+
+//MessagePack in binary frames. Binary values are native; decoded numbers are converted to float64 so
+//handlers see the same types as from JSON clients.
+type MsgpackSerializer struct{}
+
+func (s MsgpackSerializer) Serialize(msg []interface{})([]byte,error){
+	var out []byte
+	err := codec.NewEncoderBytes(&out,msgpackHandle).Encode(msg)
+	return out,err
+}
+
+func (s MsgpackSerializer) Deserialize(data []byte)([]interface{},error){
+	var msg []interface{}
+	if err := codec.NewDecoderBytes(data,msgpackHandle).Decode(&msg); err != nil{
+		return nil,err
+	}
+	jsonNumbers(msg)
+	return msg,nil
+}
+
+func (s MsgpackSerializer) Binary()(bool){
+	return true
+}
+
+//Converts integers to float64 in place
+func jsonNumbers(v interface{})(interface{}){
+	switch x := v.(type){
+	case int64:
+		return float64(x)
+	case uint64:
+		return float64(x)
+	case float32:
+		return float64(x)
+	case []interface{}:
+		for i,e := range x{
+			x[i] = jsonNumbers(e)
+		}
+	case map[string]interface{}:
+		for k,e := range x{
+			x[k] = jsonNumbers(e)
+		}
+	}
+	return v
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Serialization Utility Functions
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Serializer for a negotiated subprotocol (v1 JSON for anything else)
+func serializerFor(protocol string)(Serializer){
+	if s,ok := v2Serializers[protocol]; ok{
+		return s
+	}
+	return v1Serializer{}
+}
+
+//Type of a decoded message (-1 if invalid)
+func messageType(data []interface{})(MessageType){
+	if len(data) == 0{
+		return -1
+	}
+	typ,ok := toWAMPID(data[0])
+	if !ok{
+		return -1
+	}
+	return MessageType(typ)
+}
+
+//Encodes msg for the wire
+func serialize(s Serializer, msg wampMessage)([]byte,error){
+	return s.Serialize(msg.toArray())
+}
+
+//Writes one frame straight to the socket (before the connection's sender runs)
+func writeFrame(ws *websocket.Conn, s Serializer, out []byte)(error){
+	if s.Binary(){
+		return websocket.Message.Send(ws, out)
+	}
+	return websocket.Message.Send(ws, string(out))
+}
+
+//Decodes a v1 JSON message to its elements (used by the v1 UnmarshalJSON methods)
+func unmarshalArray(jsonData []byte)([]interface{},error){
+	return v1Serializer{}.Deserialize(jsonData)
+}
+
+//Decodes a v2 JSON message to its elements, binary strings included (used by the v2 UnmarshalJSON methods)
+func unmarshalV2Array(jsonData []byte)([]interface{},error){
+	return JSONSerializer{}.Deserialize(jsonData)
+}
+
+//Encodes a v2 message as JSON, binary values included (used by the v2 MarshalJSON methods)
+func createV2Message(args ...interface{})([]byte,error){
+	return JSONSerializer{}.Serialize(args)
+}
@@ -0,0 +1,193 @@
+package postmaster
+
+import(
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+	"code.google.com/p/go.net/websocket"
+)
+
+//Websocket frame as recieved
+type frame struct{
+	data []byte
+	binary bool
+}
+
+var frameCodec = websocket.Codec{
+	Marshal: func(v interface{})([]byte,byte,error){
+		f := v.(frame)
+		if f.binary{
+			return f.data,websocket.BinaryFrame,nil
+		}
+		return f.data,websocket.TextFrame,nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v interface{})(error){
+		*v.(*frame) = frame{data: data, binary: payloadType == websocket.BinaryFrame}
+		return nil
+	},
+}
+
+//Sends a message encoded by s in the frame type s uses
+func sendWith(t *testing.T, ws *websocket.Conn, s Serializer, msg ...interface{}){
+	data,err := s.Serialize(msg)
+	if err != nil{
+		t.Fatal(err)
+	}
+	if err := frameCodec.Send(ws, frame{data, s.Binary()}); err != nil{
+		t.Fatal(err)
+	}
+}
+
+//Recieves a message encoded by s, failing unless it came in the frame type s uses
+func recvWith(t *testing.T, ws *websocket.Conn, s Serializer)([]interface{}){
+	ws.SetReadDeadline(time.Now().Add(2*time.Second))
+	var f frame
+	if err := frameCodec.Receive(ws, &f); err != nil{
+		t.Fatalf("recieve: %s", err)
+	}
+	if f.binary != s.Binary(){
+		t.Errorf("binary frame %t, want %t", f.binary, s.Binary())
+	}
+	msg,err := s.Deserialize(f.data)
+	if err != nil{
+		t.Fatalf("invalid message %q: %s", f.data, err)
+	}
+	return msg
+}
+
+func TestSerializerRoundTrip(t *testing.T){
+	msg := []interface{}{
+		float64(V2_EVENT), float64(1), map[string]interface{}{},
+		[]interface{}{[]byte("hi"), "text", 1.5, nil, true},
+		map[string]interface{}{"b": []byte{0, 255}, "nested": []interface{}{[]byte{}}},
+	}
+	v1 := []interface{}{
+		float64(V2_EVENT), float64(1), map[string]interface{}{},
+		[]interface{}{"aGk=", "text", 1.5, nil, true},
+		map[string]interface{}{"b": "AP8=", "nested": []interface{}{""}},
+	}
+
+	tests := []struct{
+		name string
+		s Serializer
+		want []interface{}
+	}{
+		{"json", JSONSerializer{}, msg},
+		{"msgpack", MsgpackSerializer{}, msg},
+		{"v1", v1Serializer{}, v1}, //Plain encoding/json base64, never decoded back
+	}
+	for _,test := range tests{
+		data,err := test.s.Serialize(msg)
+		if err != nil{
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		got,err := test.s.Deserialize(data)
+		if err != nil{
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want){
+			t.Errorf("%s: round trip %#v, want %#v", test.name, got, test.want)
+		}
+	}
+}
+
+//v1 frames are what encoding/json makes of a message; only v2 JSON uses binary strings
+func TestJSONBinaryConvention(t *testing.T){
+	msg := []interface{}{EVENT, "topic", []byte("hi")}
+	tests := []struct{
+		s Serializer
+		out string
+	}{
+		{v1Serializer{}, `[8,"topic","aGk="]`},
+		{JSONSerializer{}, `[8,"topic","\u0000aGk="]`},
+	}
+	for _,test := range tests{
+		if out,err := test.s.Serialize(msg); err != nil || string(out) != test.out{
+			t.Errorf("%T: %s %v, want %s", test.s, out, err, test.out)
+		}
+	}
+
+	//Message methods encode v1 messages the same way
+	if out,_ := (&EventMsg{TopicURI: "topic", Event: []byte("hi")}).MarshalJSON(); string(out) != `[8,"topic","aGk="]`{
+		t.Errorf("v1 EventMsg: %s", out)
+	}
+
+	//A v1 string that looks binary stays a string
+	in := []byte(`[7,"topic","\u0000aGk="]`)
+	if msg,_ := (v1Serializer{}).Deserialize(in); msg[2] != "\x00aGk="{
+		t.Errorf("v1 decoded %#v, want the string", msg[2])
+	}
+	if msg,_ := (JSONSerializer{}).Deserialize(in); !reflect.DeepEqual(msg[2], []byte("hi")){
+		t.Errorf("v2 decoded %#v, want []byte", msg[2])
+	}
+}
+
+//Binary payloads reach each client in its own encoding: base64 for v1, a binary string in v2 JSON
+//text frames and native bin in MessagePack binary frames
+func TestBinaryPayloads(t *testing.T){
+	s := newTestServer()
+	s.RegisterRPC("add", func(conn *Connection, uri string, args ...interface{})(interface{}, *RPCError){
+		return []interface{}{fmt.Sprintf("%T", args[0]), args[0]},nil
+	})
+	ts := startServer(s)
+	defer ts.Close()
+
+	v1 := dial(t, ts)
+	defer v1.Close()
+	login(t, v1, "alice")
+	send(t, v1, SUBSCRIBE, "topic")
+
+	tests := []struct{
+		name string
+		protocol string
+		s Serializer
+	}{
+		{"json", WAMP_V2_JSON_PROTOCOL, JSONSerializer{}},
+		{"msgpack", WAMP_V2_MSGPACK_PROTOCOL, MsgpackSerializer{}},
+	}
+	conns := make([]*websocket.Conn,len(tests))
+	for i,test := range tests{
+		ws := dial(t, ts, test.protocol)
+		defer ws.Close()
+		sendWith(t, ws, test.s, V2_HELLO, "realm1", map[string]interface{}{})
+		if msg := recvWith(t, ws, test.s); msg[0] != float64(V2_WELCOME){
+			t.Fatalf("%s: expected WELCOME, got %v", test.name, msg)
+		}
+		sendWith(t, ws, test.s, V2_SUBSCRIBE, 1, map[string]interface{}{}, "topic")
+		if msg := recvWith(t, ws, test.s); msg[0] != float64(V2_SUBSCRIBED){
+			t.Fatalf("%s: subscribe failed: %v", test.name, msg)
+		}
+		conns[i] = ws
+	}
+	send(t, v1, CALL, "sync", "nope") //Answered once the subscribe is handled
+	recv(t, v1)
+
+	//Events
+	s.PublishEvent("topic", []byte("hi"))
+	if ev := recv(t, v1); ev[0] != float64(EVENT) || ev[2] != "aGk="{
+		t.Errorf("v1: event %v, want base64", ev)
+	}
+	for i,test := range tests{
+		ev := recvWith(t, conns[i], test.s)
+		if ev[0] != float64(V2_EVENT) || len(ev) < 5 || !reflect.DeepEqual(ev[4], []interface{}{[]byte("hi")}){
+			t.Errorf("%s: event %v, want binary", test.name, ev)
+		}
+	}
+
+	//Call arguments & results
+	send(t, v1, CALL, "1", "add", "\x00aGk=")
+	if res := recv(t, v1); res[0] != float64(CALLRESULT) || !reflect.DeepEqual(res[2], []interface{}{"string", "\x00aGk="}){
+		t.Errorf("v1: result %v, want the string untouched", res)
+	}
+	for i,test := range tests{
+		sendWith(t, conns[i], test.s, V2_CALL, 2, map[string]interface{}{}, "add", []interface{}{[]byte("hi")})
+		res := recvWith(t, conns[i], test.s)
+		want := []interface{}{[]interface{}{"[]uint8", []byte("hi")}}
+		if res[0] != float64(V2_RESULT) || len(res) < 4 || !reflect.DeepEqual(res[3], want){
+			t.Errorf("%s: result %v, want %v", test.name, res, want)
+		}
+	}
+}
@@ -4,8 +4,9 @@ import(
 	"code.google.com/p/go.net/websocket"
 	"github.com/nu7hatch/gouuid"
 	"errors"
-	"encoding/json"
 	"io"
+	"sync"
+	"time"
 )
 
 ///////////////////////////////////////////////////////////////////////////////////////
@@ -16,42 +17,143 @@ import(
 
 //Represents data storage per instance 
 type Server struct{
-	localID string //TODO : Don't use this
+	localID string //Node ID; identifies this instance to the broker
+	broker Broker //Passes events to other instances (nil when running alone)
 	
 	//Data storage
-	connections map[ConnectionID] *Connection // Channel to send on connection TODO Make safe for concurrent access (RWMutex)
+	connections map[ConnectionID] *Connection // Channel to send on connection
+	connLock *sync.RWMutex //Guards connections
 	subscriptions *subscriptionMap // Maps subscription URI to connectionID
-	rpcHooks map[string] RPCHandler
-	unauthRPCHooks map[string] RPCHandler
+	rpcHooks map[string] *rpcHook
+	unauthRPCHooks map[string] *rpcHook
+	hookLock *sync.RWMutex //Guards rpcHooks & unauthRPCHooks
+	middleware []Middleware //Added by Use
+	rpcMiddleware []RPCMiddleware //Added by UseRPC
+	inbound MessageHandler //middleware wrapped around dispatch (nil without middleware)
+	middlewareLock *sync.RWMutex //Guards middleware, rpcMiddleware & inbound
+	dealer *dealer //Procedures registered by clients
+	authenticators map[string] Authenticator //Maps auth method to Authenticator
+	authLock *sync.RWMutex //Guards authenticators
+	sessions *sync.WaitGroup //Running websocket handlers
+	calls *sync.WaitGroup //Running RPC handlers & unanswered invocations of client procedures
+	closing bool //Set by Shutdown
+	shutdownLock *sync.Mutex //Guards closing & Adds to sessions/calls
+	retainedTopics map[string]bool //Topics whose events are retained (see RetainTopic)
+	retainLock *sync.RWMutex //Guards retainedTopics
 	
 	//
-	//Challenge Response Authentication Callbacks
+	//Challenge Response Authentication Callbacks (used by the default wampcra Authenticator)
 	//
 	
-	//Get the authentication secret for an authentication key, i.e. the user password for the user name. Return "" when the authentication key does not exist.
-	GetAuthSecret	func(authKey string)(string,error) // Required
+	//Get the authentication secret for an authentication key, i.e. the user password for the user name. Return an error when the authentication key does not exist.
+	//Set CRASecret.Salt to have the client sign with a PBKDF2 derived key.
+	GetAuthSecret	func(authKey string)(CRASecret,error) // Required for wampcra unless an Authenticator is registered
 	
     //Get the permissions the session is granted when the authentication succeeds for the given key / extra information.
-	GetAuthPermissions func(authKey string,authExtra map[string]interface{})(Permissions,error) // Required
+	GetAuthPermissions func(authKey string,authExtra map[string]interface{})(Permissions,error) // Required for wampcra unless an Authenticator is registered
 	
-	//Fired when client authentication was successful.
+	//Fired when client authentication was successful, with the name the session authenticated as (see Connection.Username).
 	OnAuthenticated func(authKey string,authExtra map[string]interface{}, permission Permissions) // Optional
 
 	//Message interept
 	MessageToPublish PublishIntercept // Optional
 	
-	//Fired when authenticated client disconnections
+	//Fired when authenticated client disconnections, with the same name OnAuthenticated was given
 	OnDisconnect func(authKey string,authExtra map[string]interface{}) //Optional
+	
+	//
+	//WAMP v2
+	//
+	
+	//Get the permissions for a v2 session joining a realm (details from HELLO). Return ErrNoSuchRealm to reject an unknown realm.
+	GetRealmPermissions func(realm string, details map[string]interface{})(Permissions,error) // Required for v2 clients (unless AuthenticateRealm is set)
+	
+	//Verify a v2 session joining a realm (e.g. a token in details) and name it. Used instead of GetRealmPermissions when set.
+	//Without it v2 sessions have no username: the authid in HELLO is chosen by the client and never trusted.
+	AuthenticateRealm func(realm string, details map[string]interface{})(*AuthResult,error) // Optional
+	
+	//Realm v1 sessions belong to; v2 sessions joining this realm share topics with v1 sessions
+	V1Realm string // Optional
+	
+	//
+	//Retained events
+	//
+	
+	//Last event of retained topics, sent to sessions as they subscribe; nil disables retention (see NewMemoryRetainStore)
+	RetainStore RetainStore // Optional
+	
+	//
+	//Outbound queue (read when a connection is registered)
+	//
+	
+	Backlog int //Messages buffered per connection (default ALLOWED_BACKLOG)
+	SlowConsumer SlowConsumerPolicy //Applied when a connection's buffer is full (default BLOCK_WITH_TIMEOUT)
+	SendTimeout time.Duration //BLOCK_WITH_TIMEOUT: how long to wait for room (default SEND_TIMEOUT; negative waits forever)
+	MaxDrops int //DISCONNECT_AFTER_DROPS: drops tolerated before the connection is closed
+	
+	//
+	//Authentication limits
+	//
+	
+	AuthTimeout time.Duration //Unauthenticated v1 connections are closed after this long (0 never closes)
+	MaxAuthAttempts int //Failed authreq/auth calls before the connection is closed (0 is unlimited)
+	
+	//
+	//RPC
+	//
+	
+	MaxCallsInFlight int //Context handlers (RegisterRPCContext) running at once per connection (default MAX_CALLS_IN_FLIGHT)
+	InvocationTimeout time.Duration //Calls to client procedures fail with wamp.error.canceled after this long (default INVOCATION_TIMEOUT; negative never times out)
+	
+	//
+	//Panics
+	//
+	
+	PanicPolicy PanicPolicy //Whether a connection is kept after a panic handling its message (default PANIC_KEEP_CONNECTION)
+	
+	//Fired when a panic handling a message or procedure is recovered; uri is "" if the message wasn't decoded yet
+	OnPanic func(conn *Connection, uri string, recovered interface{}, stack []byte) // Optional
+	
+	//Failures per auth key & client address; nil disables lockout (see NewMemoryLockoutStore)
+	LockoutStore LockoutStore // Optional
+	LockoutThreshold int //Failures allowed before backoff starts (default LOCKOUT_THRESHOLD)
+	LockoutAddressThreshold int //Failures allowed per client address, e.g. higher behind a proxy or NAT (default LockoutThreshold; negative doesn't track addresses)
+	LockoutBackoff time.Duration //First lockout; doubles with each further failure (default LOCKOUT_BACKOFF)
+	LockoutMax time.Duration //Longest lockout (default LOCKOUT_MAX)
+	
+	//Fired when a subject ("authkey:<key>" or "addr:<host>") is locked out until the given time
+	OnLockout func(subject string, failures int, until time.Time) // Optional
+	
+	//
+	//Shutdown
+	//
+	
+	ShutdownTopic string //If set, Shutdown publishes ShutdownEvent on this topic before closing sessions
+	ShutdownEvent interface{}
 
 }
 
 func NewServer()*Server{
+	nodeID,_ := uuid.NewV4()
+	calls := new(sync.WaitGroup)
+	
 	return &Server{
-		localID: "server", // TODO: Make this something more useful
+		localID: "postmaster-" + nodeID.String(),
 		connections: make(map[ConnectionID]*Connection),
+		connLock: new(sync.RWMutex),
 		subscriptions: newSubscriptionMap(),
-		rpcHooks: make(map[string]RPCHandler),
-		unauthRPCHooks: make(map[string]RPCHandler),
+		rpcHooks: make(map[string]*rpcHook),
+		unauthRPCHooks: make(map[string]*rpcHook),
+		hookLock: new(sync.RWMutex),
+		middlewareLock: new(sync.RWMutex),
+		dealer: newDealer(calls),
+		authenticators: make(map[string]Authenticator),
+		authLock: new(sync.RWMutex),
+		sessions: new(sync.WaitGroup),
+		calls: calls,
+		shutdownLock: new(sync.Mutex),
+		retainedTopics: make(map[string]bool),
+		retainLock: new(sync.RWMutex),
 				
 		//Callbacks all nil (Note some are required)
 	}
@@ -64,35 +166,88 @@ func NewServer()*Server{
 func (t *Server) HandleWebsocket(conn *websocket.Conn) {
 	defer conn.Close() //Close connection at end of this function
 	
+	protocol := negotiatedProtocol(conn)
+	_,isV2 := v2Serializers[protocol]
+	
+	//No new sessions once shutting down
+	if !t.beginSession(){
+		if isV2{
+			sendAbort(conn, serializerFor(protocol), V2_CLOSE_SYSTEM_SHUTDOWN, "server shutting down")
+		}
+		return
+	}
+	defer t.sessions.Done()
+	
+	//WAMP v2 clients negotiate a subprotocol (see Handshake)
+	if isV2{
+		t.handleWebsocketV2(conn)
+		return
+	}
+	
 	//Register Connection
 	c,err := t.registerConnection(conn)
 	if err != nil{
 		log.Error("postmaster: error registering connection: %s", err)
 		return
 	}
+	
+	//Shutdown started while registering; it may have missed this connection
+	if t.shuttingDown(){
+		t.closeForShutdown(c)
+	}
+		
+	//Setup goroutine to send all message on chan (exits once connection is unregistered)
+	go t.sendOnConn(c,conn)
 		
-	//Setup goroutine to send all message on chan
-	go func() {
-		for msg := range c.out {
-			log.Trace("postmaster: sending message: %s", msg)
-			err := websocket.Message.Send(conn, msg)
+	//Setup message recieving (Blocking for life of connection)
+	t.recieveOnConn(c,conn)
+	
+	t.disconnect(c)
+}
+
+//Sends queued messages until the connection is unregistered
+func (t *Server) sendOnConn(c *Connection, ws *websocket.Conn){
+	for {
+		select{
+		case msg := <-c.out:
+			log.Trace("postmaster: sending message: %q", msg)
+			err := writeFrame(ws, c.serializer, msg)
 			if err != nil {
 				log.Error("postmaster: error sending message: %s", err)
 			}
+		case <-c.closing:
+			//Flush queue, then close socket (reciever then unregisters the connection)
+			for {
+				select{
+				case msg := <-c.out:
+					if err := writeFrame(ws, c.serializer, msg); err != nil {
+						log.Error("postmaster: error sending message: %s", err)
+					}
+				default:
+					c.close()
+					return
+				}
+			}
+		case <-c.done:
+			return
 		}
-	}()	
-		
-	//Setup message recieving (Blocking for life of connection)
-	t.recieveOnConn(c,conn)
+	}
+}
+
+//Signals disconnection and unregisters connection
+func (t *Server) disconnect(c *Connection){
+	c.stopAuthTimer()
+	c.cancel() //Running RPC handlers can stop
 	
 	//Call disconnection method
-	//FIXME Figure out why pendingAuth is nil sometimes
-	if t.OnDisconnect != nil && c.pendingAuth != nil{		
-		t.OnDisconnect(c.pendingAuth.authKey,c.pendingAuth.authExtra)
+	if username,authExtra,ok := c.identity(); ok && t.OnDisconnect != nil{
+		t.OnDisconnect(username,authExtra)
 	}
 	
 	//Unregister connection
-	delete(t.connections,c.id)
+	t.removeConnection(c.id)
+	t.subscriptions.RemoveConnection(c.id)
+	t.releaseProcedures(c)
 }
 
 //Returns registered id or error
@@ -121,23 +276,35 @@ func (t *Server) registerConnection(conn *websocket.Conn)(*Connection,error){
 	}
 	
 	//Create Connection
-	sendChan := make(chan string, ALLOWED_BACKLOG) //Channel to send to connection
+	newConn := newConnection(t, cid, conn) //Un authed user
+	newConn.realm = t.V1Realm
+	newConn.remoteAddr = remoteHost(conn)
 	
 	//Register channel with server	
-	newConn := &Connection{out:sendChan,id:cid,pendingAuth:nil,isAuth:false,Username:"",P:nil} //Un authed user
-	t.connections[cid] = newConn
+	t.addConnection(newConn)
+	t.startAuthTimer(newConn)
 	
 	log.Info("client connected: %s", cid)
 	
 	return  newConn,nil //Sucessfully registered
 }
 
+//Traces a recieved frame. Frames from unauthenticated sessions may hold credentials (auth signature,
+//ticket or token), so only their size is logged.
+func traceInbound(conn *Connection, rec []byte){
+	if conn.authenticated(){
+		log.Trace("postmaster: message received: %q", rec)
+		return
+	}
+	log.Trace("postmaster: message received: %d bytes (unauthenticated)", len(rec))
+}
+
 //Recieves on channel for life of connection
 func (t *Server) recieveOnConn(conn *Connection, ws *websocket.Conn){	
 	Connection_Loop:
 	for {
-		//Recieve message
-		var rec string
+		//Recieve message (text frames are kept as bytes too)
+		var rec []byte
 		err := websocket.Message.Receive(ws, &rec)
 		if err != nil {
 			//Don't error on normal socket close
@@ -147,56 +314,77 @@ func (t *Server) recieveOnConn(conn *Connection, ws *websocket.Conn){
 			}
 			break Connection_Loop
 		}
-		log.Trace("postmaster: message received: %s", rec)
+		traceInbound(conn, rec)
 		
-		//Process message
-		data := []byte(rec)
+		t.handleMessage(conn, rec)
+	}
+}
+
+//Decodes & handles one message. A panic is recovered and reported (see Server.PanicPolicy).
+func (t *Server) handleMessage(conn *Connection, rec []byte){
+	defer t.recoverMessage(conn)
 
-		switch typ := parseType(rec); typ {
-		case CALL:
-			var msg CallMsg
-			err := json.Unmarshal(data, &msg)
+	data,err := conn.serializer.Deserialize(rec)
+	if err != nil{
+		log.Error("postmaster: invalid message format, message dropped: %q", rec)
+		return
+	}
+
+	switch typ := messageType(data); typ {
+	case PREFIX:
+		var msg PrefixMsg
+		err := msg.fromArray(data)
+		if err != nil {
+			log.Error("postmaster: error unmarshalling prefix message: %s", err)
+			return
+		}
+		t.handlePrefix(conn, msg)
+	case CALL:
+		var msg CallMsg
+		err := msg.fromArray(data)
+		if err != nil {
+			log.Error("postmaster: error unmarshalling call message: %s", err)
+			return
+		}
+		msg.ProcURI = conn.expandURI(msg.ProcURI)
+		t.handleInbound(conn, &msg)
+	case SUBSCRIBE:
+		if conn.authenticated(){
+			var msg SubscribeMsg
+			err := msg.fromArray(data)
 			if err != nil {
-				log.Error("postmaster: error unmarshalling call message: %s", err)
-				continue Connection_Loop
-			}
-			t.handleCall(conn, msg)
-		case SUBSCRIBE:
-			if conn.isAuth{
-				var msg SubscribeMsg
-				err := json.Unmarshal(data, &msg)
-				if err != nil {
-					log.Error("postmaster: error unmarshalling subscribe message: %s", err)
-					continue Connection_Loop
-				}
-				t.handleSubscribe(conn, msg)
+				log.Error("postmaster: error unmarshalling subscribe message: %s", err)
+				return
 			}
-		case UNSUBSCRIBE:
-			if conn.isAuth{
-				var msg UnsubscribeMsg
-				err := json.Unmarshal(data, &msg)
-				if err != nil {
-					log.Error("postmaster: error unmarshalling unsubscribe message: %s", err)
-					continue Connection_Loop
-				}
-				t.handleUnsubscribe(conn, msg)
+			msg.TopicURI = conn.expandURI(msg.TopicURI)
+			t.handleInbound(conn, &msg)
+		}
+	case UNSUBSCRIBE:
+		if conn.authenticated(){
+			var msg UnsubscribeMsg
+			err := msg.fromArray(data)
+			if err != nil {
+				log.Error("postmaster: error unmarshalling unsubscribe message: %s", err)
+				return
 			}
-		case PUBLISH:
-			if conn.isAuth{
-				var msg PublishMsg
-				err := json.Unmarshal(data, &msg)
-				if err != nil {
-					log.Error("postmaster: error unmarshalling publish message: %s", err)
-					continue Connection_Loop
-				}
-				t.handlePublish(conn, msg)
+			msg.TopicURI = conn.expandURI(msg.TopicURI)
+			t.handleInbound(conn, &msg)
+		}
+	case PUBLISH:
+		if conn.authenticated(){
+			var msg PublishMsg
+			err := msg.fromArray(data)
+			if err != nil {
+				log.Error("postmaster: error unmarshalling publish message: %s", err)
+				return
 			}
-		case WELCOME, CALLRESULT, CALLERROR, EVENT, PREFIX:
-			log.Error("postmaster: server -> client message received, ignored: %d", typ)
-		default:
-			log.Error("postmaster: invalid message format, message dropped: %s", data)
+			msg.TopicURI = conn.expandURI(msg.TopicURI)
+			t.handleInbound(conn, &msg)
 		}
-		
+	case WELCOME, CALLRESULT, CALLERROR, EVENT:
+		log.Error("postmaster: server -> client message received, ignored: %d", typ)
+	default:
+		log.Error("postmaster: invalid message format, message dropped: %v", data)
 	}
 }
 
@@ -206,22 +394,24 @@ func (t *Server) recieveOnConn(conn *Connection, ws *websocket.Conn){
 //
 ///////////////////////////////////////////////////////////////////////////////////////
 
+func (t *Server) handlePrefix(conn *Connection, msg PrefixMsg){
+	log.Trace("postmaster: handling prefix message")
+	
+	conn.prefixes[msg.Prefix] = msg.URI //Later PREFIX for same prefix replaces earlier one
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
 func (t *Server) handlePublish(conn *Connection, msg PublishMsg){
 	log.Trace("postmaster: handling publish message")
 	
 	
 	//Make sure this connection can publish on this uri
-	if r := conn.P.PubSub[msg.TopicURI];r.CanPublish == false{
+	if !conn.Permissions().canPublish(msg.TopicURI){
 		log.Error("postmaster: Connection tried to publish to incorrect uri: ",msg.TopicURI)
 		return
 	}
-		
-	subscribers,_ := t.subscriptions.Find(msg.TopicURI) //Doesn't matter if no one listening on this instance; possibly on other instances
-	
-	event := &EventMsg{
-		TopicURI: msg.TopicURI,
-		Event: msg.Event,
-	}
 	
 	//Give server option to intercept and/or kill event
 	if t.MessageToPublish != nil && !t.MessageToPublish(conn,msg){
@@ -229,24 +419,20 @@ func (t *Server) handlePublish(conn *Connection, msg PublishMsg){
 		return
 	}
 	
-	//Format json and distribute
-	if jsonEvent, err := event.MarshalJSON(); err == nil{
-		//TODO Pass to other instances
-		
-		//Loop over all connections for subscription
-		for _,connID := range subscribers{
-			//Look up connection for this ID
-			if subConn,ok := t.connections[connID]; ok && !(connID == conn.id && msg.ExcludeMe){
-				subConn.out <- string(jsonEvent)
-			}else if !ok{
-				//Remove subscription of dropped connection
-				t.subscriptions.Remove(msg.TopicURI,connID)
-			}
-		}
-	}else{
-		log.Error("postmaster: error creating event message: %s", err)
-		return
+	ev := &BrokerEvent{
+		Origin: t.localID,
+		Realm: conn.realm,
+		TopicURI: msg.TopicURI,
+		Event: msg.Event,
+		ExcludeList: msg.ExcludeList,
+		EligibleList: msg.EligibleList,
+	}
+	if msg.ExcludeMe{
+		ev.ExcludeList = append([]string{string(conn.id)},msg.ExcludeList...)
 	}
+	
+	t.distribute(ev)
+	t.forward(ev)
 }
 
 ///////////////////////////////////////////////////////////////////////////////////////
@@ -255,82 +441,78 @@ func (t *Server) handlePublish(conn *Connection, msg PublishMsg){
 func (t *Server) handleCall(conn *Connection, msg CallMsg){
 	log.Trace("postmaster: handling call message")
 	
-	hookMap := t.rpcHooks
+	isAuth := conn.authenticated()
 	
 	//Make sure this is appropriate call (only authreq/auth when isAuth==false)
-	if !conn.isAuth {
+	if !isAuth {
 		switch msg.ProcURI{
 		case WAMP_PROCEDURE_URL+"authreq":
-			//Get args
-			authKey := msg.CallArgs[0].(string)
+			//Get args (no auth key for anonymous auth)
+			var authKey string
 			var authExtra map[string]interface{}
-			var ok bool
-			if len(msg.CallArgs)>1 && msg.CallArgs[1] != nil{
-				authExtra,ok = msg.CallArgs[1].(map[string]interface{})
-				if !ok{
-					authExtra = nil
-				}
-			}else{
-				authExtra = nil
+			if len(msg.CallArgs)>0{
+				authKey,_ = msg.CallArgs[0].(string)
+			}
+			if len(msg.CallArgs)>1{
+				authExtra,_ = msg.CallArgs[1].(map[string]interface{})
 			}
 			
 			res,err := authRequest(t,conn,authKey,authExtra)
-			if err == nil{
-				callResult := &CallResultMsg{
-					CallID: msg.CallID,
-					Result: res,
-				}
-				out,_ := callResult.MarshalJSON()
-				if returnConn, ok := t.connections[conn.id]; ok {
-					returnConn.out <- string(out)
-				}
-			}
+			t.sendAuthResult(conn,msg.CallID,res,err)
 			return
 		case WAMP_PROCEDURE_URL+"auth":
-			res,err := auth(t,conn,msg.CallArgs[0].(string))
-			if err == nil{
-				callResult := &CallResultMsg{
-					CallID: msg.CallID,
-					Result: res,
-				}
-				out,_ := callResult.MarshalJSON()
-				if returnConn, ok := t.connections[conn.id]; ok {
-					returnConn.out <- string(out)
-				}
+			var signature string
+			if len(msg.CallArgs)>0{
+				signature,_ = msg.CallArgs[0].(string)
 			}
-			return
-		default:
-			hookMap = t.unauthRPCHooks //Use unauthRPC hooks
 			
+			res,err := auth(t,conn,signature)
+			t.sendAuthResult(conn,msg.CallID,res,err)
+			return
 		}
 	}
 
 	var out []byte
 
-	//Check if function exists
-	if f, ok := hookMap[msg.ProcURI]; ok && f != nil {
-		
-		// Perform function
-		res, err := f(conn, msg.ProcURI, msg.CallArgs...)
-	
-		if err == nil{
-			//Formulate response
-			callResult := &CallResultMsg{
-				CallID: msg.CallID,
-				Result: res,
-			}
-			out,_ = callResult.MarshalJSON()
-			
-		} else {
-			//Handle error
-			callError := &CallErrorMsg{
-				CallID: msg.CallID,
-				ErrorURI: err.URI,
-				ErrorDesc: err.Description,
-				ErrorDetails: err.Details,
-			}
-			out,_ = callError.MarshalJSON()
+	//Check permission (authenticated calls only) and that function exists
+	if isAuth && !conn.Permissions().canCall(msg.ProcURI){
+		log.Warn("postmaster: RPC call not permitted for %s: %s", conn.Username(), msg.ProcURI)
+		callError := &CallErrorMsg{
+			CallID: msg.CallID,
+			ErrorURI: ERROR_NOT_AUTHORIZED,
+			ErrorDesc: "not authorized to call procedure",
+			ErrorDetails: msg.ProcURI,
 		}
+		out,_ = callError.MarshalJSON()
+	} else if hook, ok := t.getHook(msg.ProcURI, !isAuth); ok && hook != nil {
+		callID := msg.CallID
+		t.callHook(conn, hook, msg.ProcURI, msg.CallArgs, func(res interface{}, err *RPCError){
+			var out []byte
+			if err == nil{
+				//Formulate response
+				callResult := &CallResultMsg{
+					CallID: callID,
+					Result: res,
+				}
+				out,_ = callResult.MarshalJSON()
+				
+			} else {
+				//Handle error
+				callError := &CallErrorMsg{
+					CallID: callID,
+					ErrorURI: err.URI,
+					ErrorDesc: err.Description,
+					ErrorDetails: err.Details,
+				}
+				out,_ = callError.MarshalJSON()
+			}
+			conn.send(out)
+		})
+		return
+	} else if reg, ok := t.dealer.lookup(conn.realm, msg.ProcURI); ok && isAuth {
+		//Procedure registered by a client; it answers asynchronously
+		t.invokeClient(conn, reg, msg.CallID, 0, msg.CallArgs, nil, t.invocationTimeout(nil))
+		return
 	} else {
 		log.Warn("postmaster: RPC call not registered: %s", msg.ProcURI)
 		callError := &CallErrorMsg{
@@ -342,8 +524,32 @@ func (t *Server) handleCall(conn *Connection, msg CallMsg){
 		out,_ = callError.MarshalJSON()		
 	}
 
-	if returnConn, ok := t.connections[conn.id]; ok {
-		returnConn.out <- string(out)
+	conn.send(out)
+}
+
+//Answers authreq/auth calls
+func (t *Server) sendAuthResult(conn *Connection, callID string, res interface{}, err error){
+	var out []byte
+	if err != nil{
+		log.Warn("postmaster: authentication failed for %s: %s", conn.id, err)
+		callError := &CallErrorMsg{
+			CallID: callID,
+			ErrorURI: ERROR_NOT_AUTHORIZED,
+			ErrorDesc: err.Error(),
+		}
+		out,_ = callError.MarshalJSON()
+	}else{
+		callResult := &CallResultMsg{
+			CallID: callID,
+			Result: res,
+		}
+		out,_ = callResult.MarshalJSON()
+	}
+	conn.send(out)
+	
+	if conn.AuthState() == AUTH_STATE_FAILED{
+		log.Warn("postmaster: closing connection %s: too many authentication attempts", conn.id)
+		conn.closeAfterFlush()
 	}
 }
 
@@ -351,20 +557,32 @@ func (t *Server) handleCall(conn *Connection, msg CallMsg){
 ///////////////////////////////////////////////////////////////////////////////////////
 
 func (t *Server) handleSubscribe(conn *Connection, msg SubscribeMsg){
-	//Make sure this connection can publish on this uri
-	if r := conn.P.PubSub[msg.TopicURI];r.CanSubscribe == false{
+	if t.subscribe(conn,msg.TopicURI,msg.Match) == 0{
 		log.Error("postmaster: Connection tried to subscrive to incorrect uri")
 		return
 	}
 	
-	t.subscriptions.Add(msg.TopicURI,conn.id) //Add to subscriptions
+	t.sendRetained(conn,0,msg.TopicURI,msg.Match)
+}
+
+//Adds a subscription if the connection's permissions allow it; returns its ID (0 if refused).
+//Checked and added under grantLock so permissions replaced meanwhile can't miss it.
+func (t *Server) subscribe(conn *Connection, topic string, match MatchPolicy)(WAMPID){
+	conn.grantLock.Lock()
+	defer conn.grantLock.Unlock()
+	
+	//Make sure this connection can subscribe on this uri
+	if !conn.Permissions().canSubscribe(topic,match){
+		return 0
+	}
+	return t.subscriptions.Add(conn.realm,topic,match,conn.id) //Add to subscriptions
 }
 
 ///////////////////////////////////////////////////////////////////////////////////////
 ///////////////////////////////////////////////////////////////////////////////////////
 
 func (t *Server) handleUnsubscribe(conn *Connection, msg UnsubscribeMsg){
-	t.subscriptions.Remove(msg.TopicURI,conn.id) //Remove from subscriptions
+	t.subscriptions.Remove(conn.realm,msg.TopicURI,msg.Match,conn.id) //Remove from subscriptions
 }
 
 ///////////////////////////////////////////////////////////////////////////////////////
@@ -375,49 +593,339 @@ func (t *Server) handleUnsubscribe(conn *Connection, msg UnsubscribeMsg){
 
 func (t *Server) RegisterRPC(uri string, f RPCHandler) {
 	if f != nil {
-		t.rpcHooks[uri] = f
+		t.hookLock.Lock()
+		t.rpcHooks[uri] = &rpcHook{f: f}
+		t.hookLock.Unlock()
 	}
 }
 
 func (t *Server) UnregisterRPC(uri string) {
+	t.hookLock.Lock()
 	delete(t.rpcHooks, uri)
+	t.hookLock.Unlock()
 }
 
 func (t *Server) RegisterUnauthRPC(uri string, f RPCHandler) {
 	if f != nil {
-		t.unauthRPCHooks[uri] = f
+		t.hookLock.Lock()
+		t.unauthRPCHooks[uri] = &rpcHook{f: f}
+		t.hookLock.Unlock()
 	}
 }
 
 func (t *Server) UnregisterUnauthRPC(uri string) {
+	t.hookLock.Lock()
 	delete(t.unauthRPCHooks, uri)
+	t.hookLock.Unlock()
+}
+
+//Sets the Authenticator for an auth method (e.g. AUTH_METHOD_ANONYMOUS); replaces any existing one
+func (t *Server) RegisterAuthenticator(method string, a Authenticator) {
+	if a != nil {
+		t.authLock.Lock()
+		t.authenticators[method] = a
+		t.authLock.Unlock()
+	}
+}
+
+func (t *Server) UnregisterAuthenticator(method string) {
+	t.authLock.Lock()
+	delete(t.authenticators, method)
+	t.authLock.Unlock()
 }
 
 //Publish event outside of normal client->client structure
 func (t *Server) PublishEvent(uri string,msg interface{}){
-	subscribers,_ := t.subscriptions.Find(uri) //Doesn't matter if no one listening on this instance; possibly on other instances
+	t.PublishEventToRealm(t.V1Realm,uri,msg)
+}
+
+//Publish event to subscribers in a WAMP v2 realm
+func (t *Server) PublishEventToRealm(realm string, uri string,msg interface{}){
+	ev := &BrokerEvent{
+		Origin: t.localID,
+		Realm: realm,
+		TopicURI: uri,
+		Event: msg,
+	}
+	
+	t.distribute(ev)
+	t.forward(ev)
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Targeted Events (local sessions only; not passed to the broker)
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Sessions reached by a targeted event
+type DeliveryReport struct{
+	Delivered int //Sessions the event was queued for
+	Dropped int //Sessions subscribed to the topic whose queue dropped the event (see SlowConsumerPolicy)
+}
+
+//Sends an event to one session, if it is subscribed to uri (in its realm)
+func (t *Server) SendToSession(id ConnectionID, uri string, msg interface{})(DeliveryReport){
+	c,ok := t.getConnection(id)
+	if !ok{
+		return DeliveryReport{}
+	}
+	
+	ev := &BrokerEvent{
+		Origin: t.localID,
+		Realm: c.realm,
+		TopicURI: uri,
+		Event: msg,
+		EligibleList: []string{string(id)},
+	}
+	return t.distribute(ev)
+}
+
+//Sends an event to every session of username subscribed to uri
+func (t *Server) SendToUser(username string, uri string, msg interface{})(DeliveryReport){
+	//Sessions may be in different realms
+	byRealm := make(map[string][]string)
+	for _,c := range t.UserSessions(username){
+		byRealm[c.realm] = append(byRealm[c.realm],string(c.id))
+	}
 	
-	event := &EventMsg{
+	var report DeliveryReport
+	for realm,ids := range byRealm{
+		ev := &BrokerEvent{
+			Origin: t.localID,
+			Realm: realm,
+			TopicURI: uri,
+			Event: msg,
+			EligibleList: ids,
+		}
+		r := t.distribute(ev)
+		report.Delivered += r.Delivered
+		report.Dropped += r.Dropped
+	}
+	return report
+}
+
+//Publishes an event to subscribers of uri (in Server.V1Realm) that filter accepts
+func (t *Server) PublishEventFiltered(uri string, msg interface{}, filter func(*Connection)(bool))(DeliveryReport){
+	ev := &BrokerEvent{
+		Origin: t.localID,
+		Realm: t.V1Realm,
 		TopicURI: uri,
 		Event: msg,
 	}
+	return t.distributeFiltered(ev,filter)
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Connects this server to other instances. Events published here are passed to the broker and
+//events published on other instances are delivered to local subscribers. Call before serving.
+func (t *Server) SetBroker(b Broker) error{
+	if t.broker != nil{
+		t.broker.Detach(t.localID)
+	}
+	
+	t.broker = b
+	if b == nil{
+		return nil
+	}
 	
-	//Format json and distribute
-	if jsonEvent, err := event.MarshalJSON(); err == nil{
-		//TODO Pass to other instances
+	return b.Attach(t.localID, func(ev *BrokerEvent){
+		if ev.Origin == t.localID{
+			return //Our own event came back around
+		}
+		t.distribute(ev)
+	})
+}
+
+//Identifies this instance to other instances
+func (t *Server) NodeID() string{
+	return t.localID
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Event Distribution
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Delivers an event to subscribers connected to this instance (and retains it if it is to be kept)
+func (t *Server) distribute(ev *BrokerEvent)(DeliveryReport){
+	t.retain(ev)
+	return t.distributeFiltered(ev,nil)
+}
+
+//Delivers to local subscribers that filter accepts (nil accepts all); reports what happened per session
+func (t *Server) distributeFiltered(ev *BrokerEvent, filter func(*Connection)(bool))(DeliveryReport){
+	var report DeliveryReport
+	
+	subs := t.subscriptions.Find(ev.Realm,ev.TopicURI) //Doesn't matter if no one listening on this instance; possibly on other instances
+	if len(subs) == 0{
+		return report
+	}
+	
+	//Sessions the publisher asked to exclude, or restrict delivery to
+	excluded := make(map[ConnectionID]bool)
+	for _,id := range ev.ExcludeList{
+		excluded[ConnectionID(id)] = true
+	}
+	
+	var eligible map[ConnectionID]bool //nil when every session is eligible
+	if ev.EligibleList != nil{
+		eligible = make(map[ConnectionID]bool)
+		for _,id := range ev.EligibleList{
+			eligible[ConnectionID(id)] = true
+		}
+	}
+	
+	publication := ev.Publication
+	if publication == 0{
+		publication = newWAMPID()
+	}
+	
+	//Format json once for v1 and once per subscription & serializer for v2, as needed
+	var jsonEvent []byte
+	var err error
+	n := 0
+	for _,sub := range subs{
+		n += len(sub.subscribers)
+	}
+	sentV1 := make(map[ConnectionID]bool,n) //v1 sessions get one event however many of their subscriptions match
+	queued := make(map[ConnectionID]bool,n) //Per session: false once any event to it was dropped
+	
+	for _,sub := range subs{
+		var eventV2 *EventMsgV2
+		encodedV2 := make(map[Serializer][]byte)
 		
 		//Loop over all connections for subscription
-		for _,connID := range subscribers{
+		for _,connID := range sub.subscribers{
+			if excluded[connID] || (eligible != nil && !eligible[connID]){
+				continue
+			}
+			
 			//Look up connection for this ID
-			if subConn,ok := t.connections[connID]; ok{
-				subConn.out <- string(jsonEvent)
-			}else if !ok{
+			subConn,ok := t.getConnection(connID)
+			if !ok{
 				//Remove subscription of dropped connection
-				t.subscriptions.Remove(uri,connID)
+				t.subscriptions.Remove(sub.realm,sub.pattern,sub.match,connID)
+				continue
+			}
+			
+			//Pattern subscriptions may reach topics refused by a narrower deny entry
+			if sub.match != MATCH_EXACT && !subConn.Permissions().canSubscribe(ev.TopicURI,MATCH_EXACT){
+				continue
+			}
+			
+			if filter != nil && !filter(subConn){
+				continue
+			}
+			
+			var sent bool
+			
+			if subConn.version == 2{
+				if eventV2 == nil{
+					eventV2 = &EventMsgV2{
+						Subscription: sub.id,
+						Publication: publication,
+					}
+					if sub.match != MATCH_EXACT{
+						eventV2.Details = map[string]interface{}{"topic": ev.TopicURI}
+					}
+					eventV2.Arguments,eventV2.ArgumentsKw = ev.v2Arguments()
+				}
+				out,encoded := encodedV2[subConn.serializer]
+				if !encoded{
+					if out,err = serialize(subConn.serializer, eventV2); err != nil{
+						log.Error("postmaster: error creating event message: %s", err)
+						return report
+					}
+					encodedV2[subConn.serializer] = out
+				}
+				sent = subConn.send(out)
+			}else if !sentV1[connID]{
+				if jsonEvent == nil{
+					event := &EventMsg{
+						TopicURI: ev.TopicURI,
+						Event: ev.Event,
+					}
+					if jsonEvent,err = event.MarshalJSON(); err != nil{
+						log.Error("postmaster: error creating event message: %s", err)
+						return report
+					}
+				}
+				sentV1[connID] = true
+				sent = subConn.send(jsonEvent)
+			}else{
+				continue
+			}
+			
+			if ok,seen := queued[connID]; !seen || ok{
+				queued[connID] = sent
 			}
 		}
-	}else{
-		log.Error("postmaster: error creating event message(PublishEvent()): %s", err)
+	}
+	
+	for _,ok := range queued{
+		if ok{
+			report.Delivered++
+		}else{
+			report.Dropped++
+		}
+	}
+	return report
+}
+
+//Passes an event published on this instance to other instances
+func (t *Server) forward(ev *BrokerEvent){
+	if t.broker == nil{
 		return
 	}
+	
+	if err := t.broker.Publish(ev); err != nil{
+		log.Error("postmaster: error passing event to broker: %s", err)
+	}
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Registry Access (safe for concurrent use)
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+func (t *Server) getConnection(id ConnectionID)(*Connection,bool){
+	t.connLock.RLock()
+	defer t.connLock.RUnlock()
+	c,ok := t.connections[id]
+	return c,ok
+}
+
+func (t *Server) addConnection(c *Connection){
+	t.connLock.Lock()
+	t.connections[c.id] = c
+	t.connLock.Unlock()
+}
+
+//Unregisters the connection and releases anything blocked sending to it
+func (t *Server) removeConnection(id ConnectionID){
+	t.connLock.Lock()
+	c,ok := t.connections[id]
+	delete(t.connections,id)
+	t.connLock.Unlock()
+	
+	if ok{
+		close(c.done)
+	}
+}
+
+//Looks up RPC handler; unauth selects the hooks available before authentication
+func (t *Server) getHook(uri string, unauth bool)(*rpcHook,bool){
+	t.hookLock.RLock()
+	defer t.hookLock.RUnlock()
+	if unauth{
+		f,ok := t.unauthRPCHooks[uri]
+		return f,ok
+	}
+	f,ok := t.rpcHooks[uri]
+	return f,ok
 }
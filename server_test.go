@@ -0,0 +1,352 @@
+package postmaster
+
+import(
+	"fmt"
+	"testing"
+	"code.google.com/p/go.net/websocket"
+)
+
+//Reads and discards messages until the socket closes
+func drain(ws *websocket.Conn){
+	for{
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil{
+			return
+		}
+	}
+}
+
+func addHandler(conn *Connection, uri string, args ...interface{})(interface{}, *RPCError){
+	a,_ := args[0].(float64)
+	b,_ := args[1].(float64)
+	return a+b,nil
+}
+
+//Connects, subscribes, publishes, calls and disconnects from many clients at once while the server
+//publishes and manages sessions. Run with -race.
+func TestConcurrentSessions(t *testing.T){
+	s := newTestServer()
+	s.RegisterRPC("add", addHandler)
+	ts := startServer(s)
+	defer ts.Close()
+
+	t.Run("group", func(t *testing.T){
+		for i := 0; i < 16; i++{
+			user := fmt.Sprintf("user%d", i%4)
+
+			t.Run("v1", func(t *testing.T){
+				t.Parallel()
+				ws := dial(t, ts)
+				defer ws.Close()
+
+				login(t, ws, user)
+				send(t, ws, SUBSCRIBE, "topic")
+				go drain(ws)
+				for j := 0; j < 20; j++{
+					send(t, ws, PUBLISH, "topic", j)
+					send(t, ws, CALL, fmt.Sprint(j), "add", j, 1)
+				}
+				send(t, ws, UNSUBSCRIBE, "topic")
+			})
+
+			t.Run("v2", func(t *testing.T){
+				t.Parallel()
+				ws := dial(t, ts, WAMP_V2_JSON_PROTOCOL)
+				defer ws.Close()
+
+				join(t, ws, map[string]interface{}{"authid": user})
+				send(t, ws, V2_SUBSCRIBE, 1, map[string]interface{}{}, "topic")
+				recv(t, ws) //SUBSCRIBED
+				go drain(ws)
+				for j := 0; j < 20; j++{
+					send(t, ws, V2_PUBLISH, 100+j, map[string]interface{}{"exclude_me": false}, "topic", []interface{}{j})
+					send(t, ws, V2_CALL, 200+j, map[string]interface{}{}, "add", []interface{}{j, 1})
+				}
+			})
+		}
+
+		t.Run("server", func(t *testing.T){
+			t.Parallel()
+			for j := 0; j < 50; j++{
+				s.PublishEvent("topic", j)
+				s.SendToUser("user1", "topic", j)
+				s.SetUserPermissions("user2", testPermissions())
+				s.RegisterRPC("add", addHandler)
+				for _,c := range s.UserSessions("user3"){
+					c.Username()
+					c.AuthState()
+					c.Permissions()
+				}
+			}
+		})
+	})
+
+	waitFor(t, "sessions to close", func()(bool){
+		return len(s.allConnections()) == 0
+	})
+}
+
+//CURIEs in CALL, SUBSCRIBE & PUBLISH are expanded with the connection's prefixes
+func TestPrefix(t *testing.T){
+	s := newTestServer()
+	s.GetAuthPermissions = func(authKey string, authExtra map[string]interface{})(Permissions,error){
+		return Permissions{
+			RPC: map[string]RPCPermission{"http://example.com/": {Match: MATCH_PREFIX, CanCall: true}},
+			PubSub: map[string]PubSubPermission{"http://example.com/": {Match: MATCH_PREFIX, CanPublish: true, CanSubscribe: true}},
+		},nil
+	}
+	s.RegisterRPC("http://example.com/api#add", addHandler)
+	s.RegisterRPC("http://example.com/v2#add", func(conn *Connection, uri string, args ...interface{})(interface{}, *RPCError){
+		return uri,nil
+	})
+	ts := startServer(s)
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+	login(t, ws, "alice")
+
+	send(t, ws, PREFIX, "api", "http://example.com/api#")
+	send(t, ws, PREFIX, "ev", "http://example.com/event#")
+
+	//CALL
+	send(t, ws, CALL, "1", "api:add", 1, 2)
+	if res := recv(t, ws); res[0] != float64(CALLRESULT) || res[2] != float64(3){
+		t.Errorf("call api:add: got %v", res)
+	}
+
+	//SUBSCRIBE & PUBLISH (the publisher gets its own event without excludeMe)
+	send(t, ws, SUBSCRIBE, "ev:topic")
+	send(t, ws, PUBLISH, "ev:topic", "hi", false)
+	if ev := recv(t, ws); ev[0] != float64(EVENT) || ev[1] != "http://example.com/event#topic" || ev[2] != "hi"{
+		t.Errorf("publish ev:topic: got %v", ev)
+	}
+	s.PublishEvent("http://example.com/event#topic", "server")
+	if ev := recv(t, ws); ev[0] != float64(EVENT) || ev[2] != "server"{
+		t.Errorf("subscribe ev:topic: got %v", ev)
+	}
+
+	//Unknown prefixes are left as they are
+	send(t, ws, CALL, "2", "nope:add", 1, 2)
+	if res := recv(t, ws); res[0] != float64(CALLERROR) || res[4] != "nope:add"{
+		t.Errorf("call nope:add: got %v", res)
+	}
+
+	//A later PREFIX replaces the earlier one
+	send(t, ws, PREFIX, "api", "http://example.com/v2#")
+	send(t, ws, CALL, "3", "api:add", 1, 2)
+	if res := recv(t, ws); res[0] != float64(CALLRESULT) || res[2] != "http://example.com/v2#add"{
+		t.Errorf("call api:add after redefining api: got %v", res)
+	}
+}
+
+//CALLs to procedures the session may not call are refused for v1 & v2; allowed ones go through
+func TestCallPermissions(t *testing.T){
+	s := newTestServer()
+	perms := func()(Permissions){
+		p := testPermissions()
+		p.RPC["com.app."] = RPCPermission{Match: MATCH_PREFIX, CanCall: true}
+		p.RPC["com.app.admin"] = RPCPermission{Deny: true}
+		return p
+	}
+	s.GetAuthPermissions = func(authKey string, authExtra map[string]interface{})(Permissions,error){
+		return perms(),nil
+	}
+	s.GetRealmPermissions = func(realm string, details map[string]interface{})(Permissions,error){
+		return perms(),nil
+	}
+	for _,uri := range []string{"add", "secret", "com.app.echo", "com.app.admin"}{
+		s.RegisterRPC(uri, func(conn *Connection, uri string, args ...interface{})(interface{}, *RPCError){
+			return uri,nil
+		})
+	}
+	ts := startServer(s)
+	defer ts.Close()
+
+	v1 := dial(t, ts)
+	defer v1.Close()
+	login(t, v1, "alice")
+
+	v2 := dial(t, ts, WAMP_V2_JSON_PROTOCOL)
+	defer v2.Close()
+	join(t, v2, nil)
+
+	tests := []struct{
+		uri string
+		allowed bool
+	}{
+		{"add", true},
+		{"com.app.echo", true},
+		{"secret", false}, //No entry
+		{"com.app.admin", false}, //Denied
+	}
+	for i,test := range tests{
+		send(t, v1, CALL, fmt.Sprint(i), test.uri)
+		res := recv(t, v1)
+		if test.allowed && (res[0] != float64(CALLRESULT) || res[2] != test.uri){
+			t.Errorf("v1 %s: expected result, got %v", test.uri, res)
+		}else if !test.allowed && (res[0] != float64(CALLERROR) || res[2] != ERROR_NOT_AUTHORIZED || res[4] != test.uri){
+			t.Errorf("v1 %s: expected not authorized, got %v", test.uri, res)
+		}
+
+		send(t, v2, V2_CALL, i, map[string]interface{}{}, test.uri)
+		res = recv(t, v2)
+		if test.allowed && (res[0] != float64(V2_RESULT) || res[3].([]interface{})[0] != test.uri){
+			t.Errorf("v2 %s: expected result, got %v", test.uri, res)
+		}else if !test.allowed && (res[0] != float64(V2_ERROR) || res[4] != V2_ERROR_NOT_AUTHORIZED){
+			t.Errorf("v2 %s: expected not authorized, got %v", test.uri, res)
+		}
+	}
+}
+
+//PUBLISH exclude & eligible lists pick the subscribers that get the event
+func TestPublishExcludeEligible(t *testing.T){
+	s := newTestServer()
+	s.RegisterRPC("add", addHandler)
+	ts := startServer(s)
+	defer ts.Close()
+
+	ws := make([]*websocket.Conn,3)
+	ids := make([]string,3)
+	for i := range ws{
+		ws[i] = dial(t, ts)
+		defer ws[i].Close()
+		ids[i] = recv(t, ws[i])[1].(string) //WELCOME
+		authenticate(t, ws[i], "alice")
+		send(t, ws[i], SUBSCRIBE, "topic")
+		send(t, ws[i], CALL, "sync", "add", 1, 2) //Answered once the subscribe is handled
+		recv(t, ws[i])
+	}
+
+	tests := []struct{
+		name string
+		options []interface{} //After the event
+		received []bool //Per session; session 0 publishes
+	}{
+		{"none", nil, []bool{true, true, true}},
+		{"exclude me", []interface{}{true}, []bool{false, true, true}},
+		{"don't exclude me", []interface{}{false}, []bool{true, true, true}},
+		{"exclude", []interface{}{[]string{ids[1]}}, []bool{true, false, true}},
+		{"eligible", []interface{}{[]string{}, []string{ids[1]}}, []bool{false, true, false}},
+		{"exclude & eligible", []interface{}{[]string{ids[1]}, []string{ids[0], ids[1]}}, []bool{true, false, false}},
+		{"exclude me & eligible", []interface{}{true, []string{ids[0], ids[1]}}, []bool{false, true, false}},
+		{"no one eligible", []interface{}{[]string{}, []string{}}, []bool{false, false, false}},
+	}
+	for _,test := range tests{
+		send(t, ws[0], append([]interface{}{PUBLISH, "topic", test.name}, test.options...)...)
+		send(t, ws[0], CALL, "sync", "add", 1, 2) //Answered once the publish is handled
+		res := recv(t, ws[0])
+		if received := res[0] == float64(EVENT); received != test.received[0]{
+			t.Errorf("%s: publisher received %t, want %t", test.name, received, test.received[0])
+		}else if received{
+			recv(t, ws[0]) //CALLRESULT
+		}
+
+		//The others get the event before the marker if it was delivered
+		s.PublishEvent("topic", "marker")
+		for i,c := range ws[1:]{
+			ev := recv(t, c)
+			if received := ev[2] == test.name; received != test.received[i+1]{
+				t.Errorf("%s: session %d received %t, want %t", test.name, i+1, received, test.received[i+1])
+			}
+			if ev[2] != "marker"{
+				recv(t, c)
+			}
+		}
+		recv(t, ws[0]) //Marker
+	}
+}
+
+func TestDeliveryReports(t *testing.T){
+	s := NewServer()
+	s.V1Realm = "realm1"
+	s.Backlog = 1
+	s.SlowConsumer = DROP_NEWEST
+
+	//Sessions: name, user, realm, subscribed to "topic"
+	sessions := map[ConnectionID]*Connection{}
+	for _,c := range []struct{
+		id ConnectionID
+		user string
+		realm string
+		subscribed bool
+	}{
+		{"bob1", "bob", "realm1", true},
+		{"bob2", "bob", "realm2", true},
+		{"bob3", "bob", "realm1", false},
+		{"alice", "alice", "realm1", true},
+		{"slow", "carol", "realm1", true},
+	}{
+		conn := newConnection(s, c.id, nil)
+		conn.realm = c.realm
+		conn.authState = AUTH_STATE_AUTHENTICATED
+		conn.username = c.user
+		s.addConnection(conn)
+		if c.subscribed{
+			s.subscriptions.Add(c.realm, "topic", MATCH_EXACT, c.id)
+			s.subscriptions.Add(c.realm, "top", MATCH_PREFIX, c.id) //Reached twice, counted once
+		}
+		sessions[c.id] = conn
+	}
+	sessions["slow"].send([]byte("backlog")) //Queue full
+
+	//Empties every queue but the slow one's
+	drain := func(){
+		for id,c := range sessions{
+			if id == "slow"{
+				continue
+			}
+			for len(c.out) > 0{
+				<-c.out
+			}
+		}
+	}
+
+	tests := []struct{
+		name string
+		send func()(DeliveryReport)
+		report DeliveryReport
+	}{
+		{"unknown session", func()(DeliveryReport){
+			return s.SendToSession("nope", "topic", 1)
+		}, DeliveryReport{}},
+		{"session", func()(DeliveryReport){
+			return s.SendToSession("alice", "topic", 1)
+		}, DeliveryReport{Delivered: 1}},
+		{"unsubscribed session", func()(DeliveryReport){
+			return s.SendToSession("bob3", "topic", 1)
+		}, DeliveryReport{}},
+		{"other topic", func()(DeliveryReport){
+			return s.SendToSession("alice", "other", 1)
+		}, DeliveryReport{}},
+		{"slow session", func()(DeliveryReport){
+			return s.SendToSession("slow", "topic", 1)
+		}, DeliveryReport{Dropped: 1}},
+		{"user in two realms", func()(DeliveryReport){
+			return s.SendToUser("bob", "topic", 1)
+		}, DeliveryReport{Delivered: 2}},
+		{"unknown user", func()(DeliveryReport){
+			return s.SendToUser("nope", "topic", 1)
+		}, DeliveryReport{}},
+		{"filtered", func()(DeliveryReport){
+			return s.PublishEventFiltered("topic", 1, func(c *Connection)(bool){
+				return c.Username() != "alice"
+			})
+		}, DeliveryReport{Delivered: 1, Dropped: 1}}, //bob1 & slow in realm1
+		{"filter refusing all", func()(DeliveryReport){
+			return s.PublishEventFiltered("topic", 1, func(c *Connection)(bool){
+				return false
+			})
+		}, DeliveryReport{}},
+	}
+	for _,test := range tests{
+		if report := test.send(); report != test.report{
+			t.Errorf("%s: %+v, want %+v", test.name, report, test.report)
+		}
+		drain()
+	}
+
+	if drops := sessions["slow"].Drops(); drops != 2{
+		t.Errorf("slow session dropped %d events, want 2", drops)
+	}
+}
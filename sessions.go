@@ -0,0 +1,195 @@
+package postmaster
+
+import(
+	"errors"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Session Management
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+var ErrNoSuchSession = errors.New("postmaster: no such session")
+var ErrNotAuthenticated = errors.New("postmaster: session not authenticated")
+var ErrReauthUnsupported = errors.New("postmaster: WAMP v2 sessions can't re-authenticate; disconnect instead")
+
+//Looks up a connected session by ID
+func (t *Server) Session(id ConnectionID)(*Connection,bool){
+	return t.getConnection(id)
+}
+
+//Connected sessions authenticated as username ("" matches none; unnamed v2 sessions aren't a user)
+func (t *Server) UserSessions(username string)([]*Connection){
+	if username == ""{
+		return nil
+	}
+
+	var sessions []*Connection
+	for _,c := range t.allConnections(){
+		if c.authenticatedAs(username){
+			sessions = append(sessions,c)
+		}
+	}
+	return sessions
+}
+
+//Replaces a session's permissions. Subscriptions and procedure registrations the new permissions don't
+//allow are dropped; calls already passed to a dropped procedure are still answered.
+func (t *Server) SetPermissions(id ConnectionID, p Permissions)(error){
+	c,ok := t.getConnection(id)
+	if !ok{
+		return ErrNoSuchSession
+	}
+
+	//No subscribe or register checked against the old permissions may land after the prune
+	c.grantLock.Lock()
+	defer c.grantLock.Unlock()
+
+	if err := c.setPermissions(p); err != nil{
+		return err
+	}
+	t.pruneSubscriptions(c)
+	t.pruneRegistrations(c)
+
+	log.Info("postmaster: permissions replaced for session %s", id)
+	return nil
+}
+
+//Replaces the permissions of every session of username; returns the number of sessions updated
+func (t *Server) SetUserPermissions(username string, p Permissions)(int){
+	n := 0
+	for _,c := range t.UserSessions(username){
+		if t.SetPermissions(c.id,p) == nil{
+			n++
+		}
+	}
+	return n
+}
+
+//Revokes a v1 session's authentication. It keeps its socket but loses its permissions & subscriptions
+//and has to authreq/auth again (within Server.AuthTimeout if set).
+func (t *Server) Reauthenticate(id ConnectionID)(error){
+	c,ok := t.getConnection(id)
+	if !ok{
+		return ErrNoSuchSession
+	}
+	if c.version == 2{
+		return ErrReauthUnsupported
+	}
+
+	c.grantLock.Lock()
+	defer c.grantLock.Unlock()
+
+	if err := c.revokeAuth(); err != nil{
+		return err
+	}
+	t.subscriptions.RemoveConnection(c.id)
+	t.startAuthTimer(c)
+
+	log.Info("postmaster: session %s must re-authenticate", id)
+	return nil
+}
+
+//Closes a session. v2 sessions are sent GOODBYE with reason (a URI, default wamp.close.normal);
+//v1 has no close message so reason is only logged.
+func (t *Server) Disconnect(id ConnectionID, reason string)(error){
+	c,ok := t.getConnection(id)
+	if !ok{
+		return ErrNoSuchSession
+	}
+
+	if reason == ""{
+		reason = V2_CLOSE_NORMAL
+	}
+	log.Info("postmaster: disconnecting session %s: %s", id, reason)
+
+	if c.version == 2{
+		goodbye := &GoodbyeMsg{Reason: reason}
+		c.sendMessage(goodbye)
+	}
+	c.closeAfterFlush()
+
+	return nil
+}
+
+//Disconnects every session of username; returns the number of sessions closed
+func (t *Server) DisconnectUser(username string, reason string)(int){
+	n := 0
+	for _,c := range t.UserSessions(username){
+		if t.Disconnect(c.id,reason) == nil{
+			n++
+		}
+	}
+	return n
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Name & authExtra of an authenticated session (pendingAuth is kept once authenticated); ok is false otherwise
+func (c *Connection) identity()(username string, authExtra map[string]interface{}, ok bool){
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.authState != AUTH_STATE_AUTHENTICATED || c.pendingAuth == nil{
+		return "",nil,false
+	}
+	return c.username,c.pendingAuth.authExtra,true
+}
+
+//Whether the session is authenticated as username
+func (c *Connection) authenticatedAs(username string)(bool){
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.authState == AUTH_STATE_AUTHENTICATED && c.username == username
+}
+
+func (c *Connection) setPermissions(p Permissions)(error){
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.authState != AUTH_STATE_AUTHENTICATED{
+		return ErrNotAuthenticated
+	}
+	c.perms = &p
+	return nil
+}
+
+//Returns the session to AUTH_STATE_NONE without permissions or identity
+func (c *Connection) revokeAuth()(error){
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.authTransition(AUTH_EVENT_REVOKE){
+		return ErrNotAuthenticated
+	}
+	c.perms = nil
+	c.username = ""
+	c.pendingAuth = nil
+	c.authFailures = 0
+	return nil
+}
+
+//Drops subscriptions a session's permissions no longer allow
+func (t *Server) pruneSubscriptions(c *Connection){
+	p := c.Permissions()
+	for _,sub := range t.subscriptions.ForConnection(c.id){
+		if !p.canSubscribe(sub.pattern,sub.match){
+			t.subscriptions.Remove(sub.realm,sub.pattern,sub.match,c.id)
+			log.Debug("postmaster: dropped subscription of %s to %s", c.id, sub.pattern)
+		}
+	}
+}
+
+//Unregisters procedures a session's permissions no longer allow it to implement
+func (t *Server) pruneRegistrations(c *Connection){
+	p := c.Permissions()
+	for _,reg := range t.dealer.forSession(c){
+		if !p.canRegister(reg.procedure){
+			t.dealer.unregister(c,reg.id)
+			log.Debug("postmaster: dropped registration of %s for %s", c.id, reg.procedure)
+		}
+	}
+}
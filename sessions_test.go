@@ -0,0 +1,175 @@
+package postmaster
+
+import(
+	"fmt"
+	"sync"
+	"testing"
+)
+
+//The session of a logged in user
+func userSession(t *testing.T, s *Server, user string)(*Connection){
+	var sessions []*Connection
+	waitFor(t, user+"'s session", func()(bool){
+		sessions = s.UserSessions(user)
+		return len(sessions) == 1
+	})
+	return sessions[0]
+}
+
+func TestReauthenticate(t *testing.T){
+	s := newTestServer()
+	s.RegisterRPC("add", addHandler)
+	ts := startServer(s)
+	defer ts.Close()
+
+	ws := dial(t, ts)
+	defer ws.Close()
+	login(t, ws, "alice")
+	send(t, ws, SUBSCRIBE, "topic")
+	c := userSession(t, s, "alice")
+
+	if err := s.Reauthenticate(c.id); err != nil{
+		t.Fatal(err)
+	}
+	if c.AuthState() != AUTH_STATE_NONE || c.Username() != "" || len(s.UserSessions("alice")) != 0{
+		t.Errorf("still authenticated: %s %q", c.AuthState(), c.Username())
+	}
+	if err := s.Reauthenticate(c.id); err != ErrNotAuthenticated{
+		t.Errorf("second Reauthenticate: %v, want ErrNotAuthenticated", err)
+	}
+
+	//Subscriptions & permissions are gone
+	s.PublishEvent("topic", "hi")
+	recvNothing(t, ws)
+	send(t, ws, CALL, "1", "add", 1, 2)
+	if res := recv(t, ws); res[0] != float64(CALLERROR){
+		t.Errorf("call allowed after Reauthenticate: %v", res)
+	}
+
+	authenticate(t, ws, "alice")
+	if c.Username() != "alice"{
+		t.Errorf("username %q after authenticating again", c.Username())
+	}
+
+	if err := s.Reauthenticate("nope"); err != ErrNoSuchSession{
+		t.Errorf("unknown session: %v, want ErrNoSuchSession", err)
+	}
+	v2 := dial(t, ts, WAMP_V2_JSON_PROTOCOL)
+	defer v2.Close()
+	id := join(t, v2, nil)
+	if err := s.Reauthenticate(ConnectionID(fmt.Sprintf("%.0f", id))); err != ErrReauthUnsupported{
+		t.Errorf("v2 session: %v, want ErrReauthUnsupported", err)
+	}
+}
+
+//Reauthenticate & auth change the username while handleCall reads it. Run with -race.
+func TestReauthenticateDuringCalls(t *testing.T){
+	s := newTestServer()
+	s.RegisterRPC("add", addHandler)
+	ts := startServer(s)
+	defer ts.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++{
+		user := fmt.Sprintf("user%d", i)
+		ws := dial(t, ts)
+		defer ws.Close()
+		login(t, ws, user)
+		c := userSession(t, s, user)
+		go drain(ws)
+
+		wg.Add(2)
+		go func(){
+			defer wg.Done()
+			for j := 0; j < 100; j++{
+				send(t, ws, CALL, fmt.Sprint(j), "add", j, 1)
+				send(t, ws, CALL, fmt.Sprint(j), "denied", j)
+			}
+		}()
+		go func(){
+			defer wg.Done()
+			for j := 0; j < 50; j++{
+				if err := s.Reauthenticate(c.id); err != nil{
+					t.Error(err)
+					return
+				}
+				ch,err := authRequest(s, c, user, nil)
+				if err != nil{
+					t.Error(err)
+					return
+				}
+				if _,err := auth(s, c, authSignature([]byte(ch), testSecret, nil)); err != nil{
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+//SetPermissions unregisters client procedures the session may no longer implement
+func TestSetPermissionsRegistrations(t *testing.T){
+	s := newTestServer()
+	ts := startServer(s)
+	defer ts.Close()
+
+	callee := dial(t, ts, WAMP_V2_JSON_PROTOCOL)
+	defer callee.Close()
+	id := join(t, callee, nil)
+	send(t, callee, V2_REGISTER, 1, map[string]interface{}{}, "add")
+	registered := recv(t, callee)
+	if registered[0] != float64(V2_REGISTERED){
+		t.Fatalf("register failed: %v", registered)
+	}
+
+	caller := dial(t, ts, WAMP_V2_JSON_PROTOCOL)
+	defer caller.Close()
+	join(t, caller, nil)
+
+	//Calls only; registering is revoked
+	p := testPermissions()
+	p.RPC["add"] = RPCPermission{CanCall: true}
+	if err := s.SetPermissions(ConnectionID(fmt.Sprintf("%.0f", id)), p); err != nil{
+		t.Fatal(err)
+	}
+
+	send(t, caller, V2_CALL, 2, map[string]interface{}{}, "add", []interface{}{1, 2})
+	if msg := recv(t, caller); msg[0] != float64(V2_ERROR) || msg[4] != V2_ERROR_NO_SUCH_PROCEDURE{
+		t.Errorf("call after registration was revoked: %v", msg)
+	}
+	send(t, callee, V2_UNREGISTER, 3, registered[2])
+	if msg := recv(t, callee); msg[0] != float64(V2_ERROR) || msg[4] != V2_ERROR_NO_SUCH_REGISTRATION{
+		t.Errorf("unregister after registration was revoked: %v", msg)
+	}
+	send(t, callee, V2_REGISTER, 4, map[string]interface{}{}, "add")
+	if msg := recv(t, callee); msg[0] != float64(V2_ERROR) || msg[4] != V2_ERROR_NOT_AUTHORIZED{
+		t.Errorf("register after registration was revoked: %v", msg)
+	}
+}
+
+//A subscribe racing a permission change either fails or is pruned with it
+func TestSetPermissionsDuringSubscribe(t *testing.T){
+	for i := 0; i < 200; i++{
+		s := NewServer()
+		c := newConnection(s, "c", nil)
+		c.authState = AUTH_STATE_AUTHENTICATED
+		p := testPermissions()
+		c.perms = &p
+		s.addConnection(c)
+
+		done := make(chan bool)
+		go func(){
+			s.subscribe(c, "topic", MATCH_EXACT)
+			close(done)
+		}()
+		if err := s.SetPermissions(c.id, Permissions{}); err != nil{
+			t.Fatal(err)
+		}
+		<-done
+
+		if subs := s.subscriptions.ForConnection(c.id); len(subs) != 0{
+			t.Fatalf("subscription added against revoked permissions: %v", subs)
+		}
+	}
+}
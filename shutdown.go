@@ -0,0 +1,152 @@
+package postmaster
+
+import(
+	"context"
+	"errors"
+	"sync"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Shutdown
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+var ErrServerClosed = errors.New("postmaster: server shutting down")
+
+//Stops the server gracefully:
+//	*	New sessions are refused (v2 clients get ABORT) and new RPC calls fail
+//	*	ShutdownEvent is published on ShutdownTopic (if set) in every realm with sessions
+//	*	Waits for RPC handlers already running and for callees to answer calls already routed to them
+//	*	v2 sessions are sent GOODBYE; queued messages are flushed and every socket closed
+//
+//Returns once every session has ended, or ctx's error if it ends first (remaining sockets are closed).
+func (t *Server) Shutdown(ctx context.Context)(error){
+	t.shutdownLock.Lock()
+	if t.closing{
+		t.shutdownLock.Unlock()
+		return ErrServerClosed
+	}
+	t.closing = true
+	t.shutdownLock.Unlock()
+
+	log.Info("postmaster: shutting down")
+
+	conns := t.allConnections()
+
+	//Final notice (local sessions only; other instances keep running)
+	if t.ShutdownTopic != ""{
+		realms := make(map[string]bool)
+		for _,c := range conns{
+			realms[c.realm] = true
+		}
+		for realm,_ := range realms{
+			t.distribute(&BrokerEvent{
+				Origin: t.localID,
+				Realm: realm,
+				TopicURI: t.ShutdownTopic,
+				Event: t.ShutdownEvent,
+			})
+		}
+	}
+
+	//Let running calls (and callees of client procedures) answer before their sockets go
+	if err := waitContext(ctx,t.calls); err != nil{
+		t.forceClose()
+		return err
+	}
+
+	for _,c := range conns{
+		t.closeForShutdown(c)
+	}
+
+	err := waitContext(ctx,t.sessions)
+	if err != nil{
+		t.forceClose()
+	}
+
+	if t.broker != nil{
+		t.broker.Detach(t.localID)
+	}
+
+	return err
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Shutdown Utility Functions
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Counts a session handler; false once shutting down
+func (t *Server) beginSession()(bool){
+	t.shutdownLock.Lock()
+	defer t.shutdownLock.Unlock()
+
+	if t.closing{
+		return false
+	}
+	t.sessions.Add(1)
+	return true
+}
+
+//Counts an RPC handler; false once shutting down
+func (t *Server) beginCall()(bool){
+	t.shutdownLock.Lock()
+	defer t.shutdownLock.Unlock()
+
+	if t.closing{
+		return false
+	}
+	t.calls.Add(1)
+	return true
+}
+
+func (t *Server) shuttingDown()(bool){
+	t.shutdownLock.Lock()
+	defer t.shutdownLock.Unlock()
+	return t.closing
+}
+
+//Says goodbye (v2) and closes once queued messages are sent
+func (t *Server) closeForShutdown(c *Connection){
+	if c.version == 2{
+		goodbye := &GoodbyeMsg{Reason: V2_CLOSE_SYSTEM_SHUTDOWN}
+		c.sendMessage(goodbye)
+	}
+	c.closeAfterFlush()
+}
+
+//Closes every remaining socket without flushing
+func (t *Server) forceClose(){
+	for _,c := range t.allConnections(){
+		c.close()
+	}
+}
+
+func (t *Server) allConnections()([]*Connection){
+	t.connLock.RLock()
+	defer t.connLock.RUnlock()
+
+	conns := make([]*Connection,0,len(t.connections))
+	for _,c := range t.connections{
+		conns = append(conns,c)
+	}
+	return conns
+}
+
+//Waits for wg, or until ctx is done
+func waitContext(ctx context.Context, wg *sync.WaitGroup)(error){
+	done := make(chan struct{})
+	go func(){
+		wg.Wait()
+		close(done)
+	}()
+
+	select{
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
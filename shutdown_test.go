@@ -0,0 +1,193 @@
+package postmaster
+
+import(
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"code.google.com/p/go.net/websocket"
+)
+
+//Runs Shutdown in the background; the returned channel gets its error
+func shutdownAsync(s *Server, timeout time.Duration)(chan error){
+	done := make(chan error,1)
+	go func(){
+		ctx,cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+	return done
+}
+
+//Fails unless ws gets GOODBYE wamp.close.system_shutdown and is then closed
+func expectGoodbye(t *testing.T, what string, ws *websocket.Conn){
+	if msg := recv(t, ws); msg[0] != float64(V2_GOODBYE) || msg[2] != V2_CLOSE_SYSTEM_SHUTDOWN{
+		t.Errorf("%s: expected GOODBYE, got %v", what, msg)
+	}
+	if !closedWithin(ws, time.Second){
+		t.Errorf("%s: not closed after GOODBYE", what)
+	}
+}
+
+//Subscribers get the final event, v2 sessions GOODBYE, and new sessions are refused
+func TestShutdown(t *testing.T){
+	s := newTestServer()
+	s.ShutdownTopic = "topic"
+	s.ShutdownEvent = "restarting"
+	ts := startServer(s)
+	defer ts.Close()
+
+	v1 := dial(t, ts)
+	defer v1.Close()
+	login(t, v1, "alice")
+	send(t, v1, SUBSCRIBE, "topic")
+	send(t, v1, CALL, "sync", "nope") //Answered once the subscribe is handled
+	recv(t, v1)
+
+	v2 := dial(t, ts, WAMP_V2_JSON_PROTOCOL)
+	defer v2.Close()
+	join(t, v2, nil)
+	send(t, v2, V2_SUBSCRIBE, 1, map[string]interface{}{}, "topic")
+	if msg := recv(t, v2); msg[0] != float64(V2_SUBSCRIBED){
+		t.Fatalf("subscribe failed: %v", msg)
+	}
+
+	done := shutdownAsync(s, 2*time.Second)
+
+	if ev := recv(t, v1); ev[0] != float64(EVENT) || ev[1] != "topic" || ev[2] != "restarting"{
+		t.Errorf("v1: expected shutdown event, got %v", ev)
+	}
+	if !closedWithin(v1, time.Second){
+		t.Error("v1: not closed")
+	}
+	if ev := recv(t, v2); ev[0] != float64(V2_EVENT) || len(ev) < 5 || ev[4].([]interface{})[0] != "restarting"{
+		t.Errorf("v2: expected shutdown event, got %v", ev)
+	}
+	expectGoodbye(t, "v2", v2)
+
+	select{
+	case err := <-done:
+		if err != nil{
+			t.Errorf("Shutdown: %v", err)
+		}
+	case <-time.After(2*time.Second):
+		t.Fatal("Shutdown didn't return")
+	}
+
+	//Refused from now on
+	late := dial(t, ts, WAMP_V2_JSON_PROTOCOL)
+	defer late.Close()
+	if msg := recv(t, late); msg[0] != float64(V2_ABORT) || msg[2] != V2_CLOSE_SYSTEM_SHUTDOWN{
+		t.Errorf("v2: expected ABORT, got %v", msg)
+	}
+
+	lateV1 := dial(t, ts)
+	defer lateV1.Close()
+	lateV1.SetReadDeadline(time.Now().Add(time.Second))
+	var data []byte
+	if err := websocket.Message.Receive(lateV1, &data); err == nil{
+		t.Errorf("v1: got %s, expected the connection closed", data)
+	}
+
+	if err := s.Shutdown(context.Background()); err != ErrServerClosed{
+		t.Errorf("second Shutdown: %v, want ErrServerClosed", err)
+	}
+}
+
+//Calls already running answer before sockets close; new calls are canceled
+func TestShutdownDrainsCalls(t *testing.T){
+	tests := []struct{
+		name string
+		//Sets up "add"; running waits until a call is being handled, answer then answers it
+		setup func(t *testing.T, s *Server, ts *httptest.Server)(running func(), answer func())
+	}{
+		{"server procedure", func(t *testing.T, s *Server, ts *httptest.Server)(func(), func()){
+			started := make(chan bool,1)
+			release := make(chan bool)
+			s.RegisterRPCContext("add", func(ctx context.Context, conn *Connection, uri string, args ...interface{})(interface{}, *RPCError){
+				started <- true
+				<-release
+				return 3,nil
+			}, 0)
+			return func(){ <-started }, func(){ close(release) }
+		}},
+		{"client procedure", func(t *testing.T, s *Server, ts *httptest.Server)(func(), func()){
+			callee := dial(t, ts, WAMP_V2_JSON_PROTOCOL)
+			join(t, callee, nil)
+			send(t, callee, V2_REGISTER, 1, map[string]interface{}{}, "add")
+			if msg := recv(t, callee); msg[0] != float64(V2_REGISTERED){
+				t.Fatalf("register failed: %v", msg)
+			}
+			var invocation []interface{}
+			return func(){ invocation = recv(t, callee) }, func(){
+				send(t, callee, V2_YIELD, invocation[1], map[string]interface{}{}, []interface{}{3})
+			}
+		}},
+	}
+	for _,test := range tests{
+		s := newTestServer()
+		s.InvocationTimeout = -1
+		ts := startServer(s)
+		running,answer := test.setup(t, s, ts)
+
+		caller := dial(t, ts, WAMP_V2_JSON_PROTOCOL)
+		join(t, caller, nil)
+		send(t, caller, V2_CALL, 1, map[string]interface{}{}, "add", []interface{}{1, 2})
+		running()
+
+		done := shutdownAsync(s, 2*time.Second)
+		waitFor(t, "shutdown", s.shuttingDown)
+
+		send(t, caller, V2_CALL, 2, map[string]interface{}{}, "add", []interface{}{1, 2})
+		if msg := recv(t, caller); msg[0] != float64(V2_ERROR) || msg[2] != float64(2) || msg[4] != V2_ERROR_CANCELED{
+			t.Errorf("%s: expected new call canceled, got %v", test.name, msg)
+		}
+		select{
+		case err := <-done:
+			t.Fatalf("%s: Shutdown returned before the running call: %v", test.name, err)
+		case <-time.After(100*time.Millisecond):
+		}
+
+		answer()
+		if msg := recv(t, caller); msg[0] != float64(V2_RESULT) || msg[1] != float64(1){
+			t.Errorf("%s: expected result, got %v", test.name, msg)
+		}
+		expectGoodbye(t, test.name, caller)
+		if err := <-done; err != nil{
+			t.Errorf("%s: Shutdown: %v", test.name, err)
+		}
+
+		caller.Close()
+		ts.Close()
+	}
+}
+
+//Sockets are closed and ctx's error returned if calls outlast it
+func TestShutdownDeadline(t *testing.T){
+	s := newTestServer()
+	started := make(chan bool,1)
+	release := make(chan bool)
+	defer close(release)
+	s.RegisterRPCContext("add", func(ctx context.Context, conn *Connection, uri string, args ...interface{})(interface{}, *RPCError){
+		started <- true
+		<-release //Never answers in time
+		return 3,nil
+	}, 0)
+	ts := startServer(s)
+	defer ts.Close()
+
+	caller := dial(t, ts, WAMP_V2_JSON_PROTOCOL)
+	defer caller.Close()
+	join(t, caller, nil)
+	send(t, caller, V2_CALL, 1, map[string]interface{}{}, "add", []interface{}{1, 2})
+	<-started
+
+	ctx,cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded{
+		t.Errorf("Shutdown: %v, want context.DeadlineExceeded", err)
+	}
+	if !closedWithin(caller, time.Second){
+		t.Error("socket left open")
+	}
+}
@@ -0,0 +1,353 @@
+package postmaster
+
+import(
+	"strings"
+	"sync"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Subscriptions
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//How a subscription (or permission) pattern is matched against topic URIs
+type MatchPolicy int
+const (
+	MATCH_EXACT MatchPolicy = iota //Pattern is the topic
+	MATCH_PREFIX //Topic starts with pattern ("com.app.orders.")
+	MATCH_WILDCARD //Empty "." separated segments match any one segment ("com.app..created")
+)
+
+//Parses the "match" option used by WAMP v2 (and the v1 extension)
+func parseMatchPolicy(v interface{})(MatchPolicy,bool){
+	switch v{
+	case nil,"exact":
+		return MATCH_EXACT,true
+	case "prefix":
+		return MATCH_PREFIX,true
+	case "wildcard":
+		return MATCH_WILDCARD,true
+	}
+	return MATCH_EXACT,false
+}
+
+func (m MatchPolicy) String() string{
+	switch m{
+	case MATCH_PREFIX:
+		return "prefix"
+	case MATCH_WILDCARD:
+		return "wildcard"
+	}
+	return "exact"
+}
+
+//Subscribers sharing a pattern; one WAMP v2 subscription ID per pattern
+type subscription struct{
+	id WAMPID
+	realm string
+	pattern string
+	match MatchPolicy
+	subscribers map[ConnectionID]bool
+}
+
+//Subscription and a snapshot of its subscribers, safe to use without lock
+type subscriptionMatch struct{
+	id WAMPID
+	realm string
+	pattern string
+	match MatchPolicy
+	subscribers []ConnectionID
+}
+
+//Character trie of prefix subscriptions
+type prefixNode struct{
+	children map[byte]*prefixNode
+	sub *subscription
+}
+
+//Segment trie of wildcard subscriptions; "" child matches any segment
+type wildcardNode struct{
+	children map[string]*wildcardNode
+	sub *subscription
+}
+
+//Subscriptions of one realm
+type realmSubscriptions struct{
+	exact map[string]*subscription
+	prefix *prefixNode
+	wildcard *wildcardNode
+}
+
+//Maps topic patterns to subscribed connections (safe for concurrent access).
+//Publishing resolves all matching subscriptions by walking tries rather than scanning every pattern.
+type subscriptionMap struct{
+	realms map[string]*realmSubscriptions
+	byID map[WAMPID]*subscription
+	lock *sync.RWMutex
+}
+
+func newSubscriptionMap()(*subscriptionMap){
+	return &subscriptionMap{
+		realms: make(map[string]*realmSubscriptions),
+		byID: make(map[WAMPID]*subscription),
+		lock: new(sync.RWMutex),
+	}
+}
+
+//Subscribes a connection, returning the (possibly shared) subscription ID
+func (subMap *subscriptionMap) Add(realm string, pattern string, match MatchPolicy, id ConnectionID)(WAMPID){
+	subMap.lock.Lock()
+	defer subMap.lock.Unlock()
+
+	rs,ok := subMap.realms[realm]
+	if !ok{
+		rs = &realmSubscriptions{
+			exact: make(map[string]*subscription),
+			prefix: &prefixNode{},
+			wildcard: &wildcardNode{},
+		}
+		subMap.realms[realm] = rs
+	}
+
+	sub := rs.find(pattern,match,true)
+	if sub == nil{
+		sub = &subscription{
+			id: newWAMPID(),
+			realm: realm,
+			pattern: pattern,
+			match: match,
+			subscribers: make(map[ConnectionID]bool),
+		}
+		rs.set(sub)
+		subMap.byID[sub.id] = sub
+	}
+	sub.subscribers[id] = true
+
+	return sub.id
+}
+
+//Unsubscribes a connection from a pattern; false if it wasn't subscribed
+func (subMap *subscriptionMap) Remove(realm string, pattern string, match MatchPolicy, id ConnectionID)(bool){
+	subMap.lock.Lock()
+	defer subMap.lock.Unlock()
+
+	rs,ok := subMap.realms[realm]
+	if !ok{
+		return false
+	}
+	return subMap.remove(rs.find(pattern,match,false),id)
+}
+
+//Unsubscribes a connection by subscription ID; false if it wasn't subscribed
+func (subMap *subscriptionMap) RemoveByID(subID WAMPID, id ConnectionID)(bool){
+	subMap.lock.Lock()
+	defer subMap.lock.Unlock()
+
+	return subMap.remove(subMap.byID[subID],id)
+}
+
+//Drops every subscription of a connection
+func (subMap *subscriptionMap) RemoveConnection(id ConnectionID){
+	subMap.lock.Lock()
+	defer subMap.lock.Unlock()
+
+	for _,sub := range subMap.byID{
+		if sub.subscribers[id]{
+			subMap.remove(sub,id)
+		}
+	}
+}
+
+//Subscriptions held by a connection
+func (subMap *subscriptionMap) ForConnection(id ConnectionID)([]subscriptionMatch){
+	subMap.lock.RLock()
+	defer subMap.lock.RUnlock()
+
+	var subs []subscriptionMatch
+	for _,sub := range subMap.byID{
+		if sub.subscribers[id]{
+			subs = append(subs,sub.snapshot())
+		}
+	}
+	return subs
+}
+
+//All subscriptions in realm matching topic
+func (subMap *subscriptionMap) Find(realm string, topic string)([]subscriptionMatch){
+	subMap.lock.RLock()
+	defer subMap.lock.RUnlock()
+
+	rs,ok := subMap.realms[realm]
+	if !ok{
+		return nil
+	}
+
+	var matches []subscriptionMatch
+
+	if sub,ok := rs.exact[topic]; ok{
+		matches = append(matches,sub.snapshot())
+	}
+
+	//Every node on the path spells a prefix of topic
+	node := rs.prefix
+	for i := 0; node != nil; i++{
+		if node.sub != nil{
+			matches = append(matches,node.sub.snapshot())
+		}
+		if i == len(topic){
+			break
+		}
+		node = node.children[topic[i]]
+	}
+
+	//Follow exact and wildcard segments
+	var walk func(n *wildcardNode, segs []string)
+	walk = func(n *wildcardNode, segs []string){
+		if len(segs) == 0{
+			if n.sub != nil{
+				matches = append(matches,n.sub.snapshot())
+			}
+			return
+		}
+		if segs[0] == ""{
+			return //Wildcards match non-empty segments only, and "" children are wildcards
+		}
+		if child,ok := n.children[segs[0]]; ok{
+			walk(child,segs[1:])
+		}
+		if child,ok := n.children[""]; ok{
+			walk(child,segs[1:])
+		}
+	}
+	walk(rs.wildcard,strings.Split(topic,"."))
+
+	return matches
+}
+
+//Removes id from sub, dropping sub once it has no subscribers
+func (subMap *subscriptionMap) remove(sub *subscription, id ConnectionID)(bool){
+	if sub == nil || !sub.subscribers[id]{
+		return false
+	}
+
+	delete(sub.subscribers,id)
+	if len(sub.subscribers) == 0{
+		rs := subMap.realms[sub.realm]
+		rs.clear(sub)
+		delete(subMap.byID,sub.id)
+		if rs.empty(){
+			delete(subMap.realms,sub.realm)
+		}
+	}
+	return true
+}
+
+func (sub *subscription) snapshot()(subscriptionMatch){
+	ids := make([]ConnectionID,0,len(sub.subscribers))
+	for id,_ := range sub.subscribers{
+		ids = append(ids,id)
+	}
+	return subscriptionMatch{id:sub.id, realm:sub.realm, pattern:sub.pattern, match:sub.match, subscribers:ids}
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Returns subscription for pattern (nil if none); with create, builds the trie path on the way
+func (rs *realmSubscriptions) find(pattern string, match MatchPolicy, create bool)(*subscription){
+	switch match{
+	case MATCH_PREFIX:
+		node := rs.prefix
+		for i := 0; i < len(pattern); i++{
+			child,ok := node.children[pattern[i]]
+			if !ok{
+				if !create{
+					return nil
+				}
+				if node.children == nil{
+					node.children = make(map[byte]*prefixNode)
+				}
+				child = &prefixNode{}
+				node.children[pattern[i]] = child
+			}
+			node = child
+		}
+		return node.sub
+	case MATCH_WILDCARD:
+		node := rs.wildcard
+		for _,seg := range strings.Split(pattern,"."){
+			child,ok := node.children[seg]
+			if !ok{
+				if !create{
+					return nil
+				}
+				if node.children == nil{
+					node.children = make(map[string]*wildcardNode)
+				}
+				child = &wildcardNode{}
+				node.children[seg] = child
+			}
+			node = child
+		}
+		return node.sub
+	}
+	return rs.exact[pattern]
+}
+
+//Stores sub at its node (path must exist, see find)
+func (rs *realmSubscriptions) set(sub *subscription){
+	switch sub.match{
+	case MATCH_PREFIX:
+		node := rs.prefix
+		for i := 0; i < len(sub.pattern); i++{
+			node = node.children[sub.pattern[i]]
+		}
+		node.sub = sub
+	case MATCH_WILDCARD:
+		node := rs.wildcard
+		for _,seg := range strings.Split(sub.pattern,"."){
+			node = node.children[seg]
+		}
+		node.sub = sub
+	default:
+		rs.exact[sub.pattern] = sub
+	}
+}
+
+//Removes sub and prunes trie branches left empty
+func (rs *realmSubscriptions) clear(sub *subscription){
+	switch sub.match{
+	case MATCH_PREFIX:
+		var prune func(n *prefixNode, i int)(bool)
+		prune = func(n *prefixNode, i int)(bool){
+			if i == len(sub.pattern){
+				n.sub = nil
+			}else if child,ok := n.children[sub.pattern[i]]; ok && prune(child,i+1){
+				delete(n.children,sub.pattern[i])
+			}
+			return n.sub == nil && len(n.children) == 0
+		}
+		prune(rs.prefix,0)
+	case MATCH_WILDCARD:
+		segs := strings.Split(sub.pattern,".")
+		var prune func(n *wildcardNode, i int)(bool)
+		prune = func(n *wildcardNode, i int)(bool){
+			if i == len(segs){
+				n.sub = nil
+			}else if child,ok := n.children[segs[i]]; ok && prune(child,i+1){
+				delete(n.children,segs[i])
+			}
+			return n.sub == nil && len(n.children) == 0
+		}
+		prune(rs.wildcard,0)
+	default:
+		delete(rs.exact,sub.pattern)
+	}
+}
+
+//Whether the realm has no subscriptions left (tries are pruned as subscriptions are cleared)
+func (rs *realmSubscriptions) empty()(bool){
+	return len(rs.exact) == 0 && rs.prefix.sub == nil && len(rs.prefix.children) == 0 &&
+		rs.wildcard.sub == nil && len(rs.wildcard.children) == 0
+}
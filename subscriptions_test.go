@@ -0,0 +1,197 @@
+package postmaster
+
+import(
+	"sort"
+	"strings"
+	"testing"
+)
+
+//Patterns (exact, "prefix:" or "wildcard:") of the subscriptions matching topic
+func matchedPatterns(subMap *subscriptionMap, realm string, topic string)(string){
+	var patterns []string
+	for _,sub := range subMap.Find(realm,topic){
+		name := sub.pattern
+		if sub.match != MATCH_EXACT{
+			name = sub.match.String() + ":" + name
+		}
+		patterns = append(patterns,name)
+	}
+	sort.Strings(patterns)
+	return strings.Join(patterns," ")
+}
+
+func TestSubscriptionMatching(t *testing.T){
+	subMap := newSubscriptionMap()
+	subs := []struct{
+		pattern string
+		match MatchPolicy
+	}{
+		{"com.app.topic", MATCH_EXACT},
+		{"com.app.", MATCH_PREFIX},
+		{"com.app.top", MATCH_PREFIX},
+		{"com.", MATCH_PREFIX},
+		{"", MATCH_PREFIX},
+		{"com..topic", MATCH_WILDCARD},
+		{"com.app.", MATCH_WILDCARD}, //Last segment empty
+		{"..", MATCH_WILDCARD},
+	}
+	for _,sub := range subs{
+		subMap.Add("realm1", sub.pattern, sub.match, "c")
+	}
+	subMap.Add("realm2", "com.app.topic", MATCH_EXACT, "c")
+
+	tests := []struct{
+		topic string
+		matched string
+	}{
+		{"com.app.topic", "com.app.topic prefix: prefix:com. prefix:com.app. prefix:com.app.top wildcard:.. wildcard:com..topic wildcard:com.app."},
+		{"com.app.other", "prefix: prefix:com. prefix:com.app. wildcard:.. wildcard:com.app."},
+		{"com.news.topic", "prefix: prefix:com. wildcard:.. wildcard:com..topic"},
+		{"com.app.topic.sub", "prefix: prefix:com. prefix:com.app. prefix:com.app.top"},
+		{"com.app", "prefix: prefix:com."},
+		{"com..topic", "prefix: prefix:com."}, //Wildcards match non-empty segments only
+		{"org", "prefix:"},
+		{"", "prefix:"},
+	}
+	for _,test := range tests{
+		if got := matchedPatterns(subMap, "realm1", test.topic); got != test.matched{
+			t.Errorf("%q: matched %q, want %q", test.topic, got, test.matched)
+		}
+	}
+
+	if got := matchedPatterns(subMap, "realm2", "com.app.other"); got != ""{
+		t.Errorf("realm2 matched %q; realms must not share subscriptions", got)
+	}
+	if got := matchedPatterns(subMap, "realm3", "com.app.topic"); got != ""{
+		t.Errorf("unknown realm matched %q", got)
+	}
+}
+
+//Sessions subscribing to the same pattern share its subscription (and WAMP v2 subscription ID)
+func TestSharedSubscription(t *testing.T){
+	subMap := newSubscriptionMap()
+
+	tests := []struct{
+		pattern string
+		match MatchPolicy
+	}{
+		{"com.app.topic", MATCH_EXACT},
+		{"com.app.", MATCH_PREFIX},
+		{"com..topic", MATCH_WILDCARD},
+	}
+	for _,test := range tests{
+		a := subMap.Add("realm1", test.pattern, test.match, "a")
+		b := subMap.Add("realm1", test.pattern, test.match, "b")
+		if a != b{
+			t.Errorf("%q: sessions got subscriptions %d and %d", test.pattern, a, b)
+		}
+		if other := subMap.Add("realm2", test.pattern, test.match, "a"); other == a{
+			t.Errorf("%q: realms share subscription %d", test.pattern, a)
+		}
+		if again := subMap.Add("realm1", test.pattern, test.match, "a"); again != a{
+			t.Errorf("%q: subscribing again changed subscription %d to %d", test.pattern, a, again)
+		}
+
+		//The subscription lasts until its last subscriber leaves
+		if !subMap.RemoveByID(a, "a"){
+			t.Errorf("%q: a not unsubscribed", test.pattern)
+		}
+		if subMap.RemoveByID(a, "a"){
+			t.Errorf("%q: a unsubscribed twice", test.pattern)
+		}
+		found := subMap.Find("realm1", "com.app.topic")
+		shared := false
+		for _,sub := range found{
+			if sub.id == a{
+				shared = len(sub.subscribers) == 1 && sub.subscribers[0] == "b"
+			}
+		}
+		if !shared{
+			t.Errorf("%q: subscription %d lost b: %v", test.pattern, a, found)
+		}
+		if !subMap.Remove("realm1", test.pattern, test.match, "b"){
+			t.Errorf("%q: b not unsubscribed", test.pattern)
+		}
+		if again := subMap.Add("realm1", test.pattern, test.match, "a"); again == a{
+			t.Errorf("%q: subscription %d reused after its subscribers left", test.pattern, a)
+		}
+	}
+}
+
+//Nodes in the prefix & wildcard tries of realm (0 if the realm is gone)
+func trieNodes(subMap *subscriptionMap, realm string)(int){
+	rs,ok := subMap.realms[realm]
+	if !ok{
+		return 0
+	}
+
+	var prefix func(n *prefixNode)(int)
+	prefix = func(n *prefixNode)(int){
+		count := 1
+		for _,child := range n.children{
+			count += prefix(child)
+		}
+		return count
+	}
+	var wildcard func(n *wildcardNode)(int)
+	wildcard = func(n *wildcardNode)(int){
+		count := 1
+		for _,child := range n.children{
+			count += wildcard(child)
+		}
+		return count
+	}
+	return prefix(rs.prefix) + wildcard(rs.wildcard)
+}
+
+func TestSubscriptionPruning(t *testing.T){
+	subMap := newSubscriptionMap()
+	subMap.Add("realm1", "ab", MATCH_PREFIX, "a")
+	subMap.Add("realm1", "a.b", MATCH_WILDCARD, "a")
+	base := trieNodes(subMap, "realm1")
+
+	tests := []struct{
+		name string
+		remove func()
+	}{
+		{"Remove", func(){
+			subMap.Remove("realm1", "abcd", MATCH_PREFIX, "b")
+			subMap.Remove("realm1", "a.b.c.d", MATCH_WILDCARD, "b")
+			subMap.Remove("realm1", "a..c", MATCH_WILDCARD, "b")
+			subMap.Remove("realm1", "topic", MATCH_EXACT, "b")
+		}},
+		{"RemoveConnection", func(){
+			subMap.RemoveConnection("b")
+		}},
+	}
+	for _,test := range tests{
+		subMap.Add("realm1", "abcd", MATCH_PREFIX, "b")
+		subMap.Add("realm1", "a.b.c.d", MATCH_WILDCARD, "b")
+		subMap.Add("realm1", "a..c", MATCH_WILDCARD, "b")
+		subMap.Add("realm1", "topic", MATCH_EXACT, "b")
+		if n := trieNodes(subMap, "realm1"); n != base+6{
+			t.Fatalf("%s: %d trie nodes after subscribing, want %d", test.name, n, base+6)
+		}
+
+		test.remove()
+		if n := trieNodes(subMap, "realm1"); n != base{
+			t.Errorf("%s: %d trie nodes left, want %d", test.name, n, base)
+		}
+		if got := matchedPatterns(subMap, "realm1", "abcd"); got != "prefix:ab"{
+			t.Errorf("%s: abcd matched %q, want prefix:ab", test.name, got)
+		}
+		if got := matchedPatterns(subMap, "realm1", "a.b"); got != "wildcard:a.b"{
+			t.Errorf("%s: a.b matched %q, want wildcard:a.b", test.name, got)
+		}
+	}
+
+	//Realms are dropped with their last subscription
+	subMap.Add("realm2", "topic", MATCH_EXACT, "a")
+	subMap.RemoveConnection("a")
+	if len(subMap.realms) != 0 || len(subMap.byID) != 0{
+		t.Errorf("%d realms & %d subscriptions left", len(subMap.realms), len(subMap.byID))
+	}
+	if subMap.Remove("realm1", "ab", MATCH_PREFIX, "a"){
+		t.Error("removed from a dropped realm")
+	}
+}
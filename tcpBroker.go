@@ -0,0 +1,341 @@
+package postmaster
+
+import(
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"github.com/ugorji/go/codec"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	TCP Peer Mesh Broker
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+const TCP_BROKER_REDIAL = 2*time.Second
+const TCP_BROKER_WRITE_TIMEOUT = 5*time.Second
+const TCP_BROKER_QUEUE = 1024 //Events waiting to be written to each peer; further events are dropped
+
+//Connects postmaster instances in a full mesh over TCP.
+//Every node listens on ListenAddr and dials every address in Peers; events are sent on dialed
+//connections and recieved on accepted ones, so each node should list every other node as a peer.
+//Events are MessagePack encoded BrokerEvents, so []byte payloads stay binary between nodes.
+//
+//Anything that can reach ListenAddr can publish to every realm and topic, so set Secret (and
+//TLSConfig outside a trusted network). A node accepts events from a peer once the peer answers
+//a random challenge with its HMAC-SHA256 under Secret.
+type TCPBroker struct{
+	ListenAddr string
+	Peers []string
+	RedialInterval time.Duration //Wait between attempts to reach a peer (default TCP_BROKER_REDIAL)
+	Secret []byte //Shared by every node; empty accepts any peer
+	TLSConfig *tls.Config //If set, peer connections use TLS (Certificates to listen, RootCAs to dial)
+
+	nodeID string
+	deliver func(*BrokerEvent)
+	listener net.Listener
+	outbound map[string]*tcpPeer //Dialed peer address -> connection (nil while unreachable)
+	inbound map[net.Conn]bool
+	lock *sync.Mutex //Guards everything above
+	done chan struct{}
+}
+
+//Dialed peer; events are written from its queue so a stalled peer doesn't hold up publishers
+type tcpPeer struct{
+	conn net.Conn
+	queue chan []byte
+	closed chan struct{} //Closed once conn is
+}
+
+func NewTCPBroker(listenAddr string, peers ...string)*TCPBroker{
+	return &TCPBroker{
+		ListenAddr: listenAddr,
+		Peers: peers,
+		RedialInterval: TCP_BROKER_REDIAL,
+		outbound: make(map[string]*tcpPeer),
+		inbound: make(map[net.Conn]bool),
+		lock: new(sync.Mutex),
+	}
+}
+
+func (b *TCPBroker) Attach(nodeID string, deliver func(*BrokerEvent)) error{
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.done != nil{
+		return ErrNodeAttached //One node per TCPBroker
+	}
+
+	l,err := net.Listen("tcp",b.ListenAddr)
+	if err != nil{
+		return err
+	}
+	if b.TLSConfig != nil{
+		l = tls.NewListener(l,b.TLSConfig)
+	}
+
+	b.nodeID = nodeID
+	b.deliver = deliver
+	b.listener = l
+	b.done = make(chan struct{})
+
+	go b.accept(l)
+	for _,addr := range b.Peers{
+		b.outbound[addr] = nil
+		go b.dial(addr)
+	}
+
+	log.Info("postmaster: broker node %s listening on %s", nodeID, l.Addr())
+	if len(b.Secret) == 0{
+		log.Warn("postmaster: broker accepts events from any peer that can reach %s; set TCPBroker.Secret", l.Addr())
+	}
+
+	return nil
+}
+
+func (b *TCPBroker) Detach(nodeID string) error{
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.done == nil || nodeID != b.nodeID{
+		return errors.New("postmaster: node not attached to broker")
+	}
+
+	close(b.done)
+	b.listener.Close()
+	for addr,p := range b.outbound{
+		if p != nil{
+			p.conn.Close()
+		}
+		delete(b.outbound,addr)
+	}
+	for c,_ := range b.inbound{
+		c.Close()
+		delete(b.inbound,c)
+	}
+	b.done = nil
+
+	return nil
+}
+
+//Address the broker is listening on (useful when ListenAddr uses port 0)
+func (b *TCPBroker) Addr() net.Addr{
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.listener == nil{
+		return nil
+	}
+	return b.listener.Addr()
+}
+
+//Queues ev for every connected peer; events for a peer whose queue is full are dropped
+func (b *TCPBroker) Publish(ev *BrokerEvent) error{
+	var data []byte
+	if err := codec.NewEncoderBytes(&data,msgpackHandle).Encode(ev); err != nil{
+		return err
+	}
+
+	b.lock.Lock()
+	var peers []*tcpPeer
+	for _,p := range b.outbound{
+		if p != nil{
+			peers = append(peers,p)
+		}
+	}
+	b.lock.Unlock()
+
+	for _,p := range peers{
+		select{
+		case p.queue <- data:
+		default:
+			log.Warn("postmaster: broker queue to %s full, event dropped", p.conn.RemoteAddr())
+		}
+	}
+
+	return nil
+}
+
+//Accepts connections from peers for the life of the listener
+func (b *TCPBroker) accept(l net.Listener){
+	for{
+		c,err := l.Accept()
+		if err != nil{
+			return //Listener closed
+		}
+
+		b.lock.Lock()
+		b.inbound[c] = true
+		b.lock.Unlock()
+
+		go b.recieve(c)
+	}
+}
+
+//Reads events from a peer until the connection closes
+func (b *TCPBroker) recieve(c net.Conn){
+	defer func(){
+		c.Close()
+		b.lock.Lock()
+		delete(b.inbound,c)
+		b.lock.Unlock()
+	}()
+
+	r := bufio.NewReader(c)
+	if !b.challenge(c,r){
+		log.Warn("postmaster: broker rejected peer %s: challenge failed", c.RemoteAddr())
+		return
+	}
+
+	dec := codec.NewDecoder(r,msgpackHandle)
+	for{
+		var ev BrokerEvent
+		if err := dec.Decode(&ev); err != nil{
+			return
+		}
+		//Payload numbers as handlers see them from local clients
+		ev.Event = jsonNumbers(ev.Event)
+		jsonNumbers(ev.Arguments)
+		jsonNumbers(ev.ArgumentsKw)
+
+		//Ignore our own events in case we are listed as our own peer
+		if ev.Origin == b.nodeID{
+			continue
+		}
+		b.deliver(&ev)
+	}
+}
+
+//Keeps an outbound connection to addr open until the broker is detached
+func (b *TCPBroker) dial(addr string){
+	b.lock.Lock()
+	done := b.done
+	b.lock.Unlock()
+
+	for{
+		c,err := b.connect(addr)
+		if err == nil{
+			p := &tcpPeer{conn: c, queue: make(chan []byte,TCP_BROKER_QUEUE), closed: make(chan struct{})}
+
+			b.lock.Lock()
+			if b.done != done{
+				b.lock.Unlock()
+				c.Close()
+				return
+			}
+			b.outbound[addr] = p
+			b.lock.Unlock()
+
+			log.Debug("postmaster: broker connected to peer %s", addr)
+			go b.write(p)
+
+			//Peers never write after the challenge; a read returns once the connection is closed from either end
+			c.Read(make([]byte,1))
+			c.Close()
+			close(p.closed)
+
+			b.lock.Lock()
+			if b.outbound[addr] == p{
+				b.outbound[addr] = nil
+			}
+			b.lock.Unlock()
+		}else{
+			log.Debug("postmaster: broker can't reach peer %s: %s", addr, err)
+		}
+
+		wait := b.RedialInterval
+		if wait <= 0{
+			wait = TCP_BROKER_REDIAL
+		}
+		select{
+		case <-done:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+//Dials addr and answers its challenge
+func (b *TCPBroker) connect(addr string)(net.Conn,error){
+	var c net.Conn
+	var err error
+	if b.TLSConfig != nil{
+		c,err = tls.Dial("tcp",addr,b.TLSConfig)
+	}else{
+		c,err = net.Dial("tcp",addr)
+	}
+	if err != nil{
+		return nil,err
+	}
+
+	c.SetDeadline(time.Now().Add(TCP_BROKER_WRITE_TIMEOUT))
+	nonce,err := bufio.NewReader(c).ReadString('\n') //Peer writes nothing else until we answer
+	if err == nil{
+		_,err = c.Write(append(b.sign(nonce),'\n'))
+	}
+	if err != nil{
+		c.Close()
+		return nil,err
+	}
+	c.SetDeadline(time.Time{})
+
+	return c,nil
+}
+
+//Writes queued events to a peer until its connection closes
+func (b *TCPBroker) write(p *tcpPeer){
+	for{
+		select{
+		case data := <-p.queue:
+			p.conn.SetWriteDeadline(time.Now().Add(TCP_BROKER_WRITE_TIMEOUT))
+			if _,err := p.conn.Write(data); err != nil{
+				log.Error("postmaster: broker error sending to %s: %s", p.conn.RemoteAddr(), err)
+				p.conn.Close() //Dial loop notices and reconnects
+				return
+			}
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+//Sends an accepted peer a random nonce; true if it answers with the nonce signed with Secret
+func (b *TCPBroker) challenge(c net.Conn, r *bufio.Reader)(bool){
+	nonce := make([]byte,32)
+	if _,err := rand.Read(nonce); err != nil{
+		return false
+	}
+	challenge := hex.EncodeToString(nonce) + "\n"
+
+	c.SetDeadline(time.Now().Add(TCP_BROKER_WRITE_TIMEOUT))
+	defer c.SetDeadline(time.Time{})
+
+	if _,err := c.Write([]byte(challenge)); err != nil{
+		return false
+	}
+	answer,err := r.ReadString('\n')
+	if err != nil{
+		return false
+	}
+
+	if len(b.Secret) == 0{
+		return true
+	}
+	return hmac.Equal([]byte(strings.TrimSuffix(answer,"\n")),b.sign(challenge))
+}
+
+//Hex HMAC-SHA256 of a challenge line under Secret
+func (b *TCPBroker) sign(challenge string)([]byte){
+	mac := hmac.New(sha256.New,b.Secret)
+	mac.Write([]byte(strings.TrimSuffix(challenge,"\n")))
+	return []byte(hex.EncodeToString(mac.Sum(nil)))
+}
@@ -0,0 +1,206 @@
+package postmaster
+
+import(
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Attaches a broker listening on a free local port; events it recieves are passed to the returned channel
+func attachBroker(t *testing.T, b *TCPBroker, nodeID string)(chan *BrokerEvent){
+	events := make(chan *BrokerEvent,16)
+	if err := b.Attach(nodeID, func(ev *BrokerEvent){ events <- ev }); err != nil{
+		t.Fatal(err)
+	}
+	return events
+}
+
+//Publishes from b until an event reaches events or 2s pass
+func expectDelivery(t *testing.T, b *TCPBroker, events chan *BrokerEvent)(bool){
+	ev := publishUntilDelivered(b, &BrokerEvent{Origin: "sender", TopicURI: "topic", Event: "hi"}, events)
+	return ev != nil && ev.Event == "hi"
+}
+
+//Publishes ev from b until an event reaches events (returned) or 2s pass (nil)
+func publishUntilDelivered(b *TCPBroker, ev *BrokerEvent, events chan *BrokerEvent)(*BrokerEvent){
+	deadline := time.After(2*time.Second)
+	for{
+		b.Publish(ev)
+		select{
+		case got := <-events:
+			return got
+		case <-deadline:
+			return nil
+		case <-time.After(20*time.Millisecond):
+		}
+	}
+}
+
+func TestTCPBrokerSecret(t *testing.T){
+	tests := []struct{
+		listenerSecret, dialerSecret string
+		delivered bool
+	}{
+		{"s3cret", "s3cret", true},
+		{"s3cret", "wrong", false},
+		{"s3cret", "", false},
+		{"", "anything", true}, //No secret accepts any peer
+	}
+	for _,test := range tests{
+		listener := NewTCPBroker("127.0.0.1:0")
+		listener.Secret = []byte(test.listenerSecret)
+		events := attachBroker(t, listener, "listener")
+
+		dialer := NewTCPBroker("127.0.0.1:0", listener.Addr().String())
+		dialer.Secret = []byte(test.dialerSecret)
+		dialer.RedialInterval = 10*time.Millisecond
+		attachBroker(t, dialer, "sender")
+
+		if got := expectDelivery(t, dialer, events); got != test.delivered{
+			t.Errorf("secrets %q/%q: delivered %t, want %t", test.listenerSecret, test.dialerSecret, got, test.delivered)
+		}
+		dialer.Detach("sender")
+		listener.Detach("listener")
+	}
+}
+
+func TestTCPBrokerTLS(t *testing.T){
+	cert,pool := testCertificate(t)
+
+	listener := NewTCPBroker("127.0.0.1:0")
+	listener.Secret = []byte("s3cret")
+	listener.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	events := attachBroker(t, listener, "listener")
+	defer listener.Detach("listener")
+
+	dialer := NewTCPBroker("127.0.0.1:0", listener.Addr().String())
+	dialer.Secret = []byte("s3cret")
+	dialer.TLSConfig = &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}}
+	dialer.RedialInterval = 10*time.Millisecond
+	attachBroker(t, dialer, "sender")
+	defer dialer.Detach("sender")
+
+	if !expectDelivery(t, dialer, events){
+		t.Fatal("event not delivered over TLS")
+	}
+}
+
+//Events arrive on other nodes as published: binary payloads stay []byte, strings stay strings and
+//numbers are float64
+func TestTCPBrokerPayload(t *testing.T){
+	listener := NewTCPBroker("127.0.0.1:0")
+	events := attachBroker(t, listener, "listener")
+	defer listener.Detach("listener")
+
+	dialer := NewTCPBroker("127.0.0.1:0", listener.Addr().String())
+	dialer.RedialInterval = 10*time.Millisecond
+	attachBroker(t, dialer, "sender")
+	defer dialer.Detach("sender")
+
+	ev := &BrokerEvent{
+		Origin: "sender",
+		Realm: "realm1",
+		TopicURI: "topic",
+		Event: []byte("hi"),
+		Arguments: []interface{}{[]byte{0, 255}, "\x00aGk=", float64(3), 2.5, nil, []interface{}{[]byte{}}},
+		ArgumentsKw: map[string]interface{}{"b": []byte("x"), "n": float64(-1), "m": map[string]interface{}{"s": "t"}},
+		ExcludeList: []string{"1"},
+		EligibleList: []string{}, //Nobody, not everybody
+		Publication: 42,
+		Retain: true,
+	}
+	got := publishUntilDelivered(dialer, ev, events)
+	if got == nil{
+		t.Fatal("event not delivered")
+	}
+	if !reflect.DeepEqual(got, ev){
+		t.Errorf("delivered %#v, want %#v", got, ev)
+	}
+}
+
+//A peer that stops reading must not hold up Publish
+func TestTCPBrokerStalledPeer(t *testing.T){
+	l,err := net.Listen("tcp","127.0.0.1:0")
+	if err != nil{
+		t.Fatal(err)
+	}
+	defer l.Close()
+	connected := make(chan net.Conn,1)
+	go func(){
+		c,err := l.Accept()
+		if err != nil{
+			return
+		}
+		c.Write([]byte("nonce\n"))
+		bufio.NewReader(c).ReadString('\n') //Answer; then never read again
+		connected <- c
+	}()
+
+	b := NewTCPBroker("127.0.0.1:0", l.Addr().String())
+	attachBroker(t, b, "sender")
+	defer b.Detach("sender")
+
+	var stalled net.Conn
+	select{
+	case stalled = <-connected:
+		defer stalled.Close()
+	case <-time.After(2*time.Second):
+		t.Fatal("broker didn't connect")
+	}
+	waitFor(t, "peer connection", func()(bool){
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		return b.outbound[l.Addr().String()] != nil
+	})
+
+	//Enough to fill the socket buffers and the queue
+	ev := &BrokerEvent{Origin: "sender", TopicURI: "topic", Event: strings.Repeat("x",16*1024)}
+	done := make(chan bool)
+	go func(){
+		for i := 0; i < TCP_BROKER_QUEUE+512; i++{
+			b.Publish(ev)
+		}
+		close(done)
+	}()
+	select{
+	case <-done:
+	case <-time.After(10*time.Second):
+		t.Fatal("Publish blocked on a stalled peer")
+	}
+}
+
+//Self-signed certificate for 127.0.0.1 and a pool trusting it
+func testCertificate(t *testing.T)(tls.Certificate,*x509.CertPool){
+	key,err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil{
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der,err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil{
+		t.Fatal(err)
+	}
+	parsed,err := x509.ParseCertificate(der)
+	if err != nil{
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(parsed)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},pool
+}
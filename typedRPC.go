@@ -0,0 +1,275 @@
+package postmaster
+
+import(
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Typed Procedures
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+var ErrNotFunc = errors.New("postmaster: typed procedure must be a function")
+var ErrBadResults = errors.New("postmaster: typed procedure must return at most a result and an error")
+var ErrNoContext = errors.New("postmaster: typed procedure with a timeout must take a context.Context first")
+
+var (
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	connectionType = reflect.TypeOf((*Connection)(nil))
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+	rpcErrorType = reflect.TypeOf((*RPCError)(nil))
+)
+
+/*
+	Registers any Go function as a procedure for authenticated clients. Call arguments are decoded into
+	its parameter types (anything encoding/json can decode into: numbers, strings, structs, slices,
+	maps, time.Time...). A call with the wrong number or type of arguments gets an invalid argument error.
+
+	fn may start with a context.Context and/or *Connection parameter; with a context it runs concurrently
+	like a RegisterRPCContext handler that never times out (see RegisterTypedRPCContext). It returns at most a result and an error (error or *RPCError);
+	a plain error is sent as a runtime error with its message as description.
+
+		server.RegisterTypedRPC(baseURL+"add", func(a, b int)(int){ return a+b })
+		server.RegisterTypedRPC(baseURL+"order", func(conn *postmaster.Connection, o Order)(*Receipt,error){ ... })
+*/
+func (t *Server) RegisterTypedRPC(uri string, fn interface{})(error){
+	hook,err := newTypedHook(fn)
+	if err != nil{
+		return err
+	}
+
+	t.hookLock.Lock()
+	t.rpcHooks[uri] = hook
+	t.hookLock.Unlock()
+	return nil
+}
+
+//Registers a typed procedure available before authentication (see RegisterTypedRPC)
+func (t *Server) RegisterUnauthTypedRPC(uri string, fn interface{})(error){
+	hook,err := newTypedHook(fn)
+	if err != nil{
+		return err
+	}
+
+	t.hookLock.Lock()
+	t.unauthRPCHooks[uri] = hook
+	t.hookLock.Unlock()
+	return nil
+}
+
+//Registers a typed procedure taking a context.Context (ErrNoContext otherwise) for authenticated clients.
+//Calls that haven't answered within timeout (0 never times out) get a timeout error, as with RegisterRPCContext.
+func (t *Server) RegisterTypedRPCContext(uri string, fn interface{}, timeout time.Duration)(error){
+	hook,err := newTypedContextHook(fn, timeout)
+	if err != nil{
+		return err
+	}
+
+	t.hookLock.Lock()
+	t.rpcHooks[uri] = hook
+	t.hookLock.Unlock()
+	return nil
+}
+
+//Registers a typed procedure with a timeout available before authentication (see RegisterTypedRPCContext)
+func (t *Server) RegisterUnauthTypedRPCContext(uri string, fn interface{}, timeout time.Duration)(error){
+	hook,err := newTypedContextHook(fn, timeout)
+	if err != nil{
+		return err
+	}
+
+	t.hookLock.Lock()
+	t.unauthRPCHooks[uri] = hook
+	t.hookLock.Unlock()
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Typed Procedure Utility Functions
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Function checked once at registration
+type typedProc struct{
+	fn reflect.Value
+	withCtx bool //First parameter is context.Context
+	withConn bool //Takes *Connection (after the context, if any)
+	params []reflect.Type //Parameters filled from call arguments (last is a slice if variadic)
+	variadic bool
+	hasResult bool
+	hasErr bool //Last result is error or *RPCError
+}
+
+func newTypedHook(fn interface{})(*rpcHook,error){
+	v := reflect.ValueOf(fn)
+	if v.Kind() != reflect.Func || v.IsNil(){
+		return nil,ErrNotFunc
+	}
+	ft := v.Type()
+	p := &typedProc{fn: v, variadic: ft.IsVariadic()}
+
+	//Injected parameters
+	i := 0
+	if i < ft.NumIn() && ft.In(i) == contextType{
+		p.withCtx = true
+		i++
+	}
+	if i < ft.NumIn() && ft.In(i) == connectionType{
+		p.withConn = true
+		i++
+	}
+	for ; i < ft.NumIn(); i++{
+		p.params = append(p.params,ft.In(i))
+	}
+
+	//Results: (), (result), (err), (result, err)
+	switch ft.NumOut(){
+	case 0:
+	case 1:
+		if isErrType(ft.Out(0)){
+			p.hasErr = true
+		}else{
+			p.hasResult = true
+		}
+	case 2:
+		if !isErrType(ft.Out(1)){
+			return nil,ErrBadResults
+		}
+		p.hasResult,p.hasErr = true,true
+	default:
+		return nil,ErrBadResults
+	}
+
+	if p.withCtx{
+		return &rpcHook{cf: p.call},nil
+	}
+	return &rpcHook{f: func(conn *Connection, uri string, args ...interface{})(interface{}, *RPCError){
+		return p.call(context.Background(), conn, uri, args...)
+	}},nil
+}
+
+func newTypedContextHook(fn interface{}, timeout time.Duration)(*rpcHook,error){
+	hook,err := newTypedHook(fn)
+	if err != nil{
+		return nil,err
+	}
+	if hook.cf == nil{
+		return nil,ErrNoContext
+	}
+	hook.timeout = timeout
+	return hook,nil
+}
+
+func isErrType(t reflect.Type)(bool){
+	return t == errorType || t == rpcErrorType
+}
+
+//Decodes the call arguments, calls the function and converts its results
+func (p *typedProc) call(ctx context.Context, conn *Connection, uri string, args ...interface{})(interface{}, *RPCError){
+	//Arity
+	fixed := len(p.params)
+	if p.variadic{
+		fixed--
+	}
+	if len(args) < fixed || (!p.variadic && len(args) > fixed){
+		want := fmt.Sprintf("%d",fixed)
+		if p.variadic{
+			want = fmt.Sprintf("at least %d",fixed)
+		}
+		return nil,invalidArgument(conn, uri, fmt.Sprintf("%s takes %s arguments, got %d", uri, want, len(args)))
+	}
+
+	in := make([]reflect.Value,0,len(args)+2)
+	if p.withCtx{
+		in = append(in,reflect.ValueOf(ctx))
+	}
+	if p.withConn{
+		in = append(in,reflect.ValueOf(conn))
+	}
+	for i,arg := range args{
+		typ := p.paramType(i)
+		v,err := decodeArg(arg,typ)
+		if err != nil{
+			return nil,invalidArgument(conn, uri, fmt.Sprintf("argument %d: %s", i+1, err))
+		}
+		in = append(in,v)
+	}
+
+	out := p.fn.Call(in)
+
+	if p.hasErr{
+		if err := out[len(out)-1]; !err.IsNil(){
+			if rpcErr := toRPCError(conn, err.Interface()); rpcErr != nil{
+				return nil,rpcErr
+			}
+		}
+	}
+	if p.hasResult{
+		return out[0].Interface(),nil
+	}
+	return nil,nil
+}
+
+//Type call argument i is decoded into
+func (p *typedProc) paramType(i int)(reflect.Type){
+	if p.variadic && i >= len(p.params)-1{
+		return p.params[len(p.params)-1].Elem()
+	}
+	return p.params[i]
+}
+
+//Converts a decoded JSON value to typ. Values that already fit are used as is; anything else is
+//re-encoded and unmarshalled into typ.
+func decodeArg(arg interface{}, typ reflect.Type)(reflect.Value,error){
+	if arg != nil{
+		if v := reflect.ValueOf(arg); v.Type().AssignableTo(typ){
+			return v,nil
+		}
+	}
+
+	b,err := json.Marshal(arg)
+	if err != nil{
+		return reflect.Value{},err
+	}
+
+	v := reflect.New(typ)
+	if err := json.Unmarshal(b,v.Interface()); err != nil{
+		if e,ok := err.(*json.UnmarshalTypeError); ok{
+			if e.Field != ""{
+				return reflect.Value{},fmt.Errorf("field %s: cannot use %s as %s", e.Field, e.Value, e.Type)
+			}
+			return reflect.Value{},fmt.Errorf("cannot use %s as %s", e.Value, e.Type)
+		}
+		return reflect.Value{},err
+	}
+	return v.Elem(),nil
+}
+
+//Error for call arguments that don't fit the procedure
+func invalidArgument(conn *Connection, uri string, desc string)(*RPCError){
+	log.Debug("postmaster: invalid arguments for %s: %s", uri, desc)
+	if conn.version == 2{
+		return &RPCError{URI:V2_ERROR_INVALID_ARGUMENT, Description:desc, Details:uri}
+	}
+	return &RPCError{URI:ERROR_INVALID_ARGUMENT, Description:desc, Details:uri}
+}
+
+//Error returned by a typed procedure; *RPCError is passed through
+func toRPCError(conn *Connection, err interface{})(*RPCError){
+	switch e := err.(type){
+	case *RPCError:
+		if e != nil{
+			return e
+		}
+	case error:
+		return runtimeError(conn, e.Error())
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package postmaster
+
+import(
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testOrder struct{
+	Item string
+	Qty int
+	Due time.Time
+}
+
+type ctxKey struct{}
+
+//Calls a typed hook the way callHook does
+func callTyped(hook *rpcHook, ctx context.Context, conn *Connection, args ...interface{})(interface{}, *RPCError){
+	if hook.cf != nil{
+		return hook.cf(ctx, conn, "proc", args...)
+	}
+	return hook.f(conn, "proc", args...)
+}
+
+func TestTypedRPC(t *testing.T){
+	due := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var nilRPCError *RPCError
+
+	tests := []struct{
+		name string
+		fn interface{}
+		args []interface{} //As decoded from JSON
+		result interface{}
+		err string //Error URI for v1 callers; "" for none
+	}{
+		//Decoding
+		{"numbers", func(a, b int)(int){ return a+b }, []interface{}{float64(1), float64(2)}, 3, ""},
+		{"float kept", func(a float64)(float64){ return a }, []interface{}{3.5}, 3.5, ""},
+		{"numeric mismatch", func(a int)(int){ return a }, []interface{}{3.5}, nil, ERROR_INVALID_ARGUMENT},
+		{"string for int", func(a int)(int){ return a }, []interface{}{"3"}, nil, ERROR_INVALID_ARGUMENT},
+		{"struct", func(o testOrder)(testOrder){ return o },
+			[]interface{}{map[string]interface{}{"Item": "pen", "Qty": float64(2), "Due": "2024-05-01T12:00:00Z"}},
+			testOrder{"pen", 2, due}, ""},
+		{"struct field mismatch", func(o testOrder)(int){ return o.Qty },
+			[]interface{}{map[string]interface{}{"Qty": "two"}}, nil, ERROR_INVALID_ARGUMENT},
+		{"slice", func(xs []int)(int){ return len(xs) }, []interface{}{[]interface{}{float64(1), float64(2), float64(3)}}, 3, ""},
+		{"time", func(d time.Time)(time.Time){ return d }, []interface{}{"2024-05-01T12:00:00Z"}, due, ""},
+		{"bad time", func(d time.Time)(time.Time){ return d }, []interface{}{"tomorrow"}, nil, ERROR_INVALID_ARGUMENT},
+		{"null pointer", func(o *testOrder)(bool){ return o == nil }, []interface{}{nil}, true, ""},
+		{"interface kept", func(v interface{})(interface{}){ return v }, []interface{}{map[string]interface{}{"a": "b"}}, map[string]interface{}{"a": "b"}, ""},
+
+		//Arity
+		{"too few", func(a, b int)(int){ return a+b }, []interface{}{float64(1)}, nil, ERROR_INVALID_ARGUMENT},
+		{"too many", func(a, b int)(int){ return a+b }, []interface{}{float64(1), float64(2), float64(3)}, nil, ERROR_INVALID_ARGUMENT},
+		{"no arguments", func()(string){ return "ok" }, nil, "ok", ""},
+		{"variadic none", func(xs ...int)(int){ return len(xs) }, nil, 0, ""},
+		{"variadic", func(sep string, xs ...int)(int){ return len(sep)+len(xs) }, []interface{}{"-", float64(1), float64(2)}, 3, ""},
+		{"variadic too few", func(sep string, xs ...int)(int){ return 0 }, nil, nil, ERROR_INVALID_ARGUMENT},
+		{"variadic mismatch", func(xs ...int)(int){ return 0 }, []interface{}{float64(1), "two"}, nil, ERROR_INVALID_ARGUMENT},
+
+		//Injected parameters
+		{"context", func(ctx context.Context, a int)(interface{}){ return ctx.Value(ctxKey{}) }, []interface{}{float64(1)}, "ctx", ""},
+		{"connection", func(conn *Connection)(ConnectionID){ return conn.id }, nil, ConnectionID("c"), ""},
+		{"context and connection", func(ctx context.Context, conn *Connection, a int)(string){
+			return ctx.Value(ctxKey{}).(string) + string(conn.id)
+		}, []interface{}{float64(1)}, "ctxc", ""},
+
+		//Results
+		{"no results", func(){}, nil, nil, ""},
+		{"nil error", func()(error){ return nil }, nil, nil, ""},
+		{"plain error", func()(int, error){ return 0, errors.New("broken") }, nil, nil, ERROR_RUNTIME},
+		{"RPCError", func()(int, *RPCError){ return 0, &RPCError{URI: "app.error.custom"} }, nil, nil, "app.error.custom"},
+		{"typed nil RPCError", func()(int, *RPCError){ return 1, nil }, nil, 1, ""},
+		{"typed nil RPCError as error", func()(int, error){ return 1, nilRPCError }, nil, 1, ""},
+	}
+	s := NewServer()
+	for _,test := range tests{
+		hook,err := newTypedHook(test.fn)
+		if err != nil{
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		conn := newConnection(s, "c", nil)
+		ctx := context.WithValue(context.Background(), ctxKey{}, "ctx")
+
+		res,rpcErr := callTyped(hook, ctx, conn, test.args...)
+		switch{
+		case test.err != "":
+			if rpcErr == nil || rpcErr.URI != test.err{
+				t.Errorf("%s: error %+v, want %s", test.name, rpcErr, test.err)
+			}
+		case rpcErr != nil:
+			t.Errorf("%s: unexpected error %+v", test.name, rpcErr)
+		case !reflect.DeepEqual(res, test.result):
+			t.Errorf("%s: result %#v, want %#v", test.name, res, test.result)
+		}
+	}
+}
+
+//v2 callers get the v2 error URIs
+func TestTypedRPCErrorsV2(t *testing.T){
+	tests := []struct{
+		fn interface{}
+		args []interface{}
+		err string
+	}{
+		{func(a int)(int){ return a }, []interface{}{3.5}, V2_ERROR_INVALID_ARGUMENT},
+		{func(a int)(int){ return a }, nil, V2_ERROR_INVALID_ARGUMENT},
+		{func()(error){ return errors.New("broken") }, nil, V2_ERROR_RUNTIME},
+	}
+	conn := newConnection(NewServer(), "c", nil)
+	conn.version = 2
+	for i,test := range tests{
+		hook,err := newTypedHook(test.fn)
+		if err != nil{
+			t.Fatal(err)
+		}
+		if _,rpcErr := callTyped(hook, context.Background(), conn, test.args...); rpcErr == nil || rpcErr.URI != test.err{
+			t.Errorf("%d: error %+v, want %s", i, rpcErr, test.err)
+		}
+	}
+}
+
+func TestTypedRPCRegistration(t *testing.T){
+	tests := []struct{
+		name string
+		fn interface{}
+		concurrent bool
+		err error
+	}{
+		{"not a function", 42, false, ErrNotFunc},
+		{"nil function", (func())(nil), false, ErrNotFunc},
+		{"result not last", func()(error, int){ return nil, 0 }, false, ErrBadResults},
+		{"too many results", func()(int, int, error){ return 0, 0, nil }, false, ErrBadResults},
+		{"inline", func(conn *Connection, a int){}, false, nil},
+		{"context", func(ctx context.Context, conn *Connection){}, true, nil},
+		{"context not first", func(conn *Connection, ctx context.Context){}, false, nil}, //ctx decoded as an argument
+	}
+	for _,test := range tests{
+		hook,err := newTypedHook(test.fn)
+		if err != test.err{
+			t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if err == nil && (hook.cf != nil) != test.concurrent{
+			t.Errorf("%s: concurrent %t, want %t", test.name, hook.cf != nil, test.concurrent)
+		}
+	}
+
+	s := NewServer()
+	if err := s.RegisterTypedRPCContext("proc", func(a int){}, time.Second); err != ErrNoContext{
+		t.Errorf("RegisterTypedRPCContext without context: %v, want ErrNoContext", err)
+	}
+	if err := s.RegisterTypedRPCContext("proc", func(ctx context.Context){}, time.Second); err != nil{
+		t.Fatal(err)
+	}
+	if hook,_ := s.getHook("proc", false); hook == nil || hook.timeout != time.Second{
+		t.Errorf("hook %+v, want a 1s timeout", hook)
+	}
+}
+
+//Values that already fit are passed as is; anything else goes through encoding/json
+func TestDecodeArg(t *testing.T){
+	tests := []struct{
+		arg interface{}
+		typ reflect.Type
+		want interface{}
+		ok bool
+	}{
+		{"s", reflect.TypeOf(""), "s", true},
+		{[]byte("raw"), reflect.TypeOf([]byte(nil)), []byte("raw"), true}, //Binary args (msgpack, v2 JSON) kept
+		{int64(7), reflect.TypeOf(0), 7, true}, //msgpack integers
+		{float64(7), reflect.TypeOf(int8(0)), int8(7), true},
+		{float64(300), reflect.TypeOf(int8(0)), nil, false},
+		{float64(-1), reflect.TypeOf(uint(0)), nil, false},
+		{[]interface{}{"a", "b"}, reflect.TypeOf([]string(nil)), []string{"a", "b"}, true},
+		{map[string]interface{}{"k": float64(1)}, reflect.TypeOf(map[string]int(nil)), map[string]int{"k": 1}, true},
+		{nil, reflect.TypeOf(0), 0, true},
+		{true, reflect.TypeOf(""), nil, false},
+	}
+	for _,test := range tests{
+		v,err := decodeArg(test.arg, test.typ)
+		if (err == nil) != test.ok{
+			t.Errorf("decodeArg(%#v, %s): error %v, ok want %t", test.arg, test.typ, err, test.ok)
+			continue
+		}
+		if test.ok && !reflect.DeepEqual(v.Interface(), test.want){
+			t.Errorf("decodeArg(%#v, %s) = %#v, want %#v", test.arg, test.typ, v.Interface(), test.want)
+		}
+	}
+}
+
+//Typed procedures with a context get the timeout error like RegisterRPCContext handlers
+func TestTypedRPCTimeout(t *testing.T){
+	s := newTestServer()
+	cancelled := make(chan error,1)
+	err := s.RegisterTypedRPCContext("add", func(ctx context.Context, a, b int)(int, error){
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return 0, ctx.Err()
+	}, 50*time.Millisecond)
+	if err != nil{
+		t.Fatal(err)
+	}
+	ts := startServer(s)
+	defer ts.Close()
+
+	ws := dial(t, ts, WAMP_V2_JSON_PROTOCOL)
+	defer ws.Close()
+	join(t, ws, nil)
+	send(t, ws, V2_CALL, 1, map[string]interface{}{}, "add", []interface{}{1, 2})
+	if msg := recv(t, ws); msg[0] != float64(V2_ERROR) || msg[4] != V2_ERROR_TIMEOUT{
+		t.Errorf("expected %s, got %v", V2_ERROR_TIMEOUT, msg)
+	}
+	if err := <-cancelled; err != context.DeadlineExceeded{
+		t.Errorf("ctx error %v, want DeadlineExceeded", err)
+	}
+	recvNothing(t, ws)
+}
@@ -1,7 +1,12 @@
 package postmaster
 
 import(
+	"context"
+	"io"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 ///////////////////////////////////////////////////////////////////////////////////////
@@ -16,14 +21,258 @@ import(
 
 type ConnectionID string
 
+//What to do when a connection's outbound queue is full
+type SlowConsumerPolicy int
+const (
+	BLOCK_WITH_TIMEOUT SlowConsumerPolicy = iota //Wait for room up to Server.SendTimeout, then drop
+	DROP_NEWEST //Drop the message being sent
+	DROP_OLDEST //Drop the oldest queued message to make room
+	DISCONNECT_AFTER_DROPS //Drop the message being sent; disconnect once Server.MaxDrops is exceeded
+)
+
+//Default Server.SendTimeout; keeps one stalled client from holding up publishers for long
+const SEND_TIMEOUT = 100*time.Millisecond
+
+//Where a connection is in authentication (see authTransitions in auth.go)
+type AuthState int
+const (
+	AUTH_STATE_NONE AuthState = iota //Connected; may call authreq
+	AUTH_STATE_PENDING //Challenge sent; waiting on auth
+	AUTH_STATE_AUTHENTICATED
+	AUTH_STATE_FAILED //Attempts exhausted or auth deadline passed; connection is being closed
+)
+
+func (s AuthState) String() string{
+	switch s{
+	case AUTH_STATE_PENDING:
+		return "pending"
+	case AUTH_STATE_AUTHENTICATED:
+		return "authenticated"
+	case AUTH_STATE_FAILED:
+		return "failed"
+	}
+	return "none"
+}
+
 type Connection struct{
-	out chan string
-	pendingAuth *PendingAuth //Set in between authreq & auth (values kept after sucessful auth for later use)
-	isAuth bool //Has this client been authenticated (only allow authreq/auth rpc call if not)
+	drops uint64 //Messages dropped by slow consumer policy (first for atomic alignment)
+	
+	out chan []byte //Encoded messages; may be shared between connections, never modified
+	done chan struct{} //Closed when the connection is unregistered; unblocks senders
+	closing chan struct{} //Closed to have the sender flush queued messages, then close the socket
+	ws io.Closer //Underlying socket
+	closeOnce *sync.Once
+	closingOnce *sync.Once
+	policy SlowConsumerPolicy
+	maxDrops int
+	sendTimeout time.Duration //Negative waits forever
+	server *Server //Server the connection belongs to
 	id ConnectionID //Used internally
+	version int //WAMP protocol version spoken by client
+	serializer Serializer //Encoding negotiated with the client (JSON for v1)
+	realm string //Realm the session belongs to (Server.V1Realm for v1 sessions)
+	prefixes map[string]string //CURIE prefix -> URI (set by client PREFIX messages)
+	remoteAddr string //Client host, used for lockout tracking
+	ctx context.Context //Cancelled when the connection closes; parent of RPC handler contexts
+	cancel context.CancelFunc
+	inflight chan struct{} //Slots for concurrently running RPC handlers
+	grantLock *sync.Mutex //Serializes subscribing & registering against permission changes (see Server.SetPermissions)
+	
+	lock *sync.RWMutex //Guards authState, authFailures, pendingAuth, username & perms
+	authState AuthState //Only authreq/auth rpc calls are allowed until AUTH_STATE_AUTHENTICATED
+	authFailures int //Failed authreq/auth calls
+	authTimer *time.Timer //Closes the connection if it isn't authenticated in time (nil if no deadline)
+	pendingAuth *PendingAuth //Set in AUTH_STATE_PENDING (values kept after sucessful auth for later use)
+	username string //Set when authenticated (see Username)
+	perms *Permissions //Permission for this client (see Permissions)
+}
+
+func newConnection(t *Server, id ConnectionID, ws io.Closer)(*Connection){
+	backlog := t.Backlog
+	if backlog <= 0{
+		backlog = ALLOWED_BACKLOG
+	}
+	maxCalls := t.MaxCallsInFlight
+	if maxCalls <= 0{
+		maxCalls = MAX_CALLS_IN_FLIGHT
+	}
+	sendTimeout := t.SendTimeout
+	if sendTimeout == 0{
+		sendTimeout = SEND_TIMEOUT
+	}
+	ctx,cancel := context.WithCancel(context.Background())
+	
+	return &Connection{
+		out: make(chan []byte, backlog),
+		done: make(chan struct{}),
+		closing: make(chan struct{}),
+		ws: ws,
+		closeOnce: new(sync.Once),
+		closingOnce: new(sync.Once),
+		policy: t.SlowConsumer,
+		maxDrops: t.MaxDrops,
+		sendTimeout: sendTimeout,
+		server: t,
+		id: id,
+		version: PROTOCOL_VERSION,
+		serializer: v1Serializer{},
+		prefixes: make(map[string]string),
+		ctx: ctx,
+		cancel: cancel,
+		inflight: make(chan struct{}, maxCalls),
+		grantLock: new(sync.Mutex),
+		lock: new(sync.RWMutex),
+	}
+}
+
+//Queues a message for the connection according to its slow consumer policy.
+//Returns false if the message was dropped or the connection has gone away.
+func (c *Connection) send(msg []byte)(bool){
+	//Fast path: room in queue
+	select{
+	case c.out <- msg:
+		return true
+	case <-c.done:
+		return false
+	default:
+	}
 	
-	Username string
-	P *Permissions //Permission for this client
+	switch c.policy{
+	case DROP_NEWEST:
+		c.drop()
+		return false
+	case DROP_OLDEST:
+		for{
+			select{
+			case <-c.done:
+				return false
+			case <-c.out:
+				c.drop() //Discard oldest and try again
+			default:
+			}
+			
+			//Take the freed slot before dropping another
+			select{
+			case c.out <- msg:
+				return true
+			case <-c.done:
+				return false
+			default:
+			}
+		}
+	case DISCONNECT_AFTER_DROPS:
+		if c.drop() > uint64(c.maxDrops){
+			log.Warn("postmaster: disconnecting slow consumer %s", c.id)
+			c.close()
+		}
+		return false
+	default: //BLOCK_WITH_TIMEOUT
+		var timeout <-chan time.Time
+		if c.sendTimeout > 0{
+			timer := time.NewTimer(c.sendTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		
+		select{
+		case c.out <- msg:
+			return true
+		case <-c.done:
+			return false
+		case <-timeout:
+			c.drop()
+			return false
+		}
+	}
+}
+
+//Encodes msg with the connection's serializer and queues it (see send)
+func (c *Connection) sendMessage(msg wampMessage)(bool){
+	out,err := serialize(c.serializer, msg)
+	if err != nil{
+		log.Error("postmaster: error encoding message for %s: %s", c.id, err)
+		return false
+	}
+	return c.send(out)
+}
+
+//Counts a dropped message; returns total drops
+func (c *Connection) drop()(uint64){
+	return atomic.AddUint64(&c.drops,1)
+}
+
+//Number of outbound messages dropped because the client could not keep up
+func (c *Connection) Drops()(uint64){
+	return atomic.LoadUint64(&c.drops)
+}
+
+//Closes the underlying socket; the connection is unregistered once its reciever exits
+func (c *Connection) close(){
+	c.closeOnce.Do(func(){
+		c.cancel()
+		if c.ws != nil{
+			c.ws.Close()
+		}
+	})
+}
+
+//Closes the socket once messages already queued have been sent
+func (c *Connection) closeAfterFlush(){
+	c.closingOnce.Do(func(){
+		close(c.closing)
+	})
+}
+
+//Session ID (sent to the client in WELCOME)
+func (c *Connection) ID()(ConnectionID){
+	return c.id
+}
+
+//Host the client connected from
+func (c *Connection) RemoteAddr()(string){
+	return c.remoteAddr
+}
+
+//Whether the client has completed authentication
+func (c *Connection) authenticated()(bool){
+	return c.AuthState() == AUTH_STATE_AUTHENTICATED
+}
+
+//Current authentication state of the client
+func (c *Connection) AuthState()(AuthState){
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.authState
+}
+
+//Name the client authenticated as ("" until authenticated)
+func (c *Connection) Username()(string){
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.username
+}
+
+//Permissions granted to the client (nil until authenticated). Don't modify them; they are shared
+//with the server, which replaces them with Server.SetPermissions.
+func (c *Connection) Permissions()(*Permissions){
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.perms
+}
+
+//Expands a CURIE (prefix:reference) using the prefixes registered on this connection.
+//URIs with an unknown prefix are returned unchanged.
+func (c *Connection) expandURI(uri string)(string){
+	i := strings.Index(uri,":")
+	if i <= 0{
+		return uri
+	}
+	
+	if base,ok := c.prefixes[uri[:i]]; ok{
+		return base + uri[i+1:]
+	}
+	
+	return uri
 }
 
 //
@@ -33,10 +282,9 @@ type Connection struct{
 type PendingAuth struct{
 	authKey string
 	authExtra map[string]interface{}
-	sig string
+	auth Authenticator //Method chosen by authreq (nil for v2 sessions)
+	req *AuthRequest //Includes challenge sent to client
 	p Permissions
-	ch []byte //Challenge in json form
-	
 }
 
 type Permissions struct{
@@ -44,11 +292,19 @@ type Permissions struct{
 	PubSub map[string] PubSubPermission //maps uri to PubSubPermission
 }
 
-type RPCPermission bool
+type RPCPermission struct{
+	CanCall bool
+	CanRegister bool //Client may register (implement) the procedure
+	Match MatchPolicy //MATCH_PREFIX/MATCH_WILDCARD entries apply to every matching procedure
+	Deny bool //Refuse matching procedures (see Permissions precedence in permissions.go)
+}
 
 type PubSubPermission struct{
 	CanPublish bool
 	CanSubscribe bool
+	CanRetain bool //With CanPublish, events may be kept for later subscribers with the v2 PUBLISH "retain" option
+	Match MatchPolicy //MATCH_PREFIX/MATCH_WILDCARD entries apply to every matching topic
+	Deny bool //Refuse matching topics (see Permissions precedence in permissions.go)
 }
 
 //
@@ -58,51 +314,10 @@ type PubSubPermission struct{
 type PublishIntercept func(id *Connection, msg PublishMsg)(bool)
 type RPCHandler func(*Connection, string, ...interface{}) (interface{}, *RPCError)
 
-type subscriptionMap struct{
-	data map[string] (map[ConnectionID]bool) //Allows concurrent access
-	lock *sync.RWMutex
-}
-
-func (subMap *subscriptionMap) Find(uri string)([]ConnectionID,bool){
-	subMap.lock.RLock()
-	idMap,ok := subMap.data[uri]
-	subMap.lock.RUnlock()
-	
-	//Convert map to slice of keys
-	var keys []ConnectionID
-	for key,_ := range idMap{
-		keys = append(keys,key)
-	}
-	
-	return keys,ok
-}
-
-func (subMap *subscriptionMap) Add(uri string, id ConnectionID){
-	subMap.lock.Lock()
-	idMap,ok := subMap.data[uri]
-	
-	if !ok{
-		//Create new map
-		newMap := make(map[ConnectionID]bool)
-		newMap[id] = true
-		subMap.data[uri] = newMap
-		
-	}else{
-		idMap[id] = true
+//Procedures are scoped to a realm; v1 procedures in the default realm are keyed by URI alone
+func topicKey(realm string, uri string)(string){
+	if realm == ""{
+		return uri
 	}
-	
-	subMap.lock.Unlock()
-}
-
-func (subMap *subscriptionMap) Remove(uri string, id ConnectionID){
-	subMap.lock.Lock()
-	delete(subMap.data[uri],id)
-	subMap.lock.Unlock()
-}
-
-func newSubscriptionMap()(*subscriptionMap){
-	s := new(subscriptionMap)
-	s.lock = new(sync.RWMutex)
-	s.data = make(map[string] (map[ConnectionID]bool) )
-	return s
+	return realm + " " + uri //Space can't appear in a URI
 }
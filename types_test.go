@@ -0,0 +1,73 @@
+package postmaster
+
+import(
+	"testing"
+	"time"
+)
+
+func TestSlowConsumerPolicies(t *testing.T){
+	s := NewServer()
+	s.Backlog = 2
+
+	tests := []struct{
+		policy SlowConsumerPolicy
+		maxDrops int
+		queued []string //Left in the queue after sending 1-4
+		drops uint64
+	}{
+		{DROP_NEWEST, 0, []string{"1","2"}, 2},
+		{DROP_OLDEST, 0, []string{"3","4"}, 2},
+		{DISCONNECT_AFTER_DROPS, 5, []string{"1","2"}, 2},
+		{BLOCK_WITH_TIMEOUT, 0, []string{"1","2"}, 2},
+	}
+	for _,test := range tests{
+		s.SlowConsumer = test.policy
+		s.MaxDrops = test.maxDrops
+		c := newConnection(s, "c", nil)
+
+		for _,msg := range []string{"1","2","3","4"}{
+			c.send([]byte(msg))
+		}
+		if c.Drops() != test.drops{
+			t.Errorf("policy %d: %d drops, want %d", test.policy, c.Drops(), test.drops)
+		}
+		for _,want := range test.queued{
+			if got := string(<-c.out); got != want{
+				t.Errorf("policy %d: queued %s, want %s", test.policy, got, want)
+			}
+		}
+	}
+}
+
+//A stalled client holds up a publisher for SEND_TIMEOUT at most by default
+func TestDefaultSendTimeout(t *testing.T){
+	s := NewServer()
+	s.Backlog = 1
+	c := newConnection(s, "c", nil)
+	c.send([]byte("1"))
+
+	start := time.Now()
+	if c.send([]byte("2")){
+		t.Fatal("send to full queue succeeded")
+	}
+	if waited := time.Since(start); waited < SEND_TIMEOUT || waited > 10*SEND_TIMEOUT{
+		t.Errorf("waited %s for full queue, want about %s", waited, SEND_TIMEOUT)
+	}
+}
+
+func TestDisconnectAfterDrops(t *testing.T){
+	s := NewServer()
+	s.Backlog = 1
+	s.SlowConsumer = DISCONNECT_AFTER_DROPS
+	s.MaxDrops = 1
+	c := newConnection(s, "c", nil)
+
+	for _,msg := range []string{"1","2","3"}{
+		c.send([]byte(msg))
+	}
+	select{
+	case <-c.ctx.Done():
+	default:
+		t.Fatal("slow consumer not disconnected")
+	}
+}
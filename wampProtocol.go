@@ -1,11 +1,5 @@
 package postmaster
 
-import(
-	"regexp"
-	"strconv"
-	"encoding/json"
-)
-
 ///////////////////////////////////////////////////////////////////////////////////////
 //
 // WAMP constants
@@ -27,10 +21,6 @@ const (
 
 const PROTOCOL_VERSION = 1
 
-var (
-	typeReg = regexp.MustCompile("^\\s*\\[\\s*(\\d+)\\s*,")
-)
-
 ///////////////////////////////////////////////////////////////////////////////////////
 //
 //	WAMP types
@@ -60,6 +50,11 @@ type RPCError struct {
 	Details interface{}
 }
 
+//Lets typed procedures (RegisterTypedRPC) return an *RPCError as their error
+func (e *RPCError) Error() string {
+	return e.URI + ": " + e.Description
+}
+
 ///////////////////////////////////////////////////////////////////////////////////////
 ///////////////////////////////////////////////////////////////////////////////////////
 
@@ -70,11 +65,14 @@ type WelcomeMsg struct {
 }
 
 func (msg *WelcomeMsg) UnmarshalJSON(jsonData []byte) error {
-	var data []interface{}
-	err := json.Unmarshal(jsonData, &data)
+	data, err := unmarshalArray(jsonData)
 	if err != nil {
 		return err
 	}
+	return msg.fromArray(data)
+}
+
+func (msg *WelcomeMsg) fromArray(data []interface{}) error {
 	if len(data) != 4 {
 		return ErrInvalidNumArgs
 	}
@@ -94,7 +92,49 @@ func (msg *WelcomeMsg) UnmarshalJSON(jsonData []byte) error {
 }
 
 func (msg* WelcomeMsg) MarshalJSON() ([]byte, error){
-	return createWAMPMessage(WELCOME, msg.SessionId, PROTOCOL_VERSION, POSTMASTER_SERVER_ID)
+	return createWAMPMessage(msg.toArray()...)
+}
+
+func (msg* WelcomeMsg) toArray() []interface{} {
+	return []interface{}{WELCOME, msg.SessionId, PROTOCOL_VERSION, POSTMASTER_SERVER_ID}
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+type PrefixMsg struct {
+	Prefix string
+	URI    string
+}
+
+func (msg *PrefixMsg) UnmarshalJSON(jsonData []byte) error {
+	data, err := unmarshalArray(jsonData)
+	if err != nil {
+		return err
+	}
+	return msg.fromArray(data)
+}
+
+func (msg *PrefixMsg) fromArray(data []interface{}) error {
+	if len(data) != 3 {
+		return ErrInvalidNumArgs
+	}
+	var ok bool
+	if msg.Prefix, ok = data[1].(string); !ok {
+		return &WAMPError{"invalid prefix"}
+	}
+	if msg.URI, ok = data[2].(string); !ok {
+		return &WAMPError{"invalid URI"}
+	}
+	return nil
+}
+
+func (msg* PrefixMsg) MarshalJSON() ([]byte, error){
+	return createWAMPMessage(msg.toArray()...)
+}
+
+func (msg* PrefixMsg) toArray() []interface{} {
+	return []interface{}{PREFIX, msg.Prefix, msg.URI}
 }
 
 ///////////////////////////////////////////////////////////////////////////////////////
@@ -107,11 +147,14 @@ type CallMsg struct {
 }
 
 func (msg *CallMsg) UnmarshalJSON(jsonData []byte) error {
-	var data []interface{}
-	err := json.Unmarshal(jsonData, &data)
+	data, err := unmarshalArray(jsonData)
 	if err != nil {
 		return err
 	}
+	return msg.fromArray(data)
+}
+
+func (msg *CallMsg) fromArray(data []interface{}) error {
 	if len(data) < 3 {
 		return ErrInvalidNumArgs
 	}
@@ -129,9 +172,13 @@ func (msg *CallMsg) UnmarshalJSON(jsonData []byte) error {
 }
 
 func (msg* CallMsg) MarshalJSON() ([]byte, error){
+	return createWAMPMessage(msg.toArray()...)
+}
+
+func (msg* CallMsg) toArray() []interface{} {
 	data := []interface{}{CALL, msg.CallID, msg.ProcURI}
 	data = append(data,msg.CallArgs...)
-	return createWAMPMessage(data...)
+	return data
 }
 
 ///////////////////////////////////////////////////////////////////////////////////////
@@ -143,11 +190,14 @@ type CallResultMsg struct {
 }
 
 func (msg *CallResultMsg) UnmarshalJSON(jsonData []byte) error {
-	var data []interface{}
-	err := json.Unmarshal(jsonData, &data)
+	data, err := unmarshalArray(jsonData)
 	if err != nil {
 		return err
 	}
+	return msg.fromArray(data)
+}
+
+func (msg *CallResultMsg) fromArray(data []interface{}) error {
 	if len(data) != 3 {
 		return ErrInvalidNumArgs
 	}
@@ -161,7 +211,11 @@ func (msg *CallResultMsg) UnmarshalJSON(jsonData []byte) error {
 }
 
 func (msg* CallResultMsg) MarshalJSON() ([]byte, error){
-	return createWAMPMessage(CALLRESULT, msg.CallID, msg.Result)
+	return createWAMPMessage(msg.toArray()...)
+}
+
+func (msg* CallResultMsg) toArray() []interface{} {
+	return []interface{}{CALLRESULT, msg.CallID, msg.Result}
 }
 
 ///////////////////////////////////////////////////////////////////////////////////////
@@ -175,11 +229,14 @@ type CallErrorMsg struct {
 }
 
 func (msg *CallErrorMsg) UnmarshalJSON(jsonData []byte) error {
-	var data []interface{}
-	err := json.Unmarshal(jsonData, &data)
+	data, err := unmarshalArray(jsonData)
 	if err != nil {
 		return err
 	}
+	return msg.fromArray(data)
+}
+
+func (msg *CallErrorMsg) fromArray(data []interface{}) error {
 	if len(data) < 4 || len(data) > 5 {
 		return ErrInvalidNumArgs
 	}
@@ -200,7 +257,11 @@ func (msg *CallErrorMsg) UnmarshalJSON(jsonData []byte) error {
 }
 
 func (msg* CallErrorMsg) MarshalJSON() ([]byte, error){
-	return createWAMPMessage(CALLERROR, msg.CallID, msg.ErrorURI, msg.ErrorDesc,msg.ErrorDetails)
+	return createWAMPMessage(msg.toArray()...)
+}
+
+func (msg* CallErrorMsg) toArray() []interface{} {
+	return []interface{}{CALLERROR, msg.CallID, msg.ErrorURI, msg.ErrorDesc,msg.ErrorDetails}
 }
 
 ///////////////////////////////////////////////////////////////////////////////////////
@@ -208,26 +269,46 @@ func (msg* CallErrorMsg) MarshalJSON() ([]byte, error){
 
 type SubscribeMsg struct {
 	TopicURI string
+	Match    MatchPolicy //Extension: optional {"match": "prefix"|"wildcard"} options after topicURI
 }
 
 func (msg *SubscribeMsg) UnmarshalJSON(jsonData []byte) error {
-	var data []interface{}
-	err := json.Unmarshal(jsonData, &data)
+	data, err := unmarshalArray(jsonData)
 	if err != nil {
 		return err
 	}
-	if len(data) != 2 {
+	return msg.fromArray(data)
+}
+
+func (msg *SubscribeMsg) fromArray(data []interface{}) error {
+	if len(data) < 2 || len(data) > 3 {
 		return ErrInvalidNumArgs
 	}
 	var ok bool
 	if msg.TopicURI, ok = data[1].(string); !ok {
 		return &WAMPError{"invalid topicURI"}
 	}
+	if len(data) == 3 {
+		options, ok := data[2].(map[string]interface{})
+		if !ok {
+			return &WAMPError{"invalid options"}
+		}
+		if msg.Match, ok = parseMatchPolicy(options["match"]); !ok {
+			return &WAMPError{"invalid match policy"}
+		}
+	}
 	return nil
 }
 
 func (msg* SubscribeMsg) MarshalJSON() ([]byte, error){
-	return createWAMPMessage(SUBSCRIBE, msg.TopicURI)
+	return createWAMPMessage(msg.toArray()...)
+}
+
+func (msg* SubscribeMsg) toArray() []interface{} {
+	if msg.Match != MATCH_EXACT {
+		return []interface{}{SUBSCRIBE, msg.TopicURI, map[string]interface{}{"match": msg.Match.String()}}
+	}
+	return []interface{}{SUBSCRIBE, msg.TopicURI}
 }
 
 ///////////////////////////////////////////////////////////////////////////////////////
@@ -235,26 +316,46 @@ func (msg* SubscribeMsg) MarshalJSON() ([]byte, error){
 
 type UnsubscribeMsg struct {
 	TopicURI string
+	Match    MatchPolicy //Extension: optional {"match": "prefix"|"wildcard"} options after topicURI
 }
 
 func (msg *UnsubscribeMsg) UnmarshalJSON(jsonData []byte) error {
-	var data []interface{}
-	err := json.Unmarshal(jsonData, &data)
+	data, err := unmarshalArray(jsonData)
 	if err != nil {
 		return err
 	}
-	if len(data) != 2 {
+	return msg.fromArray(data)
+}
+
+func (msg *UnsubscribeMsg) fromArray(data []interface{}) error {
+	if len(data) < 2 || len(data) > 3 {
 		return ErrInvalidNumArgs
 	}
 	var ok bool
 	if msg.TopicURI, ok = data[1].(string); !ok {
 		return &WAMPError{"invalid topicURI"}
 	}
+	if len(data) == 3 {
+		options, ok := data[2].(map[string]interface{})
+		if !ok {
+			return &WAMPError{"invalid options"}
+		}
+		if msg.Match, ok = parseMatchPolicy(options["match"]); !ok {
+			return &WAMPError{"invalid match policy"}
+		}
+	}
 	return nil
 }
 
 func (msg* UnsubscribeMsg) MarshalJSON() ([]byte, error){
-	return createWAMPMessage(UNSUBSCRIBE, msg.TopicURI)
+	return createWAMPMessage(msg.toArray()...)
+}
+
+func (msg* UnsubscribeMsg) toArray() []interface{} {
+	if msg.Match != MATCH_EXACT {
+		return []interface{}{UNSUBSCRIBE, msg.TopicURI, map[string]interface{}{"match": msg.Match.String()}}
+	}
+	return []interface{}{UNSUBSCRIBE, msg.TopicURI}
 }
 
 ///////////////////////////////////////////////////////////////////////////////////////
@@ -264,16 +365,19 @@ type PublishMsg struct {
 	TopicURI     string
 	Event        interface{}
 	ExcludeMe    bool 
-	ExcludeList  []string 
-	EligibleList []string 
+	ExcludeList  []string //Session IDs that must not receive the event
+	EligibleList []string //If non-nil, only these session IDs may receive the event
 }
 
 func (msg *PublishMsg) UnmarshalJSON(jsonData []byte) error {
-	var data []interface{}
-	err := json.Unmarshal(jsonData, &data)
+	data, err := unmarshalArray(jsonData)
 	if err != nil {
 		return err
 	}
+	return msg.fromArray(data)
+}
+
+func (msg *PublishMsg) fromArray(data []interface{}) error {
 	if len(data) < 3 || len(data) > 5 {
 		return ErrInvalidNumArgs
 	}
@@ -288,6 +392,9 @@ func (msg *PublishMsg) UnmarshalJSON(jsonData []byte) error {
 			if arr, ok = data[3].([]interface{}); !ok && data[3] != nil {
 				return &WAMPError{"invalid exclude argument"}
 			}
+			if arr != nil {
+				msg.ExcludeList = make([]string, 0, len(arr))
+			}
 			for _, v := range arr {
 				if val, ok := v.(string); !ok {
 					return &WAMPError{"invalid exclude list"}
@@ -295,25 +402,47 @@ func (msg *PublishMsg) UnmarshalJSON(jsonData []byte) error {
 					msg.ExcludeList = append(msg.ExcludeList, val)
 				}
 			}
-			if len(data) == 5 {
-				if arr, ok = data[4].([]interface{}); !ok && data[3] != nil {
-					return &WAMPError{"invalid eligable list"}
-				}
-				for _, v := range arr {
-					if val, ok := v.(string); !ok {
-						return &WAMPError{"invalid eligable list"}
-					} else {
-						msg.EligibleList = append(msg.EligibleList, val)
-					}
-				}
+		}
+	}
+	if len(data) == 5 { //Follows an exclude list or excludeMe
+		arr, ok := data[4].([]interface{})
+		if !ok && data[4] != nil {
+			return &WAMPError{"invalid eligable list"}
+		}
+		if arr != nil {
+			msg.EligibleList = make([]string, 0, len(arr)) //Present but empty means no one is eligible
+		}
+		for _, v := range arr {
+			if val, ok := v.(string); !ok {
+				return &WAMPError{"invalid eligable list"}
+			} else {
+				msg.EligibleList = append(msg.EligibleList, val)
 			}
 		}
 	}
 	return nil
 }
 
+//ExcludeMe can't be sent together with an exclude list (the publisher's session ID isn't known here)
 func (msg* PublishMsg) MarshalJSON()([]byte, error){
-	return createWAMPMessage(PUBLISH, msg.TopicURI, msg.Event,msg.ExcludeMe)
+	if msg.ExcludeMe && msg.ExcludeList != nil {
+		return nil, &WAMPError{"excludeMe can't be combined with an exclude list"}
+	}
+	return createWAMPMessage(msg.toArray()...)
+}
+
+func (msg* PublishMsg) toArray() []interface{} {
+	var exclude interface{} = msg.ExcludeMe
+	if msg.ExcludeList != nil {
+		exclude = msg.ExcludeList
+	}
+	if msg.EligibleList != nil {
+		if !msg.ExcludeMe && msg.ExcludeList == nil {
+			exclude = []string{}
+		}
+		return []interface{}{PUBLISH, msg.TopicURI, msg.Event, exclude, msg.EligibleList}
+	}
+	return []interface{}{PUBLISH, msg.TopicURI, msg.Event, exclude}
 }
 
 ///////////////////////////////////////////////////////////////////////////////////////
@@ -325,11 +454,14 @@ type EventMsg struct {
 }
 
 func (msg *EventMsg) UnmarshalJSON(jsonData []byte) error {
-	var data []interface{}
-	err := json.Unmarshal(jsonData, &data)
+	data, err := unmarshalArray(jsonData)
 	if err != nil {
 		return err
 	}
+	return msg.fromArray(data)
+}
+
+func (msg *EventMsg) fromArray(data []interface{}) error {
 	if len(data) != 3 {
 		return ErrInvalidNumArgs
 	}
@@ -343,7 +475,11 @@ func (msg *EventMsg) UnmarshalJSON(jsonData []byte) error {
 }
 
 func (msg* EventMsg) MarshalJSON() ([]byte, error){
-	return createWAMPMessage(EVENT, msg.TopicURI, msg.Event)
+	return createWAMPMessage(msg.toArray()...)
+}
+
+func (msg* EventMsg) toArray() []interface{} {
+	return []interface{}{EVENT, msg.TopicURI, msg.Event}
 }
 
 ///////////////////////////////////////////////////////////////////////////////////////
@@ -352,17 +488,8 @@ func (msg* EventMsg) MarshalJSON() ([]byte, error){
 //
 ///////////////////////////////////////////////////////////////////////////////////////
 
-func parseType(msg string) MessageType {
-	match := typeReg.FindStringSubmatch(msg)
-	if match == nil {
-		return -1
-	}
-	i, _ := strconv.Atoi(match[1])
-	return MessageType(i)
-}
-
 // createWAMPMessage returns a JSON encoded list from all the arguments passed to it
 func createWAMPMessage(args ...interface{}) ([]byte,error) {
-	return json.Marshal(args)
+	return v1Serializer{}.Serialize(args)
 }
 
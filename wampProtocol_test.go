@@ -0,0 +1,51 @@
+package postmaster
+
+import(
+	"reflect"
+	"testing"
+)
+
+func TestPublishMsgRoundTrip(t *testing.T){
+	tests := []struct{
+		msg PublishMsg
+		json string
+	}{
+		//Encodings of msg decode back to msg
+		{PublishMsg{TopicURI: "topic", Event: "hi"}, `[7,"topic","hi",false]`},
+		{PublishMsg{TopicURI: "topic", Event: "hi", ExcludeMe: true}, `[7,"topic","hi",true]`},
+		{PublishMsg{TopicURI: "topic", Event: "hi", ExcludeList: []string{"a"}}, `[7,"topic","hi",["a"]]`},
+		{PublishMsg{TopicURI: "topic", Event: "hi", ExcludeList: []string{}}, `[7,"topic","hi",[]]`},
+		{PublishMsg{TopicURI: "topic", Event: "hi", ExcludeList: []string{"a"}, EligibleList: []string{"b","c"}}, `[7,"topic","hi",["a"],["b","c"]]`},
+		{PublishMsg{TopicURI: "topic", Event: "hi", ExcludeList: []string{}, EligibleList: []string{"b"}}, `[7,"topic","hi",[],["b"]]`},
+		{PublishMsg{TopicURI: "topic", Event: "hi", ExcludeList: []string{}, EligibleList: []string{}}, `[7,"topic","hi",[],[]]`}, //No one is eligible
+		{PublishMsg{TopicURI: "topic", Event: "hi", ExcludeMe: true, EligibleList: []string{"b"}}, `[7,"topic","hi",true,["b"]]`},
+	}
+	for _,test := range tests{
+		data,err := test.msg.MarshalJSON()
+		if err != nil{
+			t.Errorf("%+v: %s", test.msg, err)
+			continue
+		}
+		if string(data) != test.json{
+			t.Errorf("%+v: encoded %s, want %s", test.msg, data, test.json)
+		}
+
+		var got PublishMsg
+		if err := got.UnmarshalJSON(data); err != nil{
+			t.Errorf("%s: %s", data, err)
+		}else if !reflect.DeepEqual(got, test.msg){
+			t.Errorf("%s: decoded %+v, want %+v", data, got, test.msg)
+		}
+	}
+
+	//An eligible list needs an exclude list before it
+	eligible := PublishMsg{TopicURI: "topic", Event: "hi", EligibleList: []string{"b"}}
+	if data,err := eligible.MarshalJSON(); err != nil || string(data) != `[7,"topic","hi",[],["b"]]`{
+		t.Errorf("eligible list alone encoded %s %v", data, err)
+	}
+
+	both := PublishMsg{TopicURI: "topic", ExcludeMe: true, ExcludeList: []string{"a"}}
+	if _,err := both.MarshalJSON(); err == nil{
+		t.Error("excludeMe with an exclude list encoded")
+	}
+}
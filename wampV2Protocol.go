@@ -0,0 +1,938 @@
+package postmaster
+
+import(
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+// WAMP v2 constants
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+const (
+	V2_HELLO MessageType = 1
+	V2_WELCOME MessageType = 2
+	V2_ABORT MessageType = 3
+	V2_GOODBYE MessageType = 6
+	V2_ERROR MessageType = 8
+	V2_PUBLISH MessageType = 16
+	V2_PUBLISHED MessageType = 17
+	V2_SUBSCRIBE MessageType = 32
+	V2_SUBSCRIBED MessageType = 33
+	V2_UNSUBSCRIBE MessageType = 34
+	V2_UNSUBSCRIBED MessageType = 35
+	V2_EVENT MessageType = 36
+	V2_CALL MessageType = 48
+	V2_RESULT MessageType = 50
+	V2_REGISTER MessageType = 64
+	V2_REGISTERED MessageType = 65
+	V2_UNREGISTER MessageType = 66
+	V2_UNREGISTERED MessageType = 67
+	V2_INVOCATION MessageType = 68
+	V2_YIELD MessageType = 70
+)
+
+//Websocket subprotocols
+const WAMP_V1_PROTOCOL = "wamp"
+const WAMP_V2_JSON_PROTOCOL = "wamp.2.json"
+const WAMP_V2_MSGPACK_PROTOCOL = "wamp.2.msgpack"
+
+//Reasons & errors (Basic Profile)
+const (
+	V2_CLOSE_NORMAL = "wamp.close.normal"
+	V2_CLOSE_GOODBYE_AND_OUT = "wamp.close.goodbye_and_out"
+	V2_CLOSE_SYSTEM_SHUTDOWN = "wamp.close.system_shutdown"
+	V2_ERROR_NO_SUCH_REALM = "wamp.error.no_such_realm"
+	V2_ERROR_NOT_AUTHORIZED = "wamp.error.not_authorized"
+	V2_ERROR_NO_SUCH_PROCEDURE = "wamp.error.no_such_procedure"
+	V2_ERROR_NO_SUCH_SUBSCRIPTION = "wamp.error.no_such_subscription"
+	V2_ERROR_INVALID_ARGUMENT = "wamp.error.invalid_argument"
+	V2_ERROR_PROTOCOL_VIOLATION = "wamp.error.protocol_violation"
+	V2_ERROR_PROCEDURE_ALREADY_EXISTS = "wamp.error.procedure_already_exists"
+	V2_ERROR_NO_SUCH_REGISTRATION = "wamp.error.no_such_registration"
+	V2_ERROR_CANCELED = "wamp.error.canceled"
+	V2_ERROR_TIMEOUT = "wamp.error.timeout"
+	V2_ERROR_RUNTIME = "wamp.error.runtime_error"
+	V2_ERROR_INTERNAL = "wamp.error.internal_error"
+)
+
+//IDs are integers in [1, 2^53]
+type WAMPID uint64
+
+const maxWAMPID = 1 << 53
+
+var (
+	idRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	idLock = new(sync.Mutex)
+)
+
+//Random ID for sessions and publications
+func newWAMPID()(WAMPID){
+	idLock.Lock()
+	defer idLock.Unlock()
+	return WAMPID(idRand.Int63n(maxWAMPID) + 1)
+}
+
+func (id WAMPID) String() string{
+	return strconv.FormatUint(uint64(id),10)
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	WAMP v2 types
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+type HelloMsg struct {
+	Realm   string
+	Details map[string]interface{}
+}
+
+func (msg *HelloMsg) UnmarshalJSON(jsonData []byte) error {
+	data, err := unmarshalV2Array(jsonData)
+	if err != nil {
+		return err
+	}
+	return msg.fromArray(data)
+}
+
+func (msg *HelloMsg) fromArray(data []interface{}) error {
+	if len(data) != 3 {
+		return ErrInvalidNumArgs
+	}
+	var ok bool
+	if msg.Realm, ok = data[1].(string); !ok {
+		return &WAMPError{"invalid realm"}
+	}
+	if msg.Details, ok = data[2].(map[string]interface{}); !ok {
+		return &WAMPError{"invalid details"}
+	}
+	return nil
+}
+
+func (msg* HelloMsg) MarshalJSON() ([]byte, error){
+	return createV2Message(msg.toArray()...)
+}
+
+func (msg* HelloMsg) toArray() []interface{} {
+	return []interface{}{V2_HELLO, msg.Realm, dict(msg.Details)}
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+type WelcomeMsgV2 struct {
+	Session WAMPID
+	Details map[string]interface{}
+}
+
+func (msg *WelcomeMsgV2) UnmarshalJSON(jsonData []byte) error {
+	data, err := unmarshalV2Array(jsonData)
+	if err != nil {
+		return err
+	}
+	return msg.fromArray(data)
+}
+
+func (msg *WelcomeMsgV2) fromArray(data []interface{}) error {
+	if len(data) != 3 {
+		return ErrInvalidNumArgs
+	}
+	var ok bool
+	if msg.Session, ok = toWAMPID(data[1]); !ok {
+		return &WAMPError{"invalid session ID"}
+	}
+	if msg.Details, ok = data[2].(map[string]interface{}); !ok {
+		return &WAMPError{"invalid details"}
+	}
+	return nil
+}
+
+func (msg* WelcomeMsgV2) MarshalJSON() ([]byte, error){
+	return createV2Message(msg.toArray()...)
+}
+
+func (msg* WelcomeMsgV2) toArray() []interface{} {
+	return []interface{}{V2_WELCOME, msg.Session, dict(msg.Details)}
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+//ABORT and GOODBYE share a format
+type AbortMsg struct {
+	Details map[string]interface{}
+	Reason  string
+}
+
+func (msg *AbortMsg) UnmarshalJSON(jsonData []byte) error {
+	data, err := unmarshalV2Array(jsonData)
+	if err != nil {
+		return err
+	}
+	return msg.fromArray(data)
+}
+
+func (msg *AbortMsg) fromArray(data []interface{}) error {
+	if len(data) != 3 {
+		return ErrInvalidNumArgs
+	}
+	var ok bool
+	if msg.Details, ok = data[1].(map[string]interface{}); !ok {
+		return &WAMPError{"invalid details"}
+	}
+	if msg.Reason, ok = data[2].(string); !ok {
+		return &WAMPError{"invalid reason"}
+	}
+	return nil
+}
+
+func (msg* AbortMsg) MarshalJSON() ([]byte, error){
+	return createV2Message(msg.toArray()...)
+}
+
+func (msg* AbortMsg) toArray() []interface{} {
+	return []interface{}{V2_ABORT, dict(msg.Details), msg.Reason}
+}
+
+type GoodbyeMsg AbortMsg
+
+func (msg *GoodbyeMsg) UnmarshalJSON(jsonData []byte) error {
+	return (*AbortMsg)(msg).UnmarshalJSON(jsonData)
+}
+
+func (msg *GoodbyeMsg) fromArray(data []interface{}) error {
+	return (*AbortMsg)(msg).fromArray(data)
+}
+
+func (msg* GoodbyeMsg) MarshalJSON() ([]byte, error){
+	return createV2Message(msg.toArray()...)
+}
+
+func (msg* GoodbyeMsg) toArray() []interface{} {
+	return []interface{}{V2_GOODBYE, dict(msg.Details), msg.Reason}
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+type ErrorMsg struct {
+	RequestType MessageType
+	Request     WAMPID
+	Details     map[string]interface{}
+	Error       string
+	Arguments   []interface{}
+	ArgumentsKw map[string]interface{}
+}
+
+func (msg *ErrorMsg) UnmarshalJSON(jsonData []byte) error {
+	data, err := unmarshalV2Array(jsonData)
+	if err != nil {
+		return err
+	}
+	return msg.fromArray(data)
+}
+
+func (msg *ErrorMsg) fromArray(data []interface{}) error {
+	var err error
+	if len(data) < 5 || len(data) > 7 {
+		return ErrInvalidNumArgs
+	}
+	var ok bool
+	if typ, ok := toWAMPID(data[1]); ok {
+		msg.RequestType = MessageType(typ)
+	} else {
+		return &WAMPError{"invalid request type"}
+	}
+	if msg.Request, ok = toWAMPID(data[2]); !ok {
+		return &WAMPError{"invalid request ID"}
+	}
+	if msg.Details, ok = data[3].(map[string]interface{}); !ok {
+		return &WAMPError{"invalid details"}
+	}
+	if msg.Error, ok = data[4].(string); !ok {
+		return &WAMPError{"invalid error URI"}
+	}
+	msg.Arguments, msg.ArgumentsKw, err = parseArguments(data[5:])
+	return err
+}
+
+func (msg* ErrorMsg) MarshalJSON() ([]byte, error){
+	return createV2Message(msg.toArray()...)
+}
+
+func (msg* ErrorMsg) toArray() []interface{} {
+	data := []interface{}{V2_ERROR, msg.RequestType, msg.Request, dict(msg.Details), msg.Error}
+	return appendArguments(data, msg.Arguments, msg.ArgumentsKw)
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+type PublishMsgV2 struct {
+	Request     WAMPID
+	Options     map[string]interface{}
+	Topic       string
+	Arguments   []interface{}
+	ArgumentsKw map[string]interface{}
+}
+
+func (msg *PublishMsgV2) UnmarshalJSON(jsonData []byte) error {
+	data, err := unmarshalV2Array(jsonData)
+	if err != nil {
+		return err
+	}
+	return msg.fromArray(data)
+}
+
+func (msg *PublishMsgV2) fromArray(data []interface{}) error {
+	var err error
+	if len(data) < 4 || len(data) > 6 {
+		return ErrInvalidNumArgs
+	}
+	var ok bool
+	if msg.Request, ok = toWAMPID(data[1]); !ok {
+		return &WAMPError{"invalid request ID"}
+	}
+	if msg.Options, ok = data[2].(map[string]interface{}); !ok {
+		return &WAMPError{"invalid options"}
+	}
+	if msg.Topic, ok = data[3].(string); !ok {
+		return &WAMPError{"invalid topic"}
+	}
+	msg.Arguments, msg.ArgumentsKw, err = parseArguments(data[4:])
+	return err
+}
+
+func (msg* PublishMsgV2) MarshalJSON() ([]byte, error){
+	return createV2Message(msg.toArray()...)
+}
+
+func (msg* PublishMsgV2) toArray() []interface{} {
+	data := []interface{}{V2_PUBLISH, msg.Request, dict(msg.Options), msg.Topic}
+	return appendArguments(data, msg.Arguments, msg.ArgumentsKw)
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+type PublishedMsg struct {
+	Request     WAMPID
+	Publication WAMPID
+}
+
+func (msg *PublishedMsg) UnmarshalJSON(jsonData []byte) error {
+	data, err := unmarshalV2Array(jsonData)
+	if err != nil {
+		return err
+	}
+	return msg.fromArray(data)
+}
+
+func (msg *PublishedMsg) fromArray(data []interface{}) error {
+	if len(data) != 3 {
+		return ErrInvalidNumArgs
+	}
+	var ok bool
+	if msg.Request, ok = toWAMPID(data[1]); !ok {
+		return &WAMPError{"invalid request ID"}
+	}
+	if msg.Publication, ok = toWAMPID(data[2]); !ok {
+		return &WAMPError{"invalid publication ID"}
+	}
+	return nil
+}
+
+func (msg* PublishedMsg) MarshalJSON() ([]byte, error){
+	return createV2Message(msg.toArray()...)
+}
+
+func (msg* PublishedMsg) toArray() []interface{} {
+	return []interface{}{V2_PUBLISHED, msg.Request, msg.Publication}
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+type SubscribeMsgV2 struct {
+	Request WAMPID
+	Options map[string]interface{}
+	Topic   string
+}
+
+func (msg *SubscribeMsgV2) UnmarshalJSON(jsonData []byte) error {
+	data, err := unmarshalV2Array(jsonData)
+	if err != nil {
+		return err
+	}
+	return msg.fromArray(data)
+}
+
+func (msg *SubscribeMsgV2) fromArray(data []interface{}) error {
+	if len(data) != 4 {
+		return ErrInvalidNumArgs
+	}
+	var ok bool
+	if msg.Request, ok = toWAMPID(data[1]); !ok {
+		return &WAMPError{"invalid request ID"}
+	}
+	if msg.Options, ok = data[2].(map[string]interface{}); !ok {
+		return &WAMPError{"invalid options"}
+	}
+	if msg.Topic, ok = data[3].(string); !ok {
+		return &WAMPError{"invalid topic"}
+	}
+	return nil
+}
+
+func (msg* SubscribeMsgV2) MarshalJSON() ([]byte, error){
+	return createV2Message(msg.toArray()...)
+}
+
+func (msg* SubscribeMsgV2) toArray() []interface{} {
+	return []interface{}{V2_SUBSCRIBE, msg.Request, dict(msg.Options), msg.Topic}
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+type SubscribedMsg struct {
+	Request      WAMPID
+	Subscription WAMPID
+}
+
+func (msg *SubscribedMsg) UnmarshalJSON(jsonData []byte) error {
+	data, err := unmarshalV2Array(jsonData)
+	if err != nil {
+		return err
+	}
+	return msg.fromArray(data)
+}
+
+func (msg *SubscribedMsg) fromArray(data []interface{}) error {
+	if len(data) != 3 {
+		return ErrInvalidNumArgs
+	}
+	var ok bool
+	if msg.Request, ok = toWAMPID(data[1]); !ok {
+		return &WAMPError{"invalid request ID"}
+	}
+	if msg.Subscription, ok = toWAMPID(data[2]); !ok {
+		return &WAMPError{"invalid subscription ID"}
+	}
+	return nil
+}
+
+func (msg* SubscribedMsg) MarshalJSON() ([]byte, error){
+	return createV2Message(msg.toArray()...)
+}
+
+func (msg* SubscribedMsg) toArray() []interface{} {
+	return []interface{}{V2_SUBSCRIBED, msg.Request, msg.Subscription}
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+type UnsubscribeMsgV2 struct {
+	Request      WAMPID
+	Subscription WAMPID
+}
+
+func (msg *UnsubscribeMsgV2) UnmarshalJSON(jsonData []byte) error {
+	data, err := unmarshalV2Array(jsonData)
+	if err != nil {
+		return err
+	}
+	return msg.fromArray(data)
+}
+
+func (msg *UnsubscribeMsgV2) fromArray(data []interface{}) error {
+	if len(data) != 3 {
+		return ErrInvalidNumArgs
+	}
+	var ok bool
+	if msg.Request, ok = toWAMPID(data[1]); !ok {
+		return &WAMPError{"invalid request ID"}
+	}
+	if msg.Subscription, ok = toWAMPID(data[2]); !ok {
+		return &WAMPError{"invalid subscription ID"}
+	}
+	return nil
+}
+
+func (msg* UnsubscribeMsgV2) MarshalJSON() ([]byte, error){
+	return createV2Message(msg.toArray()...)
+}
+
+func (msg* UnsubscribeMsgV2) toArray() []interface{} {
+	return []interface{}{V2_UNSUBSCRIBE, msg.Request, msg.Subscription}
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+type UnsubscribedMsg struct {
+	Request WAMPID
+}
+
+func (msg *UnsubscribedMsg) UnmarshalJSON(jsonData []byte) error {
+	data, err := unmarshalV2Array(jsonData)
+	if err != nil {
+		return err
+	}
+	return msg.fromArray(data)
+}
+
+func (msg *UnsubscribedMsg) fromArray(data []interface{}) error {
+	if len(data) != 2 {
+		return ErrInvalidNumArgs
+	}
+	var ok bool
+	if msg.Request, ok = toWAMPID(data[1]); !ok {
+		return &WAMPError{"invalid request ID"}
+	}
+	return nil
+}
+
+func (msg* UnsubscribedMsg) MarshalJSON() ([]byte, error){
+	return createV2Message(msg.toArray()...)
+}
+
+func (msg* UnsubscribedMsg) toArray() []interface{} {
+	return []interface{}{V2_UNSUBSCRIBED, msg.Request}
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+type EventMsgV2 struct {
+	Subscription WAMPID
+	Publication  WAMPID
+	Details      map[string]interface{}
+	Arguments    []interface{}
+	ArgumentsKw  map[string]interface{}
+}
+
+func (msg *EventMsgV2) UnmarshalJSON(jsonData []byte) error {
+	data, err := unmarshalV2Array(jsonData)
+	if err != nil {
+		return err
+	}
+	return msg.fromArray(data)
+}
+
+func (msg *EventMsgV2) fromArray(data []interface{}) error {
+	var err error
+	if len(data) < 4 || len(data) > 6 {
+		return ErrInvalidNumArgs
+	}
+	var ok bool
+	if msg.Subscription, ok = toWAMPID(data[1]); !ok {
+		return &WAMPError{"invalid subscription ID"}
+	}
+	if msg.Publication, ok = toWAMPID(data[2]); !ok {
+		return &WAMPError{"invalid publication ID"}
+	}
+	if msg.Details, ok = data[3].(map[string]interface{}); !ok {
+		return &WAMPError{"invalid details"}
+	}
+	msg.Arguments, msg.ArgumentsKw, err = parseArguments(data[4:])
+	return err
+}
+
+func (msg* EventMsgV2) MarshalJSON() ([]byte, error){
+	return createV2Message(msg.toArray()...)
+}
+
+func (msg* EventMsgV2) toArray() []interface{} {
+	data := []interface{}{V2_EVENT, msg.Subscription, msg.Publication, dict(msg.Details)}
+	return appendArguments(data, msg.Arguments, msg.ArgumentsKw)
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+type CallMsgV2 struct {
+	Request     WAMPID
+	Options     map[string]interface{}
+	Procedure   string
+	Arguments   []interface{}
+	ArgumentsKw map[string]interface{}
+}
+
+func (msg *CallMsgV2) UnmarshalJSON(jsonData []byte) error {
+	data, err := unmarshalV2Array(jsonData)
+	if err != nil {
+		return err
+	}
+	return msg.fromArray(data)
+}
+
+func (msg *CallMsgV2) fromArray(data []interface{}) error {
+	var err error
+	if len(data) < 4 || len(data) > 6 {
+		return ErrInvalidNumArgs
+	}
+	var ok bool
+	if msg.Request, ok = toWAMPID(data[1]); !ok {
+		return &WAMPError{"invalid request ID"}
+	}
+	if msg.Options, ok = data[2].(map[string]interface{}); !ok {
+		return &WAMPError{"invalid options"}
+	}
+	if msg.Procedure, ok = data[3].(string); !ok {
+		return &WAMPError{"invalid procedure"}
+	}
+	msg.Arguments, msg.ArgumentsKw, err = parseArguments(data[4:])
+	return err
+}
+
+func (msg* CallMsgV2) MarshalJSON() ([]byte, error){
+	return createV2Message(msg.toArray()...)
+}
+
+func (msg* CallMsgV2) toArray() []interface{} {
+	data := []interface{}{V2_CALL, msg.Request, dict(msg.Options), msg.Procedure}
+	return appendArguments(data, msg.Arguments, msg.ArgumentsKw)
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+type ResultMsg struct {
+	Request     WAMPID
+	Details     map[string]interface{}
+	Arguments   []interface{}
+	ArgumentsKw map[string]interface{}
+}
+
+func (msg *ResultMsg) UnmarshalJSON(jsonData []byte) error {
+	data, err := unmarshalV2Array(jsonData)
+	if err != nil {
+		return err
+	}
+	return msg.fromArray(data)
+}
+
+func (msg *ResultMsg) fromArray(data []interface{}) error {
+	var err error
+	if len(data) < 3 || len(data) > 5 {
+		return ErrInvalidNumArgs
+	}
+	var ok bool
+	if msg.Request, ok = toWAMPID(data[1]); !ok {
+		return &WAMPError{"invalid request ID"}
+	}
+	if msg.Details, ok = data[2].(map[string]interface{}); !ok {
+		return &WAMPError{"invalid details"}
+	}
+	msg.Arguments, msg.ArgumentsKw, err = parseArguments(data[3:])
+	return err
+}
+
+func (msg* ResultMsg) MarshalJSON() ([]byte, error){
+	return createV2Message(msg.toArray()...)
+}
+
+func (msg* ResultMsg) toArray() []interface{} {
+	data := []interface{}{V2_RESULT, msg.Request, dict(msg.Details)}
+	return appendArguments(data, msg.Arguments, msg.ArgumentsKw)
+}
+
+type RegisterMsg struct {
+	Request   WAMPID
+	Options   map[string]interface{}
+	Procedure string
+}
+
+func (msg *RegisterMsg) UnmarshalJSON(jsonData []byte) error {
+	data, err := unmarshalV2Array(jsonData)
+	if err != nil {
+		return err
+	}
+	return msg.fromArray(data)
+}
+
+func (msg *RegisterMsg) fromArray(data []interface{}) error {
+	if len(data) != 4 {
+		return ErrInvalidNumArgs
+	}
+	var ok bool
+	if msg.Request, ok = toWAMPID(data[1]); !ok {
+		return &WAMPError{"invalid request ID"}
+	}
+	if msg.Options, ok = data[2].(map[string]interface{}); !ok {
+		return &WAMPError{"invalid options"}
+	}
+	if msg.Procedure, ok = data[3].(string); !ok {
+		return &WAMPError{"invalid procedure"}
+	}
+	return nil
+}
+
+func (msg* RegisterMsg) MarshalJSON() ([]byte, error){
+	return createV2Message(msg.toArray()...)
+}
+
+func (msg* RegisterMsg) toArray() []interface{} {
+	return []interface{}{V2_REGISTER, msg.Request, dict(msg.Options), msg.Procedure}
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+type RegisteredMsg struct {
+	Request      WAMPID
+	Registration WAMPID
+}
+
+func (msg *RegisteredMsg) UnmarshalJSON(jsonData []byte) error {
+	data, err := unmarshalV2Array(jsonData)
+	if err != nil {
+		return err
+	}
+	return msg.fromArray(data)
+}
+
+func (msg *RegisteredMsg) fromArray(data []interface{}) error {
+	if len(data) != 3 {
+		return ErrInvalidNumArgs
+	}
+	var ok bool
+	if msg.Request, ok = toWAMPID(data[1]); !ok {
+		return &WAMPError{"invalid request ID"}
+	}
+	if msg.Registration, ok = toWAMPID(data[2]); !ok {
+		return &WAMPError{"invalid registration ID"}
+	}
+	return nil
+}
+
+func (msg* RegisteredMsg) MarshalJSON() ([]byte, error){
+	return createV2Message(msg.toArray()...)
+}
+
+func (msg* RegisteredMsg) toArray() []interface{} {
+	return []interface{}{V2_REGISTERED, msg.Request, msg.Registration}
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+type UnregisterMsg struct {
+	Request      WAMPID
+	Registration WAMPID
+}
+
+func (msg *UnregisterMsg) UnmarshalJSON(jsonData []byte) error {
+	data, err := unmarshalV2Array(jsonData)
+	if err != nil {
+		return err
+	}
+	return msg.fromArray(data)
+}
+
+func (msg *UnregisterMsg) fromArray(data []interface{}) error {
+	if len(data) != 3 {
+		return ErrInvalidNumArgs
+	}
+	var ok bool
+	if msg.Request, ok = toWAMPID(data[1]); !ok {
+		return &WAMPError{"invalid request ID"}
+	}
+	if msg.Registration, ok = toWAMPID(data[2]); !ok {
+		return &WAMPError{"invalid registration ID"}
+	}
+	return nil
+}
+
+func (msg* UnregisterMsg) MarshalJSON() ([]byte, error){
+	return createV2Message(msg.toArray()...)
+}
+
+func (msg* UnregisterMsg) toArray() []interface{} {
+	return []interface{}{V2_UNREGISTER, msg.Request, msg.Registration}
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+type UnregisteredMsg struct {
+	Request WAMPID
+}
+
+func (msg *UnregisteredMsg) UnmarshalJSON(jsonData []byte) error {
+	data, err := unmarshalV2Array(jsonData)
+	if err != nil {
+		return err
+	}
+	return msg.fromArray(data)
+}
+
+func (msg *UnregisteredMsg) fromArray(data []interface{}) error {
+	if len(data) != 2 {
+		return ErrInvalidNumArgs
+	}
+	var ok bool
+	if msg.Request, ok = toWAMPID(data[1]); !ok {
+		return &WAMPError{"invalid request ID"}
+	}
+	return nil
+}
+
+func (msg* UnregisteredMsg) MarshalJSON() ([]byte, error){
+	return createV2Message(msg.toArray()...)
+}
+
+func (msg* UnregisteredMsg) toArray() []interface{} {
+	return []interface{}{V2_UNREGISTERED, msg.Request}
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+type InvocationMsg struct {
+	Request      WAMPID
+	Registration WAMPID
+	Details      map[string]interface{}
+	Arguments    []interface{}
+	ArgumentsKw  map[string]interface{}
+}
+
+func (msg *InvocationMsg) UnmarshalJSON(jsonData []byte) error {
+	data, err := unmarshalV2Array(jsonData)
+	if err != nil {
+		return err
+	}
+	return msg.fromArray(data)
+}
+
+func (msg *InvocationMsg) fromArray(data []interface{}) error {
+	var err error
+	if len(data) < 4 || len(data) > 6 {
+		return ErrInvalidNumArgs
+	}
+	var ok bool
+	if msg.Request, ok = toWAMPID(data[1]); !ok {
+		return &WAMPError{"invalid request ID"}
+	}
+	if msg.Registration, ok = toWAMPID(data[2]); !ok {
+		return &WAMPError{"invalid registration ID"}
+	}
+	if msg.Details, ok = data[3].(map[string]interface{}); !ok {
+		return &WAMPError{"invalid details"}
+	}
+	msg.Arguments, msg.ArgumentsKw, err = parseArguments(data[4:])
+	return err
+}
+
+func (msg* InvocationMsg) MarshalJSON() ([]byte, error){
+	return createV2Message(msg.toArray()...)
+}
+
+func (msg* InvocationMsg) toArray() []interface{} {
+	data := []interface{}{V2_INVOCATION, msg.Request, msg.Registration, dict(msg.Details)}
+	return appendArguments(data, msg.Arguments, msg.ArgumentsKw)
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+///////////////////////////////////////////////////////////////////////////////////////
+
+type YieldMsg struct {
+	Request     WAMPID
+	Options     map[string]interface{}
+	Arguments   []interface{}
+	ArgumentsKw map[string]interface{}
+}
+
+func (msg *YieldMsg) UnmarshalJSON(jsonData []byte) error {
+	data, err := unmarshalV2Array(jsonData)
+	if err != nil {
+		return err
+	}
+	return msg.fromArray(data)
+}
+
+func (msg *YieldMsg) fromArray(data []interface{}) error {
+	var err error
+	if len(data) < 3 || len(data) > 5 {
+		return ErrInvalidNumArgs
+	}
+	var ok bool
+	if msg.Request, ok = toWAMPID(data[1]); !ok {
+		return &WAMPError{"invalid request ID"}
+	}
+	if msg.Options, ok = data[2].(map[string]interface{}); !ok {
+		return &WAMPError{"invalid options"}
+	}
+	msg.Arguments, msg.ArgumentsKw, err = parseArguments(data[3:])
+	return err
+}
+
+func (msg* YieldMsg) MarshalJSON() ([]byte, error){
+	return createV2Message(msg.toArray()...)
+}
+
+func (msg* YieldMsg) toArray() []interface{} {
+	data := []interface{}{V2_YIELD, msg.Request, dict(msg.Options)}
+	return appendArguments(data, msg.Arguments, msg.ArgumentsKw)
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+//
+//	Utility Functions
+//
+///////////////////////////////////////////////////////////////////////////////////////
+
+//Converts a decoded JSON number to an ID
+func toWAMPID(v interface{}) (WAMPID, bool) {
+	f, ok := v.(float64)
+	if !ok || f < 0 || f > maxWAMPID || f != float64(uint64(f)) {
+		return 0, false
+	}
+	return WAMPID(f), true
+}
+
+//Parses the optional trailing Arguments|list, ArgumentsKw|dict of a message
+func parseArguments(data []interface{}) ([]interface{}, map[string]interface{}, error) {
+	var args []interface{}
+	var kwargs map[string]interface{}
+	var ok bool
+	if len(data) > 0 {
+		if args, ok = data[0].([]interface{}); !ok {
+			return nil, nil, &WAMPError{"invalid arguments"}
+		}
+	}
+	if len(data) > 1 {
+		if kwargs, ok = data[1].(map[string]interface{}); !ok {
+			return nil, nil, &WAMPError{"invalid keyword arguments"}
+		}
+	}
+	return args, kwargs, nil
+}
+
+//Appends Arguments|list, ArgumentsKw|dict, leaving out empty trailing elements
+func appendArguments(data []interface{}, args []interface{}, kwargs map[string]interface{}) []interface{} {
+	if kwargs != nil {
+		if args == nil {
+			args = []interface{}{}
+		}
+		return append(data, args, kwargs)
+	} else if args != nil {
+		return append(data, args)
+	}
+	return data
+}
+
+//Dictionaries are always sent as objects, never null
+func dict(d map[string]interface{}) map[string]interface{} {
+	if d == nil {
+		return map[string]interface{}{}
+	}
+	return d
+}